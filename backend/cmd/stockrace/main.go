@@ -0,0 +1,127 @@
+// Command stockrace fires parallel orders at a single product against a running
+// backend and checks that stock never goes negative. Point it at a product with
+// low stock: exactly min(stock, n) orders should succeed and the rest get 409.
+//
+//	go run ./cmd/stockrace -product 3 -n 50 -token "$ACCESS_TOKEN"
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+)
+
+func main() {
+	api := flag.String("api", "http://localhost:8080/api", "backend base URL")
+	productID := flag.Int("product", 0, "product to order")
+	n := flag.Int("n", 20, "number of concurrent orders")
+	quantity := flag.Int("quantity", 1, "quantity per order")
+	token := flag.String("token", "", "access token of a verified user")
+	flag.Parse()
+
+	if *productID <= 0 {
+		log.Fatal("-product is required")
+	}
+	if *token == "" {
+		log.Fatal("-token is required")
+	}
+
+	before, err := productStock(*api, *productID)
+	if err != nil {
+		log.Fatalf("read stock: %v", err)
+	}
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"customer_name":  "Stock Race",
+		"customer_email": "stockrace@example.com",
+		"customer_phone": "0000",
+		"items":          []map[string]int{{"product_id": *productID, "quantity": *quantity}},
+		"shipping_address": map[string]string{
+			"recipient_name": "Stock Race",
+			"phone":          "0000",
+			"street":         "Jl. Stock Race 1",
+			"city":           "Jakarta",
+		},
+	})
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		statuses = make(map[int]int)
+	)
+	start := make(chan struct{})
+	for i := 0; i < *n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+
+			req, _ := http.NewRequest(http.MethodPost, *api+"/orders", bytes.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Authorization", "Bearer "+*token)
+
+			status := -1
+			if resp, err := http.DefaultClient.Do(req); err == nil {
+				status = resp.StatusCode
+				resp.Body.Close()
+			}
+
+			mu.Lock()
+			statuses[status]++
+			mu.Unlock()
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	after, err := productStock(*api, *productID)
+	if err != nil {
+		log.Fatalf("read stock: %v", err)
+	}
+
+	fmt.Printf("stock before: %d, after: %d\n", before, after)
+	for status, count := range statuses {
+		fmt.Printf("HTTP %d: %d\n", status, count)
+	}
+
+	want := before / *quantity
+	if want > *n {
+		want = *n
+	}
+	created := statuses[http.StatusCreated]
+	switch {
+	case after < 0:
+		fmt.Println("FAIL: stock went negative")
+		os.Exit(1)
+	case created != want:
+		fmt.Printf("FAIL: %d orders created, expected %d\n", created, want)
+		os.Exit(1)
+	case before-after != created**quantity:
+		fmt.Printf("FAIL: stock dropped by %d for %d orders\n", before-after, created)
+		os.Exit(1)
+	}
+	fmt.Println("OK")
+}
+
+func productStock(api string, productID int) (int, error) {
+	resp, err := http.Get(fmt.Sprintf("%s/products/%d", api, productID))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	var out struct {
+		Data struct {
+			Stock int `json:"stock"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return 0, err
+	}
+	return out.Data.Stock, nil
+}
@@ -0,0 +1,96 @@
+// Command webhooksim posts signed payment webhook fixtures to a running
+// backend, standing in for the payment provider during local development.
+//
+//	go run ./cmd/webhooksim -secret "$PAYMENT_WEBHOOK_SECRET" -fixture paid -ref fake_ch_...
+//
+// -event sets the event id (a fresh one is generated by default, pass the same
+// value twice to check deduplication), -age sends a stale timestamp to check
+// replay protection and -tamper changes the body after signing.
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"embed"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"guaagsay/backend/handlers"
+)
+
+//go:embed fixtures/*.json
+var fixtures embed.FS
+
+func main() {
+	api := flag.String("api", "http://localhost:8080/api", "backend base URL")
+	secret := flag.String("secret", os.Getenv("PAYMENT_WEBHOOK_SECRET"), "webhook signing secret")
+	fixture := flag.String("fixture", "paid", "fixture name: paid, failed or expired")
+	file := flag.String("file", "", "post this JSON file instead of a built-in fixture")
+	ref := flag.String("ref", "", "provider_ref of the payment to update")
+	eventID := flag.String("event", "", "event id (random when empty)")
+	age := flag.Duration("age", 0, "backdate the signature timestamp by this much")
+	tamper := flag.Bool("tamper", false, "modify the body after signing")
+	flag.Parse()
+
+	if *secret == "" {
+		log.Fatal("-secret or PAYMENT_WEBHOOK_SECRET is required")
+	}
+
+	var raw []byte
+	var err error
+	if *file != "" {
+		raw, err = os.ReadFile(*file)
+	} else {
+		raw, err = fixtures.ReadFile("fixtures/" + *fixture + ".json")
+	}
+	if err != nil {
+		log.Fatalf("read fixture: %v", err)
+	}
+
+	var event map[string]interface{}
+	if err := json.Unmarshal(raw, &event); err != nil {
+		log.Fatalf("parse fixture: %v", err)
+	}
+	if *ref != "" {
+		event["provider_ref"] = *ref
+	}
+	if *eventID != "" {
+		event["event_id"] = *eventID
+	} else {
+		b := make([]byte, 8)
+		rand.Read(b)
+		event["event_id"] = "evt_" + hex.EncodeToString(b)
+	}
+
+	body, _ := json.Marshal(event)
+	timestamp := time.Now().Add(-*age).Unix()
+	signature := handlers.SignPaymentWebhook([]byte(*secret), timestamp, body)
+	if *tamper {
+		body = append(body, ' ')
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, *api+"/payments/webhook", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(handlers.WebhookTimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(handlers.WebhookSignatureHeader, signature)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Fatalf("post webhook: %v", err)
+	}
+	defer resp.Body.Close()
+	out, _ := io.ReadAll(resp.Body)
+
+	fmt.Printf("> %s\n< HTTP %d %s", body, resp.StatusCode, out)
+	if resp.StatusCode >= 300 {
+		os.Exit(1)
+	}
+}
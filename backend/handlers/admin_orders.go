@@ -1,9 +1,12 @@
 package handlers
 
 import (
+	"database/sql"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/gorilla/mux"
 )
@@ -13,9 +16,10 @@ func (h *Handler) GetAllOrders(w http.ResponseWriter, r *http.Request) {
 	status := r.URL.Query().Get("status")
 
 	query := `
-		SELECT o.id, o.user_id, u.full_name, u.email, o.total_amount, o.status, o.created_at
+		SELECT o.id, o.user_id, COALESCE(u.full_name, o.customer_name), COALESCE(u.email, o.customer_email),
+			o.total_amount, o.status, o.created_at
 		FROM orders o
-		JOIN users u ON o.user_id = u.id
+		LEFT JOIN users u ON o.user_id = u.id
 	`
 	args := []interface{}{}
 
@@ -36,7 +40,8 @@ func (h *Handler) GetAllOrders(w http.ResponseWriter, r *http.Request) {
 	var orders []map[string]interface{}
 	for rows.Next() {
 		var (
-			id, userID      int
+			id              int
+			userID          sql.NullInt64
 			fullName, email string
 			totalAmount     float64
 			orderStatus     string
@@ -50,7 +55,7 @@ func (h *Handler) GetAllOrders(w http.ResponseWriter, r *http.Request) {
 
 		orders = append(orders, map[string]interface{}{
 			"id":           id,
-			"user_id":      userID,
+			"user_id":      nullableInt(userID),
 			"customer":     fullName,
 			"email":        email,
 			"total_amount": totalAmount,
@@ -73,20 +78,24 @@ func (h *Handler) GetOrderDetails(w http.ResponseWriter, r *http.Request) {
 
 	// Get order info
 	var (
-		userID      int
+		userID      sql.NullInt64
+		phone       string
+		shipping    sql.NullString
 		fullName    string
 		email       string
 		totalAmount float64
+		refunded    float64
 		status      string
 		createdAt   string
 	)
 
 	err = h.DB.QueryRow(`
-		SELECT o.user_id, u.full_name, u.email, o.total_amount, o.status, o.created_at
+		SELECT o.user_id, COALESCE(u.full_name, o.customer_name), COALESCE(u.email, o.customer_email),
+			o.customer_phone, o.shipping_address, o.total_amount, o.refunded_amount, o.status, o.created_at
 		FROM orders o
-		JOIN users u ON o.user_id = u.id
+		LEFT JOIN users u ON o.user_id = u.id
 		WHERE o.id = ?
-	`, id).Scan(&userID, &fullName, &email, &totalAmount, &status, &createdAt)
+	`, id).Scan(&userID, &fullName, &email, &phone, &shipping, &totalAmount, &refunded, &status, &createdAt)
 
 	if err != nil {
 		respondError(w, http.StatusNotFound, "Order not found")
@@ -95,7 +104,7 @@ func (h *Handler) GetOrderDetails(w http.ResponseWriter, r *http.Request) {
 
 	// Get order items
 	rows, err := h.DB.Query(`
-		SELECT oi.product_id, p.name, oi.quantity, oi.price
+		SELECT oi.id, oi.product_id, p.name, oi.quantity, oi.refunded_quantity, oi.price
 		FROM order_items oi
 		JOIN products p ON oi.product_id = p.id
 		WHERE oi.order_id = ?
@@ -110,34 +119,72 @@ func (h *Handler) GetOrderDetails(w http.ResponseWriter, r *http.Request) {
 	var items []map[string]interface{}
 	for rows.Next() {
 		var (
+			itemID    int
 			productID int
 			name      string
 			quantity  int
+			refundedQ int
 			price     float64
 		)
 
-		rows.Scan(&productID, &name, &quantity, &price)
+		rows.Scan(&itemID, &productID, &name, &quantity, &refundedQ, &price)
 		items = append(items, map[string]interface{}{
-			"product_id": productID,
-			"name":       name,
-			"quantity":   quantity,
-			"price":      price,
+			"id":                itemID,
+			"product_id":        productID,
+			"name":              name,
+			"quantity":          quantity,
+			"refunded_quantity": refundedQ,
+			"price":             price,
 		})
 	}
 
+	history, err := loadOrderHistory(h.DB, id)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to fetch order history")
+		return
+	}
+
+	payments, err := loadPayments(h.DB, id)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to fetch payments")
+		return
+	}
+
+	refunds, err := loadRefunds(h.DB, id)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to fetch refunds")
+		return
+	}
+
+	returns, err := loadReturns(h.DB, "r.order_id = ?", "", id)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to fetch returns")
+		return
+	}
+
 	respondSuccess(w, map[string]interface{}{
-		"id":           id,
-		"user_id":      userID,
-		"customer":     fullName,
-		"email":        email,
-		"total_amount": totalAmount,
-		"status":       status,
-		"created_at":   createdAt,
-		"items":        items,
+		"id":               id,
+		"user_id":          nullableInt(userID),
+		"customer":         fullName,
+		"email":            email,
+		"phone":            phone,
+		"shipping_address": decodeShippingAddress(shipping),
+		"total_amount":     totalAmount,
+		"refunded_amount":  refunded,
+		"net_amount":       totalAmount - refunded,
+		"status":           status,
+		"created_at":       createdAt,
+		"items":            items,
+		"history":          history,
+		"payments":         payments,
+		"refunds":          refunds,
+		"returns":          returns,
 	})
 }
 
-// UpdateOrderStatus updates the status of an order
+// UpdateOrderStatus moves an order to a new status allowed by the order state
+// machine. Cancelling a paid order refunds it in full the same way a customer
+// cancellation does, which also needs orders:refund, and tells the customer.
 func (h *Handler) UpdateOrderStatus(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id, err := strconv.Atoi(vars["id"])
@@ -148,6 +195,7 @@ func (h *Handler) UpdateOrderStatus(w http.ResponseWriter, r *http.Request) {
 
 	var req struct {
 		Status string `json:"status"`
+		Note   string `json:"note"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -155,28 +203,84 @@ func (h *Handler) UpdateOrderStatus(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	validStatuses := map[string]bool{
-		"pending":    true,
-		"processing": true,
-		"completed":  true,
-		"cancelled":  true,
-	}
-
-	if !validStatuses[req.Status] {
+	if _, ok := orderTransitions[req.Status]; !ok {
 		respondError(w, http.StatusBadRequest, "Invalid status")
 		return
 	}
 
-	_, err = h.DB.Exec("UPDATE orders SET status = ? WHERE id = ?", req.Status, id)
+	tx, err := h.DB.Begin()
 	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	principal, _ := principalFromContext(r.Context())
+	from, err := transitionOrder(tx, id, req.Status, principal.UserID, req.Note)
+	switch {
+	case err == sql.ErrNoRows:
+		respondError(w, http.StatusNotFound, "Order not found")
+		return
+	case err == errIllegalTransition:
+		respondError(w, http.StatusConflict, fmt.Sprintf("Cannot change order status from %s to %s", from, req.Status))
+		return
+	case err != nil:
 		respondError(w, http.StatusInternalServerError, "Failed to update order status")
 		return
 	}
 
-	respondSuccess(w, map[string]interface{}{
+	var (
+		refundID int
+		amount   float64
+	)
+	if req.Status == OrderCancelled {
+		reason := "Cancelled by staff"
+		if note := strings.TrimSpace(req.Note); note != "" {
+			reason += ": " + note
+		}
+		refundID, amount, err = h.refundCancelledOrder(tx, id, reason, principal.UserID)
+		if err != nil {
+			respondRefundError(w, err)
+			return
+		}
+		if refundID != 0 && !hasPermission(principal.Role, PermOrdersRefund) {
+			respondError(w, http.StatusForbidden, "Cancelling a paid order refunds it and needs the orders:refund permission")
+			return
+		}
+
+		body := "Pesanan Anda dibatalkan oleh toko."
+		if refundID != 0 {
+			body += fmt.Sprintf(" Dana sebesar %.2f akan dikembalikan.", amount)
+		}
+		if _, err := tx.Exec(`
+			INSERT INTO notifications (user_id, title, body, type)
+			SELECT user_id, ?, ?, 'order' FROM orders WHERE id = ? AND user_id IS NOT NULL
+		`, fmt.Sprintf("Pesanan #%d dibatalkan", id), body, id); err != nil {
+			respondError(w, http.StatusInternalServerError, "Failed to update order status")
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to update order status")
+		return
+	}
+
+	// As in CancelOrder, a declined refund is reported to staff by
+	// completeRefund and an unreachable gateway is retried by the hold sweeper
+	data := map[string]interface{}{
 		"id":     id,
 		"status": req.Status,
-	})
+	}
+	if refundID != 0 {
+		refundStatus := h.completeRefund(refundID)
+		data["refunded"] = 0.0
+		if refundStatus == RefundCompleted {
+			data["refunded"] = amount
+		}
+		data["refund_status"] = refundStatus
+	}
+	respondSuccess(w, data)
 }
 
 // GetDashboardStats returns statistics for the admin dashboard
@@ -186,12 +290,14 @@ func (h *Handler) GetDashboardStats(w http.ResponseWriter, r *http.Request) {
 		TotalOrders    int     `json:"total_orders"`
 		TotalCustomers int     `json:"total_customers"`
 		TotalRevenue   float64 `json:"total_revenue"`
+		TotalRefunded  float64 `json:"total_refunded"`
 	}
 
 	h.DB.QueryRow("SELECT COUNT(*) FROM products").Scan(&stats.TotalProducts)
 	h.DB.QueryRow("SELECT COUNT(*) FROM orders").Scan(&stats.TotalOrders)
 	h.DB.QueryRow("SELECT COUNT(*) FROM users WHERE role = 'user'").Scan(&stats.TotalCustomers)
-	h.DB.QueryRow("SELECT COALESCE(SUM(total_amount), 0) FROM orders WHERE status = 'completed'").Scan(&stats.TotalRevenue)
+	h.DB.QueryRow("SELECT COALESCE(SUM(total_amount - refunded_amount), 0) FROM orders WHERE status = 'delivered'").Scan(&stats.TotalRevenue)
+	h.DB.QueryRow("SELECT COALESCE(SUM(amount), 0) FROM refunds WHERE status <> 'failed'").Scan(&stats.TotalRefunded)
 
 	respondSuccess(w, stats)
 }
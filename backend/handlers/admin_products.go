@@ -9,20 +9,6 @@ import (
 	"github.com/gorilla/mux"
 )
 
-// AdminMiddleware checks if the user has admin role
-func (h *Handler) AdminMiddleware(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		// In a real app, you'd check JWT token or session
-		// For now, we'll check a header
-		role := r.Header.Get("X-User-Role")
-		if role != "admin" {
-			respondError(w, http.StatusForbidden, "Admin access required")
-			return
-		}
-		next(w, r)
-	}
-}
-
 // GetAllProducts returns all products for admin
 func (h *Handler) GetAllProducts(w http.ResponseWriter, r *http.Request) {
 	rows, err := h.DB.Query(`
@@ -0,0 +1,324 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// AdminUser is the staff view of a user account.
+type AdminUser struct {
+	ID            int     `json:"id"`
+	Email         string  `json:"email"`
+	FullName      string  `json:"full_name"`
+	Phone         string  `json:"phone"`
+	Role          string  `json:"role"`
+	IsActive      bool    `json:"is_active"`
+	EmailVerified bool    `json:"email_verified"`
+	LastLogin     *string `json:"last_login"`
+	CreatedAt     string  `json:"created_at"`
+}
+
+const adminUserColumns = `id, email, full_name, COALESCE(phone, ''), role, is_active,
+	email_verified_at IS NOT NULL, last_login, created_at`
+
+func scanAdminUser(row interface{ Scan(...interface{}) error }) (AdminUser, error) {
+	var (
+		u         AdminUser
+		isActive  int
+		lastLogin sql.NullString
+	)
+	err := row.Scan(&u.ID, &u.Email, &u.FullName, &u.Phone, &u.Role, &isActive, &u.EmailVerified, &lastLogin, &u.CreatedAt)
+	u.IsActive = isActive == 1
+	if lastLogin.Valid {
+		u.LastLogin = &lastLogin.String
+	}
+	return u, err
+}
+
+// escapeLike escapes the LIKE wildcards in s so it matches literally.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+// canManageUser reports whether a staff member with actorRole may deactivate or
+// reset the password of an account with targetRole. Admin accounts and above
+// are reserved for super admins.
+func canManageUser(actorRole, targetRole string) bool {
+	if targetRole == RoleAdmin || targetRole == RoleSuperAdmin {
+		return actorRole == RoleSuperAdmin
+	}
+	return true
+}
+
+// GetUsers lists users with optional search, role and active filters and pagination.
+func (h *Handler) GetUsers(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	page, limit, offset := parsePagination(r)
+
+	where := " WHERE 1=1"
+	var args []interface{}
+
+	if search := q.Get("search"); search != "" {
+		where += " AND (email LIKE ? OR full_name LIKE ? OR phone LIKE ?)"
+		pattern := "%" + escapeLike(search) + "%"
+		args = append(args, pattern, pattern, pattern)
+	}
+
+	if role := q.Get("role"); role != "" {
+		where += " AND role = ?"
+		args = append(args, role)
+	}
+
+	if active := q.Get("active"); active != "" {
+		where += " AND is_active = ?"
+		args = append(args, boolToInt(active == "true" || active == "1"))
+	}
+
+	var total int
+	if err := h.DB.QueryRow("SELECT COUNT(*) FROM users"+where, args...).Scan(&total); err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to count users")
+		return
+	}
+
+	rows, err := h.DB.Query(
+		"SELECT "+adminUserColumns+" FROM users"+where+" ORDER BY created_at DESC LIMIT ? OFFSET ?",
+		append(args, limit, offset)...,
+	)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to fetch users")
+		return
+	}
+	defer rows.Close()
+
+	users := []AdminUser{}
+	for rows.Next() {
+		u, err := scanAdminUser(rows)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, "Failed to scan user")
+			return
+		}
+		users = append(users, u)
+	}
+
+	respondSuccess(w, map[string]interface{}{
+		"users": users,
+		"page":  page,
+		"limit": limit,
+		"total": total,
+	})
+}
+
+// GetUserDetails returns a user together with their orders and addresses.
+func (h *Handler) GetUserDetails(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+
+	user, err := scanAdminUser(h.DB.QueryRow("SELECT "+adminUserColumns+" FROM users WHERE id = ?", id))
+	if err != nil {
+		respondError(w, http.StatusNotFound, "User not found")
+		return
+	}
+
+	orderRows, err := h.DB.Query(
+		"SELECT id, customer_name, customer_email, customer_phone, total_amount, status, created_at FROM orders WHERE user_id = ? ORDER BY created_at DESC",
+		id,
+	)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to fetch orders")
+		return
+	}
+	defer orderRows.Close()
+
+	orders := []Order{}
+	for orderRows.Next() {
+		var o Order
+		if err := orderRows.Scan(&o.ID, &o.CustomerName, &o.CustomerEmail, &o.CustomerPhone, &o.TotalAmount, &o.Status, &o.CreatedAt); err != nil {
+			respondError(w, http.StatusInternalServerError, "Failed to scan order")
+			return
+		}
+		orders = append(orders, o)
+	}
+
+	addressRows, err := h.DB.Query(
+		`SELECT id, user_id, label, recipient_name, phone, street, city, state, postal_code, is_default, created_at
+		 FROM addresses
+		 WHERE user_id = ?
+		 ORDER BY is_default DESC, created_at DESC`,
+		id,
+	)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to fetch addresses")
+		return
+	}
+	defer addressRows.Close()
+
+	addresses := []Address{}
+	for addressRows.Next() {
+		var a Address
+		var isDefault int
+		if err := addressRows.Scan(&a.ID, &a.UserID, &a.Label, &a.RecipientName, &a.Phone, &a.Street, &a.City, &a.State, &a.PostalCode, &isDefault, &a.CreatedAt); err != nil {
+			respondError(w, http.StatusInternalServerError, "Failed to scan address")
+			return
+		}
+		a.IsDefault = isDefault == 1
+		addresses = append(addresses, a)
+	}
+
+	respondSuccess(w, map[string]interface{}{
+		"user":      user,
+		"orders":    orders,
+		"addresses": addresses,
+	})
+}
+
+// UpdateUserStatus activates or deactivates an account. Deactivation signs the user out everywhere.
+func (h *Handler) UpdateUserStatus(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+
+	var req struct {
+		IsActive *bool `json:"is_active"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.IsActive == nil {
+		respondError(w, http.StatusBadRequest, "is_active is required")
+		return
+	}
+
+	principal, _ := principalFromContext(r.Context())
+	if id == principal.UserID && !*req.IsActive {
+		respondError(w, http.StatusConflict, "You cannot deactivate your own account")
+		return
+	}
+
+	tx, err := h.DB.Begin()
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	var role string
+	if err := tx.QueryRow("SELECT role FROM users WHERE id = ? FOR UPDATE", id).Scan(&role); err != nil {
+		respondError(w, http.StatusNotFound, "User not found")
+		return
+	}
+
+	if !canManageUser(principal.Role, role) {
+		respondError(w, http.StatusForbidden, "Permission denied")
+		return
+	}
+
+	if _, err := tx.Exec("UPDATE users SET is_active = ? WHERE id = ?", boolToInt(*req.IsActive), id); err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to update user")
+		return
+	}
+
+	action := "user_activated"
+	if !*req.IsActive {
+		action = "user_deactivated"
+		if err := revokeUserSessions(tx, id); err != nil {
+			respondError(w, http.StatusInternalServerError, "Failed to update user")
+			return
+		}
+	}
+	h.audit(tx, principal.UserID, action, "user", id, "")
+
+	if err := tx.Commit(); err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to update user")
+		return
+	}
+
+	respondSuccess(w, map[string]interface{}{
+		"id":        id,
+		"is_active": *req.IsActive,
+	})
+}
+
+// ForcePasswordReset invalidates a user's password and sessions and emails them a reset token.
+func (h *Handler) ForcePasswordReset(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+
+	principal, _ := principalFromContext(r.Context())
+
+	// Replace the password with one nobody knows so only the emailed token can restore access.
+	unusable, err := randomToken(32)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to reset password")
+		return
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(unusable), bcrypt.DefaultCost)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to reset password")
+		return
+	}
+
+	tx, err := h.DB.Begin()
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	var email, role string
+	if err := tx.QueryRow("SELECT email, role FROM users WHERE id = ? FOR UPDATE", id).Scan(&email, &role); err != nil {
+		respondError(w, http.StatusNotFound, "User not found")
+		return
+	}
+
+	if !canManageUser(principal.Role, role) {
+		respondError(w, http.StatusForbidden, "Permission denied")
+		return
+	}
+
+	if _, err := tx.Exec("UPDATE users SET password_hash = ?, password_changed_at = NOW() WHERE id = ?", string(hash), id); err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to reset password")
+		return
+	}
+
+	if err := revokeUserSessions(tx, id); err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to reset password")
+		return
+	}
+
+	token, err := h.createPasswordReset(tx, id)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to reset password")
+		return
+	}
+
+	h.audit(tx, principal.UserID, "password_reset_forced", "user", id, "")
+
+	if err := tx.Commit(); err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to reset password")
+		return
+	}
+
+	if err := h.mailPasswordReset(email, token, "Administrator telah mereset password akun Anda. Silakan buat password baru."); err != nil {
+		respondError(w, http.StatusInternalServerError, "Password was reset but the email could not be sent")
+		return
+	}
+
+	respondSuccess(w, map[string]interface{}{
+		"id":      id,
+		"message": "Password reset email sent",
+	})
+}
@@ -0,0 +1,280 @@
+package handlers
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// adminRequest builds a request to an admin user route made by principal.
+func adminRequest(method, target, body, id string, principal Principal) *http.Request {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if id != "" {
+		req = mux.SetURLVars(req, map[string]string{"id": id})
+	}
+	return req.WithContext(withPrincipal(req.Context(), principal))
+}
+
+// adminUserRow is the adminUserColumns row of a user on a fakeDB.
+func adminUserRow(id int64, email, role string) []driver.Value {
+	return []driver.Value{id, email, "Test User", "", role, int64(1), true, nil, "2026-01-01 00:00:00"}
+}
+
+func TestGetUsers(t *testing.T) {
+	db, f := newFakeDB(t)
+	h := &Handler{DB: db}
+
+	var countArgs, listArgs []driver.Value
+	f.on("SELECT COUNT(*) FROM users", func(args []driver.Value) fakeResult {
+		countArgs = args
+		return row(int64(11))
+	})
+	f.on("FROM users WHERE 1=1", func(args []driver.Value) fakeResult {
+		listArgs = args
+		return row(adminUserRow(3, "budi@example.com", RoleUser)...)
+	})
+
+	admin := Principal{UserID: 1, Role: RoleAdmin}
+	rec := httptest.NewRecorder()
+	h.GetUsers(rec, adminRequest("GET", "/api/admin/users?search=budi&role=user&active=false&page=2&limit=10", "", "", admin))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+
+	wantFilter := []driver.Value{"%budi%", "%budi%", "%budi%", "user", int64(0)}
+	if !reflect.DeepEqual(countArgs, wantFilter) {
+		t.Errorf("count args %v, want %v", countArgs, wantFilter)
+	}
+	if want := append(wantFilter, int64(10), int64(10)); !reflect.DeepEqual(listArgs, want) {
+		t.Errorf("list args %v, want %v", listArgs, want)
+	}
+
+	var resp struct {
+		Data struct {
+			Users []AdminUser `json:"users"`
+			Page  int         `json:"page"`
+			Total int         `json:"total"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Data.Total != 11 || resp.Data.Page != 2 || len(resp.Data.Users) != 1 || resp.Data.Users[0].Email != "budi@example.com" {
+		t.Errorf("response %+v", resp.Data)
+	}
+}
+
+func TestGetUserDetails(t *testing.T) {
+	db, f := newFakeDB(t)
+	h := &Handler{DB: db}
+
+	f.on("FROM users WHERE id = ?", func(args []driver.Value) fakeResult {
+		if args[0] != int64(3) {
+			return fakeResult{}
+		}
+		return row(adminUserRow(3, "budi@example.com", RoleUser)...)
+	})
+	f.on("FROM orders WHERE user_id = ?", func([]driver.Value) fakeResult {
+		return row(int64(7), "Budi", "budi@example.com", "0812", 150000.0, "pending", "2026-01-02 00:00:00")
+	})
+	f.on("FROM addresses", func([]driver.Value) fakeResult {
+		return row(int64(1), int64(3), "Rumah", "Budi", "0812", "Jl. Merdeka 1", "Jakarta", "DKI", "10110", int64(1), "2026-01-01 00:00:00")
+	})
+
+	admin := Principal{UserID: 1, Role: RoleAdmin}
+	rec := httptest.NewRecorder()
+	h.GetUserDetails(rec, adminRequest("GET", "/api/admin/users/3", "", "3", admin))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	var resp struct {
+		Data struct {
+			User      AdminUser `json:"user"`
+			Orders    []Order   `json:"orders"`
+			Addresses []Address `json:"addresses"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Data.User.ID != 3 || len(resp.Data.Orders) != 1 || resp.Data.Orders[0].ID != 7 ||
+		len(resp.Data.Addresses) != 1 || !resp.Data.Addresses[0].IsDefault {
+		t.Errorf("response %+v", resp.Data)
+	}
+
+	rec = httptest.NewRecorder()
+	h.GetUserDetails(rec, adminRequest("GET", "/api/admin/users/9", "", "9", admin))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("unknown user: status %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+// managedUsers models the role, active flag and sessions of accounts on a fakeDB.
+type managedUsers struct {
+	roles   map[int64]string
+	active  map[int64]int64
+	revoked map[int64]int
+	audited []string
+}
+
+func newManagedUsers(f *fakeDB) *managedUsers {
+	s := &managedUsers{
+		roles:   map[int64]string{2: RoleUser, 3: RoleSuperAdmin},
+		active:  map[int64]int64{2: 1, 3: 1},
+		revoked: map[int64]int{},
+	}
+	f.on("SELECT role FROM users WHERE id = ?", func(args []driver.Value) fakeResult {
+		role, ok := s.roles[args[0].(int64)]
+		if !ok {
+			return fakeResult{}
+		}
+		return row(role)
+	})
+	f.on("SELECT email, role FROM users WHERE id = ?", func(args []driver.Value) fakeResult {
+		role, ok := s.roles[args[0].(int64)]
+		if !ok {
+			return fakeResult{}
+		}
+		return row("user@example.com", role)
+	})
+	f.on("UPDATE users SET is_active = ?", func(args []driver.Value) fakeResult {
+		s.active[args[1].(int64)] = args[0].(int64)
+		return fakeResult{affected: 1}
+	})
+	f.on("UPDATE refresh_tokens SET revoked_at = NOW() WHERE user_id = ?", func(args []driver.Value) fakeResult {
+		s.revoked[args[0].(int64)]++
+		return fakeResult{affected: 1}
+	})
+	f.on("INSERT INTO audit_logs", func(args []driver.Value) fakeResult {
+		s.audited = append(s.audited, args[1].(string))
+		return fakeResult{affected: 1}
+	})
+	return s
+}
+
+func TestUpdateUserStatus(t *testing.T) {
+	db, f := newFakeDB(t)
+	h := &Handler{DB: db}
+	s := newManagedUsers(f)
+
+	update := func(id string, principal Principal, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.UpdateUserStatus(rec, adminRequest("PUT", "/api/admin/users/"+id+"/status", body, id, principal))
+		return rec
+	}
+	admin := Principal{UserID: 1, Role: RoleAdmin}
+
+	if rec := update("2", admin, `{"is_active":false}`); rec.Code != http.StatusOK {
+		t.Fatalf("deactivate: status %d: %s", rec.Code, rec.Body)
+	}
+	if s.active[2] != 0 || s.revoked[2] != 1 {
+		t.Errorf("after deactivation: active %d, sessions revoked %d times", s.active[2], s.revoked[2])
+	}
+	if !reflect.DeepEqual(s.audited, []string{"user_deactivated"}) {
+		t.Errorf("audited %v", s.audited)
+	}
+
+	if rec := update("2", admin, `{"is_active":true}`); rec.Code != http.StatusOK || s.active[2] != 1 {
+		t.Fatalf("activate: status %d, active %d", rec.Code, s.active[2])
+	}
+	if s.revoked[2] != 1 {
+		t.Error("activation revoked sessions")
+	}
+
+	tests := []struct {
+		name      string
+		id        string
+		principal Principal
+		body      string
+		want      int
+	}{
+		{"own account", "1", admin, `{"is_active":false}`, http.StatusConflict},
+		{"super admin by an admin", "3", admin, `{"is_active":false}`, http.StatusForbidden},
+		{"unknown user", "9", admin, `{"is_active":false}`, http.StatusNotFound},
+		{"missing is_active", "2", admin, `{}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if rec := update(tt.id, tt.principal, tt.body); rec.Code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, rec.Code, tt.want)
+		}
+	}
+	if s.active[3] != 1 || s.revoked[3] != 0 {
+		t.Error("refused deactivation changed the account")
+	}
+}
+
+func TestForcePasswordReset(t *testing.T) {
+	db, f := newFakeDB(t)
+	mailer := &recordingMailer{}
+	h := NewHandler(db, Config{PasswordResetTTL: time.Hour, Mailer: mailer})
+	s := newManagedUsers(f)
+	resets := newResetState(f)
+	resets.passwordHash = "old"
+
+	reset := func(id string, principal Principal) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ForcePasswordReset(rec, adminRequest("POST", "/api/admin/users/"+id+"/force-password-reset", "", id, principal))
+		return rec
+	}
+	admin := Principal{UserID: 1, Role: RoleAdmin}
+
+	if rec := reset("3", admin); rec.Code != http.StatusForbidden || resets.passwordHash != "old" {
+		t.Fatalf("super admin by an admin: status %d, password changed %v", rec.Code, resets.passwordHash != "old")
+	}
+
+	if rec := reset("2", admin); rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	if resets.passwordHash == "old" || s.revoked[2] != 1 {
+		t.Errorf("password changed %v, sessions revoked %d times", resets.passwordHash != "old", s.revoked[2])
+	}
+	token := resetToken(t, mailer)
+	if pr, ok := resets.resets[hashToken(token)]; !ok || pr.userID != 2 || pr.used {
+		t.Errorf("emailed token has reset %+v, want a usable one for user 2", pr)
+	}
+	if !reflect.DeepEqual(s.audited, []string{"password_reset_forced"}) {
+		t.Errorf("audited %v", s.audited)
+	}
+}
+
+func TestEscapeLike(t *testing.T) {
+	tests := map[string]string{
+		"budi":       "budi",
+		"100%":       `100\%`,
+		"a_b":        `a\_b`,
+		`back\slash`: `back\\slash`,
+		`%_\`:        `\%\_\\`,
+	}
+	for in, want := range tests {
+		if got := escapeLike(in); got != want {
+			t.Errorf("escapeLike(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestCanManageUser(t *testing.T) {
+	tests := []struct {
+		actor, target string
+		want          bool
+	}{
+		{RoleSupport, RoleUser, true},
+		{RoleAdmin, RoleUser, true},
+		{RoleAdmin, RoleSupport, true},
+		{RoleAdmin, RoleAdmin, false},
+		{RoleAdmin, RoleSuperAdmin, false},
+		{RoleSuperAdmin, RoleAdmin, true},
+		{RoleSuperAdmin, RoleSuperAdmin, true},
+	}
+	for _, tt := range tests {
+		if got := canManageUser(tt.actor, tt.target); got != tt.want {
+			t.Errorf("canManageUser(%s, %s) = %v, want %v", tt.actor, tt.target, got, tt.want)
+		}
+	}
+}
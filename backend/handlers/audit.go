@@ -0,0 +1,15 @@
+package handlers
+
+import "log"
+
+// audit records a privileged action; an actorID of 0 means the system. Failures
+// are logged but never block the request.
+func (h *Handler) audit(q execer, actorID int, action, targetType string, targetID int, details string) {
+	_, err := q.Exec(
+		"INSERT INTO audit_logs (actor_id, action, target_type, target_id, details) VALUES (NULLIF(?, 0), ?, ?, ?, ?)",
+		actorID, action, targetType, targetID, details,
+	)
+	if err != nil {
+		log.Printf("audit: failed to record %s by user %d: %v", action, actorID, err)
+	}
+}
@@ -2,16 +2,41 @@ package handlers
 
 import (
 	"encoding/json"
+	"fmt"
+	"log"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	"golang.org/x/crypto/bcrypt"
 )
 
 type User struct {
-	ID       int    `json:"id"`
-	Email    string `json:"email"`
-	FullName string `json:"full_name"`
-	Role     string `json:"role"`
+	ID            int    `json:"id"`
+	Email         string `json:"email"`
+	FullName      string `json:"full_name"`
+	Role          string `json:"role"`
+	EmailVerified bool   `json:"email_verified"`
+}
+
+// authResponse is returned by Login and RefreshSession; the embedded User keeps
+// the response shape compatible with clients that only read the user fields.
+type authResponse struct {
+	User
+	AccessToken  string    `json:"access_token"`
+	TokenType    string    `json:"token_type"`
+	ExpiresAt    time.Time `json:"expires_at"`
+	RefreshToken string    `json:"refresh_token"`
+	// CartMerge is set when the request carried a guest cart token.
+	CartMerge *CartMergeResult `json:"cart_merge,omitempty"`
+}
+
+// registerResponse embeds User for the same compatibility reason as authResponse.
+type registerResponse struct {
+	User
+	CartMerge *CartMergeResult `json:"cart_merge,omitempty"`
 }
 
 type loginRequest struct {
@@ -26,8 +51,12 @@ type registerRequest struct {
 	Phone    string `json:"phone"`
 }
 
-type resetPasswordRequest struct {
-	Email       string `json:"email"`
+type passwordResetRequest struct {
+	Email string `json:"email"`
+}
+
+type confirmPasswordResetRequest struct {
+	Token       string `json:"token"`
 	NewPassword string `json:"new_password"`
 }
 
@@ -39,6 +68,16 @@ func (h *Handler) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	req.Email = strings.ToLower(strings.TrimSpace(req.Email))
+	accountKey := accountThrottleKey(req.Email)
+	ipKey := ipThrottleKey(h.clientIP(r))
+	if wait := h.loginRetryAfter(accountKey, ipKey); wait > 0 {
+		seconds := int(wait.Seconds())
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+		respondError(w, http.StatusTooManyRequests, fmt.Sprintf("Terlalu banyak percobaan login. Coba lagi dalam %d detik", seconds))
+		return
+	}
+
 	var (
 		id       int
 		email    string
@@ -46,33 +85,66 @@ func (h *Handler) Login(w http.ResponseWriter, r *http.Request) {
 		hash     string
 		role     string
 		isActive int
+		verified bool
 	)
 
 	err := h.DB.QueryRow(
-		"SELECT id, email, full_name, password_hash, role, is_active FROM users WHERE email = ? LIMIT 1",
+		"SELECT id, email, full_name, password_hash, role, is_active, email_verified_at IS NOT NULL FROM users WHERE email = ? LIMIT 1",
 		req.Email,
-	).Scan(&id, &email, &fullName, &hash, &role, &isActive)
+	).Scan(&id, &email, &fullName, &hash, &role, &isActive, &verified)
 
 	if err != nil {
+		h.recordLoginFailure(accountKey, h.Config.AccountThrottle)
+		h.recordLoginFailure(ipKey, h.Config.IPThrottle)
+		respondError(w, http.StatusUnauthorized, "Email atau password salah")
+		return
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(req.Password)); err != nil {
+		h.recordLoginFailure(accountKey, h.Config.AccountThrottle)
+		h.recordLoginFailure(ipKey, h.Config.IPThrottle)
 		respondError(w, http.StatusUnauthorized, "Email atau password salah")
 		return
 	}
 
+	// Only reveal that an account is deactivated to someone who knows its password
 	if isActive == 0 {
 		respondError(w, http.StatusForbidden, "Akun tidak aktif")
 		return
 	}
 
-	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(req.Password)); err != nil {
-		respondError(w, http.StatusUnauthorized, "Email atau password salah")
+	h.clearLoginFailures(accountKey)
+
+	if !verified && h.Config.UnverifiedAccess == UnverifiedAccessNone {
+		respondError(w, http.StatusForbidden, "Email belum diverifikasi")
 		return
 	}
 
-	respondSuccess(w, User{
-		ID:       id,
-		Email:    email,
-		FullName: fullName,
-		Role:     role,
+	twoFactor, err := h.twoFactorEnabled(id)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Gagal membuat sesi")
+		return
+	}
+	if twoFactor {
+		challenge, expiresAt, err := h.issueChallengeToken(id, role)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, "Gagal membuat sesi")
+			return
+		}
+		respondSuccess(w, twoFactorChallenge{
+			TwoFactorRequired: true,
+			ChallengeToken:    challenge,
+			ExpiresAt:         expiresAt,
+		})
+		return
+	}
+
+	h.completeLogin(w, r, User{
+		ID:            id,
+		Email:         email,
+		FullName:      fullName,
+		Role:          role,
+		EmailVerified: verified,
 	})
 }
 
@@ -84,10 +156,23 @@ func (h *Handler) Register(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if req.Email == "" || req.Password == "" || req.FullName == "" {
-		respondError(w, http.StatusBadRequest, "Email, password, dan nama wajib diisi")
+	errs := map[string]string{}
+	email, ok := normalizeEmail(req.Email)
+	if !ok {
+		errs["email"] = "Format email tidak valid"
+	}
+	req.FullName = strings.TrimSpace(req.FullName)
+	if req.FullName == "" {
+		errs["full_name"] = "Nama wajib diisi"
+	}
+	if msg := h.Config.PasswordPolicy.Check(req.Password, email); msg != "" {
+		errs["password"] = msg
+	}
+	if len(errs) > 0 {
+		respondValidationError(w, errs)
 		return
 	}
+	req.Email = email
 
 	hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
 	if err != nil {
@@ -99,58 +184,195 @@ func (h *Handler) Register(w http.ResponseWriter, r *http.Request) {
 		"INSERT INTO users (email, password_hash, full_name, phone, role, is_active) VALUES (?, ?, ?, ?, 'user', 1)",
 		req.Email, string(hash), req.FullName, req.Phone,
 	)
+	if isDuplicateKey(err) {
+		respondValidationError(w, map[string]string{"email": "Email sudah terdaftar"})
+		return
+	}
 	if err != nil {
-		respondError(w, http.StatusBadRequest, "Email sudah terdaftar")
+		respondError(w, http.StatusInternalServerError, "Gagal membuat akun")
 		return
 	}
 
 	userID, _ := result.LastInsertId()
+	if err := h.sendEmailVerification(int(userID), req.Email); err != nil {
+		log.Printf("register: failed to send verification to user %d: %v", userID, err)
+	}
+
 	respondJSON(w, http.StatusCreated, Response{
 		Success: true,
-		Message: "Akun berhasil dibuat",
-		Data: User{
-			ID:       int(userID),
-			Email:    req.Email,
-			FullName: req.FullName,
-			Role:     "user",
+		Message: "Akun berhasil dibuat, silakan verifikasi email Anda",
+		Data: registerResponse{
+			User: User{
+				ID:       int(userID),
+				Email:    req.Email,
+				FullName: req.FullName,
+				Role:     "user",
+			},
+			CartMerge: h.mergeGuestCartFromRequest(r, int(userID)),
 		},
 	})
 }
 
-// ResetPassword (debug) allows updating password directly.
-func (h *Handler) ResetPassword(w http.ResponseWriter, r *http.Request) {
-	var req resetPasswordRequest
+// createPasswordReset stores a new reset token for the user, invalidating older ones.
+func (h *Handler) createPasswordReset(q execer, userID int) (string, error) {
+	token, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+
+	// Only the most recent reset link stays usable.
+	if _, err := q.Exec(
+		"UPDATE password_resets SET used_at = NOW() WHERE user_id = ? AND used_at IS NULL",
+		userID,
+	); err != nil {
+		return "", err
+	}
+
+	if _, err := q.Exec(
+		"INSERT INTO password_resets (user_id, token_hash, expires_at) VALUES (?, ?, NOW() + INTERVAL ? SECOND)",
+		userID, hashToken(token), int(h.Config.PasswordResetTTL.Seconds()),
+	); err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// mailPasswordReset sends a reset token to email, preceded by the given intro line.
+func (h *Handler) mailPasswordReset(email, token, intro string) error {
+	body := fmt.Sprintf(
+		"%s\n\nToken reset: %s\n\nToken berlaku selama %s dan hanya dapat digunakan sekali. Abaikan email ini jika Anda tidak memintanya.",
+		intro, token, h.Config.PasswordResetTTL,
+	)
+	if h.Config.PasswordResetURL != "" {
+		body += "\n\nAtau buka tautan berikut: " + h.Config.PasswordResetURL + url.QueryEscape(token)
+	}
+	return h.Config.Mailer.Send(email, "Reset password", body)
+}
+
+// RequestPasswordReset emails a single-use reset token to the account owner.
+// The response is identical whether or not the email is registered.
+func (h *Handler) RequestPasswordReset(w http.ResponseWriter, r *http.Request) {
+	var req passwordResetRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		respondError(w, http.StatusBadRequest, "Invalid request body")
 		return
 	}
-	if req.Email == "" || req.NewPassword == "" {
-		respondError(w, http.StatusBadRequest, "Email dan password baru wajib diisi")
+	email, ok := normalizeEmail(req.Email)
+	if !ok {
+		respondValidationError(w, map[string]string{"email": "Format email tidak valid"})
 		return
 	}
+	req.Email = email
 
-	hash, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+	accepted := Response{
+		Success: true,
+		Message: "Jika email terdaftar, instruksi reset password telah dikirim",
+	}
+
+	var userID int
+	err := h.DB.QueryRow(
+		"SELECT id FROM users WHERE email = ? AND is_active = 1 LIMIT 1",
+		req.Email,
+	).Scan(&userID)
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, "Gagal mengubah password")
+		respondJSON(w, http.StatusOK, accepted)
 		return
 	}
 
-	result, err := h.DB.Exec(
-		"UPDATE users SET password_hash = ? WHERE email = ?",
-		string(hash), req.Email,
+	tx, err := h.DB.Begin()
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Gagal memulai transaksi")
+		return
+	}
+	defer tx.Rollback()
+
+	token, err := h.createPasswordReset(tx, userID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Gagal membuat token reset")
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		respondError(w, http.StatusInternalServerError, "Gagal membuat token reset")
+		return
+	}
+
+	if err := h.mailPasswordReset(req.Email, token, "Kami menerima permintaan reset password untuk akun Anda."); err != nil {
+		log.Printf("password reset: failed to send mail to user %d: %v", userID, err)
+	}
+
+	respondJSON(w, http.StatusOK, accepted)
+}
+
+// ConfirmPasswordReset sets a new password using a reset token and signs out every session.
+func (h *Handler) ConfirmPasswordReset(w http.ResponseWriter, r *http.Request) {
+	var req confirmPasswordResetRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if req.Token == "" {
+		respondError(w, http.StatusBadRequest, "Token wajib diisi")
+		return
+	}
+
+	tx, err := h.DB.Begin()
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Gagal memulai transaksi")
+		return
+	}
+	defer tx.Rollback()
+
+	var (
+		resetID, userID int
+		email           string
 	)
+	err = tx.QueryRow(`
+		SELECT pr.id, pr.user_id, u.email
+		FROM password_resets pr
+		JOIN users u ON pr.user_id = u.id
+		WHERE pr.token_hash = ? AND pr.used_at IS NULL AND pr.expires_at > NOW()
+		FOR UPDATE
+	`, hashToken(req.Token)).Scan(&resetID, &userID, &email)
 	if err != nil {
+		respondError(w, http.StatusBadRequest, "Token reset tidak valid atau sudah kedaluwarsa")
+		return
+	}
+
+	if msg := h.Config.PasswordPolicy.Check(req.NewPassword, email); msg != "" {
+		respondValidationError(w, map[string]string{"new_password": msg})
+		return
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Gagal mengubah password")
+		return
+	}
+
+	if _, err := tx.Exec("UPDATE password_resets SET used_at = NOW() WHERE id = ?", resetID); err != nil {
 		respondError(w, http.StatusInternalServerError, "Gagal memperbarui password")
 		return
 	}
-	affected, _ := result.RowsAffected()
-	if affected == 0 {
-		respondError(w, http.StatusNotFound, "User tidak ditemukan")
+
+	if _, err := tx.Exec("UPDATE users SET password_hash = ?, password_changed_at = NOW() WHERE id = ?", string(hash), userID); err != nil {
+		respondError(w, http.StatusInternalServerError, "Gagal memperbarui password")
 		return
 	}
 
-	respondSuccess(w, map[string]string{
-		"email": req.Email,
-		"msg":   "Password diperbarui (debug)",
+	if err := revokeUserSessions(tx, userID); err != nil {
+		respondError(w, http.StatusInternalServerError, "Gagal memperbarui password")
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		respondError(w, http.StatusInternalServerError, "Gagal memperbarui password")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, Response{
+		Success: true,
+		Message: "Password berhasil diperbarui, silakan login kembali",
 	})
 }
@@ -0,0 +1,52 @@
+package handlers
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// TestLoginDeactivatedAccount checks that a deactivated account answers a wrong
+// password like any other account, and counts it as a failed attempt, so its
+// state is only revealed to someone who knows the password.
+func TestLoginDeactivatedAccount(t *testing.T) {
+	db, f := newFakeDB(t)
+	h := NewHandler(db, Config{})
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("Rahasia123"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.on("FROM users WHERE email = ?", func([]driver.Value) fakeResult {
+		return row(int64(1), "user@example.com", "Test User", string(hash), RoleUser, int64(0), true)
+	})
+	failures := map[string]int{}
+	f.on("INSERT INTO login_throttles", func(args []driver.Value) fakeResult {
+		failures[args[0].(string)]++
+		return fakeResult{affected: 1}
+	})
+
+	login := func(password string) *httptest.ResponseRecorder {
+		body := `{"email":"user@example.com","password":"` + password + `"}`
+		req := httptest.NewRequest("POST", "/api/auth/login", strings.NewReader(body))
+		req.RemoteAddr = "192.0.2.1:1234"
+		rec := httptest.NewRecorder()
+		h.Login(rec, req)
+		return rec
+	}
+
+	if rec := login("salah"); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("wrong password: status %d, want %d: %s", rec.Code, http.StatusUnauthorized, rec.Body)
+	}
+	if failures[accountThrottleKey("user@example.com")] != 1 || failures[ipThrottleKey("192.0.2.1")] != 1 {
+		t.Errorf("failures recorded %v, want one for the account and one for the IP", failures)
+	}
+
+	if rec := login("Rahasia123"); rec.Code != http.StatusForbidden {
+		t.Fatalf("right password: status %d, want %d: %s", rec.Code, http.StatusForbidden, rec.Body)
+	}
+}
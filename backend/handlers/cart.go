@@ -0,0 +1,326 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// maxCartQuantity is the largest quantity a single cart line may hold.
+const maxCartQuantity = 999
+
+// Reasons a cart line cannot currently be bought.
+const (
+	cartIssueInactive          = "inactive"
+	cartIssueOutOfStock        = "out_of_stock"
+	cartIssueInsufficientStock = "insufficient_stock"
+)
+
+// CartLine is a cart item priced at the product's current price.
+type CartLine struct {
+	ProductID int     `json:"product_id"`
+	Name      string  `json:"name"`
+	ImageURL  string  `json:"image_url"`
+	Price     float64 `json:"price"`
+	Quantity  int     `json:"quantity"`
+	Stock     int     `json:"stock"`
+	LineTotal float64 `json:"line_total"`
+	Available bool    `json:"available"`
+	Issue     string  `json:"issue,omitempty"`
+}
+
+// Cart is the server-side shopping cart of a user. Subtotal only counts
+// lines that are currently available.
+type Cart struct {
+	Items          []CartLine `json:"items"`
+	TotalQuantity  int        `json:"total_quantity"`
+	Subtotal       float64    `json:"subtotal"`
+	HasUnavailable bool       `json:"has_unavailable"`
+}
+
+type cartItemRequest struct {
+	ProductID int `json:"product_id"`
+	Quantity  int `json:"quantity"`
+}
+
+// cartRef identifies a cart: a user's cart_items or a guest's guest_cart_items.
+type cartRef struct {
+	table    string
+	ownerCol string
+	owner    interface{}
+	// maxLines caps the number of distinct products in the cart; zero means no cap.
+	maxLines int
+}
+
+func userCart(userID int) cartRef {
+	return cartRef{table: "cart_items", ownerCol: "user_id", owner: userID}
+}
+
+// loadCart reads a cart joined with current product data.
+func loadCart(q queryer, ref cartRef) (Cart, error) {
+	rows, err := q.Query(`
+		SELECT p.id, p.name, COALESCE(p.image_url, ''), p.price, ci.quantity, p.stock, p.is_active
+		FROM `+ref.table+` ci
+		JOIN products p ON ci.product_id = p.id
+		WHERE ci.`+ref.ownerCol+` = ?
+		ORDER BY ci.created_at
+	`, ref.owner)
+	if err != nil {
+		return Cart{}, err
+	}
+	defer rows.Close()
+
+	cart := Cart{Items: []CartLine{}}
+	for rows.Next() {
+		var (
+			line     CartLine
+			isActive int
+		)
+		if err := rows.Scan(&line.ProductID, &line.Name, &line.ImageURL, &line.Price, &line.Quantity, &line.Stock, &isActive); err != nil {
+			return Cart{}, err
+		}
+
+		switch {
+		case isActive == 0:
+			line.Issue = cartIssueInactive
+		case line.Stock <= 0:
+			line.Issue = cartIssueOutOfStock
+		case line.Stock < line.Quantity:
+			line.Issue = cartIssueInsufficientStock
+		}
+		line.Available = line.Issue == ""
+		line.LineTotal = line.Price * float64(line.Quantity)
+
+		cart.TotalQuantity += line.Quantity
+		if line.Available {
+			cart.Subtotal += line.LineTotal
+		} else {
+			cart.HasUnavailable = true
+		}
+		cart.Items = append(cart.Items, line)
+	}
+
+	return cart, rows.Err()
+}
+
+// respondCart writes the current cart as the response.
+func (h *Handler) respondCart(w http.ResponseWriter, ref cartRef) {
+	cart, err := loadCart(h.DB, ref)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Gagal mengambil keranjang")
+		return
+	}
+	respondSuccess(w, cart)
+}
+
+// addCartItem decodes a cartItemRequest and adds it to the cart.
+func (h *Handler) addCartItem(w http.ResponseWriter, r *http.Request, ref cartRef) {
+	var req cartItemRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Body tidak valid")
+		return
+	}
+	if req.Quantity == 0 {
+		req.Quantity = 1
+	}
+	if req.ProductID <= 0 || req.Quantity < 0 {
+		respondError(w, http.StatusBadRequest, "Produk dan jumlah tidak valid")
+		return
+	}
+	if req.Quantity > maxCartQuantity {
+		respondError(w, http.StatusBadRequest, fmt.Sprintf("Jumlah maksimal %d per produk", maxCartQuantity))
+		return
+	}
+
+	var isActive int
+	err := h.DB.QueryRow("SELECT is_active FROM products WHERE id = ?", req.ProductID).Scan(&isActive)
+	if err != nil {
+		respondError(w, http.StatusNotFound, "Produk tidak ditemukan")
+		return
+	}
+	if isActive == 0 {
+		respondError(w, http.StatusConflict, "Produk tidak tersedia")
+		return
+	}
+
+	tx, err := h.DB.Begin()
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Gagal menambahkan ke keranjang")
+		return
+	}
+	defer tx.Rollback()
+
+	// Lock the line so concurrent adds cannot together pass the maximum
+	var current int
+	err = tx.QueryRow(
+		"SELECT quantity FROM "+ref.table+" WHERE "+ref.ownerCol+" = ? AND product_id = ? FOR UPDATE",
+		ref.owner, req.ProductID,
+	).Scan(&current)
+	if err != nil && err != sql.ErrNoRows {
+		respondError(w, http.StatusInternalServerError, "Gagal menambahkan ke keranjang")
+		return
+	}
+	if current+req.Quantity > maxCartQuantity {
+		respondError(w, http.StatusBadRequest, fmt.Sprintf("Jumlah maksimal %d per produk", maxCartQuantity))
+		return
+	}
+
+	if current == 0 && ref.maxLines > 0 {
+		// Locks the cart's lines, so concurrent adds of other products wait
+		var lines int
+		if err := tx.QueryRow(
+			"SELECT COUNT(*) FROM "+ref.table+" WHERE "+ref.ownerCol+" = ? FOR UPDATE", ref.owner,
+		).Scan(&lines); err != nil {
+			respondError(w, http.StatusInternalServerError, "Gagal menambahkan ke keranjang")
+			return
+		}
+		if lines >= ref.maxLines {
+			respondError(w, http.StatusBadRequest, fmt.Sprintf("Keranjang maksimal berisi %d produk", ref.maxLines))
+			return
+		}
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO `+ref.table+` (`+ref.ownerCol+`, product_id, quantity) VALUES (?, ?, ?)
+		ON DUPLICATE KEY UPDATE quantity = quantity + VALUES(quantity)
+	`, ref.owner, req.ProductID, req.Quantity)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Gagal menambahkan ke keranjang")
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		respondError(w, http.StatusInternalServerError, "Gagal menambahkan ke keranjang")
+		return
+	}
+
+	h.respondCart(w, ref)
+}
+
+// updateCartItem sets the quantity of the {productId} line; zero removes it.
+func (h *Handler) updateCartItem(w http.ResponseWriter, r *http.Request, ref cartRef) {
+	productID, err := strconv.Atoi(mux.Vars(r)["productId"])
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid product ID")
+		return
+	}
+
+	var req struct {
+		Quantity *int `json:"quantity"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Quantity == nil || *req.Quantity < 0 {
+		respondError(w, http.StatusBadRequest, "Jumlah tidak valid")
+		return
+	}
+
+	if *req.Quantity > maxCartQuantity {
+		respondError(w, http.StatusBadRequest, fmt.Sprintf("Jumlah maksimal %d per produk", maxCartQuantity))
+		return
+	}
+
+	if *req.Quantity == 0 {
+		h.removeCartItem(w, r, ref)
+		return
+	}
+
+	result, err := h.DB.Exec(
+		"UPDATE "+ref.table+" SET quantity = ? WHERE "+ref.ownerCol+" = ? AND product_id = ?",
+		*req.Quantity, ref.owner, productID,
+	)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Gagal memperbarui keranjang")
+		return
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		var exists bool
+		h.DB.QueryRow(
+			"SELECT EXISTS(SELECT 1 FROM "+ref.table+" WHERE "+ref.ownerCol+" = ? AND product_id = ?)",
+			ref.owner, productID,
+		).Scan(&exists)
+		if !exists {
+			respondError(w, http.StatusNotFound, "Produk tidak ada di keranjang")
+			return
+		}
+	}
+
+	h.respondCart(w, ref)
+}
+
+// removeCartItem deletes the {productId} line from the cart.
+func (h *Handler) removeCartItem(w http.ResponseWriter, r *http.Request, ref cartRef) {
+	productID, err := strconv.Atoi(mux.Vars(r)["productId"])
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid product ID")
+		return
+	}
+
+	if _, err := h.DB.Exec(
+		"DELETE FROM "+ref.table+" WHERE "+ref.ownerCol+" = ? AND product_id = ?",
+		ref.owner, productID,
+	); err != nil {
+		respondError(w, http.StatusInternalServerError, "Gagal menghapus item")
+		return
+	}
+
+	h.respondCart(w, ref)
+}
+
+// clearCart empties the cart.
+func (h *Handler) clearCart(w http.ResponseWriter, ref cartRef) {
+	if _, err := h.DB.Exec("DELETE FROM "+ref.table+" WHERE "+ref.ownerCol+" = ?", ref.owner); err != nil {
+		respondError(w, http.StatusInternalServerError, "Gagal mengosongkan keranjang")
+		return
+	}
+
+	h.respondCart(w, ref)
+}
+
+// userCartFromRequest resolves the {userId} cart, writing an error if the ID is invalid.
+func userCartFromRequest(w http.ResponseWriter, r *http.Request) (cartRef, bool) {
+	userID, err := strconv.Atoi(mux.Vars(r)["userId"])
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid user ID")
+		return cartRef{}, false
+	}
+	return userCart(userID), true
+}
+
+// GetCart returns the user's cart with line totals at current prices.
+func (h *Handler) GetCart(w http.ResponseWriter, r *http.Request) {
+	if ref, ok := userCartFromRequest(w, r); ok {
+		h.respondCart(w, ref)
+	}
+}
+
+// AddCartItem adds quantity of a product to the cart, merging with an existing line.
+func (h *Handler) AddCartItem(w http.ResponseWriter, r *http.Request) {
+	if ref, ok := userCartFromRequest(w, r); ok {
+		h.addCartItem(w, r, ref)
+	}
+}
+
+// UpdateCartItem sets the quantity of a cart line; zero removes it.
+func (h *Handler) UpdateCartItem(w http.ResponseWriter, r *http.Request) {
+	if ref, ok := userCartFromRequest(w, r); ok {
+		h.updateCartItem(w, r, ref)
+	}
+}
+
+// RemoveCartItem deletes a product from the cart.
+func (h *Handler) RemoveCartItem(w http.ResponseWriter, r *http.Request) {
+	if ref, ok := userCartFromRequest(w, r); ok {
+		h.removeCartItem(w, r, ref)
+	}
+}
+
+// ClearCart empties the cart.
+func (h *Handler) ClearCart(w http.ResponseWriter, r *http.Request) {
+	if ref, ok := userCartFromRequest(w, r); ok {
+		h.clearCart(w, ref)
+	}
+}
@@ -0,0 +1,98 @@
+package handlers
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAddCartItemQuantityLimit(t *testing.T) {
+	db, f := newFakeDB(t)
+	h := &Handler{DB: db}
+
+	quantity := int64(0)
+	f.on("SELECT is_active FROM products", func([]driver.Value) fakeResult {
+		return row(int64(1))
+	})
+	f.on("SELECT quantity FROM cart_items", func([]driver.Value) fakeResult {
+		if quantity == 0 {
+			return fakeResult{}
+		}
+		return row(quantity)
+	})
+	f.on("INSERT INTO cart_items", func(args []driver.Value) fakeResult {
+		quantity += args[2].(int64)
+		return fakeResult{affected: 1}
+	})
+
+	add := func(n int) int {
+		rec := httptest.NewRecorder()
+		body := fmt.Sprintf(`{"product_id":1,"quantity":%d}`, n)
+		h.addCartItem(rec, httptest.NewRequest("POST", "/", strings.NewReader(body)), userCart(1))
+		return rec.Code
+	}
+
+	tests := []struct {
+		name    string
+		add     int
+		want    int
+		wantQty int64
+	}{
+		{"over the maximum at once", maxCartQuantity + 1, http.StatusBadRequest, 0},
+		{"overflowing int", 1 << 31, http.StatusBadRequest, 0},
+		{"up to one below the maximum", maxCartQuantity - 1, http.StatusOK, maxCartQuantity - 1},
+		{"past the maximum with the existing line", 2, http.StatusBadRequest, maxCartQuantity - 1},
+		{"up to the maximum", 1, http.StatusOK, maxCartQuantity},
+		{"one more", 1, http.StatusBadRequest, maxCartQuantity},
+	}
+	for _, tt := range tests {
+		if got := add(tt.add); got != tt.want || quantity != tt.wantQty {
+			t.Fatalf("%s: status %d with %d in the cart, want %d with %d", tt.name, got, quantity, tt.want, tt.wantQty)
+		}
+	}
+}
+
+func TestAddGuestCartItemLineLimit(t *testing.T) {
+	db, f := newFakeDB(t)
+	h := &Handler{DB: db}
+
+	lines := map[int64]bool{}
+	f.on("SELECT is_active FROM products", func([]driver.Value) fakeResult {
+		return row(int64(1))
+	})
+	f.on("SELECT quantity FROM guest_cart_items", func(args []driver.Value) fakeResult {
+		if !lines[args[1].(int64)] {
+			return fakeResult{}
+		}
+		return row(int64(1))
+	})
+	f.on("SELECT COUNT(*) FROM guest_cart_items", func([]driver.Value) fakeResult {
+		return row(int64(len(lines)))
+	})
+	f.on("INSERT INTO guest_cart_items", func(args []driver.Value) fakeResult {
+		lines[args[1].(int64)] = true
+		return fakeResult{affected: 1}
+	})
+
+	add := func(productID int) int {
+		rec := httptest.NewRecorder()
+		body := fmt.Sprintf(`{"product_id":%d}`, productID)
+		h.addCartItem(rec, httptest.NewRequest("POST", "/", strings.NewReader(body)), guestCart("guest-cart-token-0123456789"))
+		return rec.Code
+	}
+
+	for id := 1; id <= maxGuestCartLines; id++ {
+		if got := add(id); got != http.StatusOK {
+			t.Fatalf("product %d: status %d, want %d", id, got, http.StatusOK)
+		}
+	}
+	if got := add(maxGuestCartLines + 1); got != http.StatusBadRequest {
+		t.Errorf("one product too many: status %d, want %d", got, http.StatusBadRequest)
+	}
+	if got := add(1); got != http.StatusOK {
+		t.Errorf("more of a product already in the full cart: status %d, want %d", got, http.StatusOK)
+	}
+}
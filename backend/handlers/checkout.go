@@ -0,0 +1,152 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+)
+
+type checkoutRequest struct {
+	// AddressID selects a saved address. ShippingAddress is used when it is
+	// zero; with neither, the user's default address is used.
+	AddressID       int              `json:"address_id"`
+	ShippingAddress *ShippingAddress `json:"shipping_address"`
+	Notes           string           `json:"notes"`
+}
+
+// Checkout places an order from the authenticated user's persisted cart and
+// chosen address, and empties the cart in the same transaction. Prices, items
+// and customer details all come from the database, never from the client.
+func (h *Handler) Checkout(w http.ResponseWriter, r *http.Request) {
+	principal, _ := principalFromContext(r.Context())
+
+	var req checkoutRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondError(w, http.StatusBadRequest, "Invalid request body")
+			return
+		}
+	}
+
+	tx, err := h.DB.Begin()
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	var customer struct {
+		name, email string
+		phone       sql.NullString
+	}
+	err = tx.QueryRow(
+		"SELECT full_name, email, phone FROM users WHERE id = ? AND is_active = 1",
+		principal.UserID,
+	).Scan(&customer.name, &customer.email, &customer.phone)
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, "User not found")
+		return
+	}
+
+	addr, fieldErrs, err := resolveShippingAddress(tx, principal.UserID, req.AddressID, req.ShippingAddress, true)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to read address")
+		return
+	}
+	if len(fieldErrs) > 0 {
+		respondValidationError(w, fieldErrs)
+		return
+	}
+
+	// Lock the cart so a concurrent edit cannot change it between pricing and clearing.
+	locked, err := tx.Query("SELECT id FROM cart_items WHERE user_id = ? FOR UPDATE", principal.UserID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to read cart")
+		return
+	}
+	locked.Close()
+
+	cart, err := loadCart(tx, userCart(principal.UserID))
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to read cart")
+		return
+	}
+	if len(cart.Items) == 0 {
+		respondError(w, http.StatusBadRequest, "Keranjang kosong")
+		return
+	}
+	if cart.HasUnavailable {
+		respondJSON(w, http.StatusConflict, Response{
+			Success: false,
+			Error:   "Beberapa produk di keranjang tidak tersedia",
+			Data:    cart,
+		})
+		return
+	}
+
+	requested := make([]OrderItem, 0, len(cart.Items))
+	for _, line := range cart.Items {
+		requested = append(requested, OrderItem{ProductID: line.ProductID, Quantity: line.Quantity})
+	}
+	items, shortages, err := lockOrderItems(tx, requested)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to check stock")
+		return
+	}
+	if len(shortages) > 0 {
+		respondStockShortage(w, shortages)
+		return
+	}
+	total := orderTotal(items)
+
+	phone := addr.Phone
+	if phone == "" {
+		phone = customer.phone.String
+	}
+
+	result, err := tx.Exec(
+		`INSERT INTO orders (user_id, customer_name, customer_email, customer_phone, shipping_address, total_amount, status, notes, hold_expires_at)
+		 VALUES (?, ?, ?, ?, ?, ?, 'pending', ?, NOW() + INTERVAL ? SECOND)`,
+		principal.UserID, customer.name, customer.email, phone, encodeShippingAddress(addr), total, req.Notes, h.holdExpiry(),
+	)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to create order")
+		return
+	}
+	orderID, _ := result.LastInsertId()
+
+	if err := recordOrderStatus(tx, int(orderID), "", OrderPending, principal.UserID, ""); err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to create order")
+		return
+	}
+
+	if err := insertOrderItems(tx, int(orderID), items); err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to create order item")
+		return
+	}
+
+	if _, err := tx.Exec("DELETE FROM cart_items WHERE user_id = ?", principal.UserID); err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to clear cart")
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to commit transaction")
+		return
+	}
+
+	respondJSON(w, http.StatusCreated, Response{
+		Success: true,
+		Message: "Order created successfully",
+		Data: Order{
+			ID:              int(orderID),
+			CustomerName:    customer.name,
+			CustomerEmail:   customer.email,
+			CustomerPhone:   phone,
+			ShippingAddress: addr,
+			TotalAmount:     total,
+			Status:          "pending",
+			Items:           items,
+		},
+	})
+}
@@ -0,0 +1,159 @@
+package handlers
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// checkoutLine is a cart_items row joined with its product on a fakeDB. sold
+// units go to a concurrent order after the cart is read but before checkout
+// locks the product row.
+type checkoutLine struct {
+	productID, quantity, stock, sold int64
+	price                            float64
+}
+
+// checkoutState models the account, default address and cart of user 2 on a
+// fakeDB, and records the writes a checkout makes in order.
+type checkoutState struct {
+	cart   []checkoutLine
+	order  []driver.Value
+	items  [][]driver.Value
+	writes []string
+}
+
+func newCheckoutState(f *fakeDB) *checkoutState {
+	s := &checkoutState{}
+	f.on("SELECT full_name, email, phone FROM users WHERE id = ? AND is_active = 1", func([]driver.Value) fakeResult {
+		return row("Budi", "budi@example.com", nil)
+	})
+	f.on("FROM addresses WHERE user_id = ?", func(args []driver.Value) fakeResult {
+		if len(args) > 1 && args[1] != int64(5) {
+			return fakeResult{}
+		}
+		return row(int64(5), "Rumah", "Budi", "0812", "Jl. Merdeka 1", "Jakarta", "DKI", "10110")
+	})
+	f.on("FROM cart_items ci JOIN products p", func([]driver.Value) fakeResult {
+		res := fakeResult{columns: []string{"id", "name", "image_url", "price", "quantity", "stock", "is_active"}}
+		for _, l := range s.cart {
+			res.rows = append(res.rows, []driver.Value{l.productID, "Produk", "", l.price, l.quantity, l.stock, int64(1)})
+		}
+		return res
+	})
+	f.on("FROM products WHERE id IN", func([]driver.Value) fakeResult {
+		res := fakeResult{columns: []string{"id", "name", "price", "stock", "is_active"}}
+		for _, l := range s.cart {
+			res.rows = append(res.rows, []driver.Value{l.productID, "Produk", l.price, l.stock - l.sold, int64(1)})
+		}
+		return res
+	})
+	f.on("UPDATE products SET stock = stock - ? WHERE id = ? AND stock >= ?", func(args []driver.Value) fakeResult {
+		for i, l := range s.cart {
+			if l.productID == args[1] && l.stock-l.sold >= args[2].(int64) {
+				s.cart[i].stock -= args[0].(int64)
+				s.writes = append(s.writes, "stock")
+				return fakeResult{affected: 1}
+			}
+		}
+		return fakeResult{}
+	})
+	f.on("INSERT INTO orders", func(args []driver.Value) fakeResult {
+		s.order = args
+		s.writes = append(s.writes, "order")
+		return fakeResult{affected: 1, lastID: 10}
+	})
+	f.on("INSERT INTO order_items", func(args []driver.Value) fakeResult {
+		s.items = append(s.items, args)
+		s.writes = append(s.writes, "item")
+		return fakeResult{affected: 1}
+	})
+	f.on("DELETE FROM cart_items WHERE user_id = ?", func(args []driver.Value) fakeResult {
+		if args[0] != int64(2) {
+			return fakeResult{}
+		}
+		s.cart = nil
+		s.writes = append(s.writes, "clear cart")
+		return fakeResult{affected: 1}
+	})
+	return s
+}
+
+func checkout(h *Handler, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/api/checkout", strings.NewReader(body))
+	req = req.WithContext(withPrincipal(req.Context(), Principal{UserID: 2, Role: RoleUser}))
+	rec := httptest.NewRecorder()
+	h.Checkout(rec, req)
+	return rec
+}
+
+func TestCheckout(t *testing.T) {
+	db, f := newFakeDB(t)
+	h := &Handler{DB: db}
+	s := newCheckoutState(f)
+	s.cart = []checkoutLine{
+		{productID: 1, quantity: 2, stock: 5, price: 10000},
+		{productID: 3, quantity: 1, stock: 1, price: 25000},
+	}
+
+	rec := checkout(h, `{"notes":"Titip satpam"}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+
+	// The order is priced and addressed from the database
+	wantOrder := []driver.Value{
+		int64(2), "Budi", "budi@example.com", "0812",
+		`{"address_id":5,"label":"Rumah","recipient_name":"Budi","phone":"0812","street":"Jl. Merdeka 1","city":"Jakarta","state":"DKI","postal_code":"10110"}`,
+		45000.0, "Titip satpam", nil,
+	}
+	if !reflect.DeepEqual(s.order, wantOrder) {
+		t.Errorf("order %v, want %v", s.order, wantOrder)
+	}
+	wantItems := [][]driver.Value{
+		{int64(10), int64(1), int64(2), 10000.0},
+		{int64(10), int64(3), int64(1), 25000.0},
+	}
+	if !reflect.DeepEqual(s.items, wantItems) {
+		t.Errorf("order items %v, want %v", s.items, wantItems)
+	}
+
+	// Stock is taken line by line and the cart is emptied in the same
+	// transaction, after the order is written
+	if want := []string{"order", "item", "stock", "item", "stock", "clear cart"}; !reflect.DeepEqual(s.writes, want) {
+		t.Errorf("writes %v, want %v", s.writes, want)
+	}
+}
+
+func TestCheckoutRefused(t *testing.T) {
+	tests := []struct {
+		name string
+		cart []checkoutLine
+		body string
+		want int
+	}{
+		{"empty cart", nil, "", http.StatusBadRequest},
+		{"insufficient stock", []checkoutLine{{productID: 1, quantity: 3, stock: 2, price: 10000}}, "", http.StatusConflict},
+		{"out of stock", []checkoutLine{{productID: 1, quantity: 1, stock: 0, price: 10000}}, "", http.StatusConflict},
+		{"sold while checking out", []checkoutLine{{productID: 1, quantity: 2, stock: 2, sold: 1, price: 10000}}, "", http.StatusConflict},
+		{"unknown address", []checkoutLine{{productID: 1, quantity: 1, stock: 5, price: 10000}}, `{"address_id":9}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, f := newFakeDB(t)
+			h := &Handler{DB: db}
+			s := newCheckoutState(f)
+			s.cart = tt.cart
+
+			if rec := checkout(h, tt.body); rec.Code != tt.want {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+			if len(s.writes) != 0 {
+				t.Errorf("refused checkout wrote %v", s.writes)
+			}
+		})
+	}
+}
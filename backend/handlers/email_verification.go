@@ -0,0 +1,195 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// Values for Config.UnverifiedAccess.
+const (
+	// UnverifiedAccessFull places no restriction on unverified accounts.
+	UnverifiedAccessFull = "full"
+	// UnverifiedAccessBrowse lets unverified accounts log in and browse, but not
+	// call endpoints wrapped with RequireVerified (e.g. placing orders).
+	UnverifiedAccessBrowse = "browse"
+	// UnverifiedAccessNone refuses logins until the email is verified.
+	UnverifiedAccessNone = "none"
+)
+
+type verifyEmailRequest struct {
+	Token string `json:"token"`
+}
+
+// sendEmailVerification creates a verification token for the user and mails it.
+func (h *Handler) sendEmailVerification(userID int, email string) error {
+	token, err := randomToken(32)
+	if err != nil {
+		return err
+	}
+
+	tx, err := h.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Only the most recent link stays usable.
+	if _, err := tx.Exec(
+		"UPDATE email_verifications SET used_at = NOW() WHERE user_id = ? AND used_at IS NULL",
+		userID,
+	); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(
+		"INSERT INTO email_verifications (user_id, token_hash, expires_at) VALUES (?, ?, NOW() + INTERVAL ? SECOND)",
+		userID, hashToken(token), int(h.Config.EmailVerificationTTL.Seconds()),
+	); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	body := fmt.Sprintf(
+		"Terima kasih telah mendaftar.\n\nToken verifikasi email: %s\n\nToken berlaku selama %s.",
+		token, h.Config.EmailVerificationTTL,
+	)
+	if h.Config.EmailVerificationURL != "" {
+		body += "\n\nAtau buka tautan berikut: " + h.Config.EmailVerificationURL + url.QueryEscape(token)
+	}
+	return h.Config.Mailer.Send(email, "Verifikasi email", body)
+}
+
+// VerifyEmail marks the account owning the token as verified.
+func (h *Handler) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	var req verifyEmailRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+		respondError(w, http.StatusBadRequest, "Token wajib diisi")
+		return
+	}
+
+	tx, err := h.DB.Begin()
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Gagal memulai transaksi")
+		return
+	}
+	defer tx.Rollback()
+
+	var verificationID, userID int
+	err = tx.QueryRow(
+		"SELECT id, user_id FROM email_verifications WHERE token_hash = ? AND used_at IS NULL AND expires_at > NOW() FOR UPDATE",
+		hashToken(req.Token),
+	).Scan(&verificationID, &userID)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Token verifikasi tidak valid atau sudah kedaluwarsa")
+		return
+	}
+
+	if _, err := tx.Exec("UPDATE email_verifications SET used_at = NOW() WHERE id = ?", verificationID); err != nil {
+		respondError(w, http.StatusInternalServerError, "Gagal memverifikasi email")
+		return
+	}
+
+	if _, err := tx.Exec(
+		"UPDATE users SET email_verified_at = COALESCE(email_verified_at, NOW()) WHERE id = ?",
+		userID,
+	); err != nil {
+		respondError(w, http.StatusInternalServerError, "Gagal memverifikasi email")
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		respondError(w, http.StatusInternalServerError, "Gagal memverifikasi email")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, Response{
+		Success: true,
+		Message: "Email berhasil diverifikasi",
+	})
+}
+
+// ResendEmailVerification sends a new verification token to the authenticated user,
+// at most once per Config.VerificationResendInterval.
+func (h *Handler) ResendEmailVerification(w http.ResponseWriter, r *http.Request) {
+	principal, _ := principalFromContext(r.Context())
+
+	var (
+		email    string
+		verified bool
+	)
+	err := h.DB.QueryRow(
+		"SELECT email, email_verified_at IS NOT NULL FROM users WHERE id = ?",
+		principal.UserID,
+	).Scan(&email, &verified)
+	if err != nil {
+		respondError(w, http.StatusNotFound, "User tidak ditemukan")
+		return
+	}
+
+	if verified {
+		respondError(w, http.StatusConflict, "Email sudah terverifikasi")
+		return
+	}
+
+	var wait int64
+	err = h.DB.QueryRow(`
+		SELECT COALESCE(MAX(TIMESTAMPDIFF(SECOND, NOW(), created_at + INTERVAL ? SECOND)), 0)
+		FROM email_verifications
+		WHERE user_id = ?
+	`, int(h.Config.VerificationResendInterval.Seconds()), principal.UserID).Scan(&wait)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Gagal mengirim ulang verifikasi")
+		return
+	}
+	if wait > 0 {
+		w.Header().Set("Retry-After", strconv.FormatInt(wait, 10))
+		respondError(w, http.StatusTooManyRequests, fmt.Sprintf("Tunggu %d detik sebelum mengirim ulang", wait))
+		return
+	}
+
+	if err := h.sendEmailVerification(principal.UserID, email); err != nil {
+		log.Printf("email verification: failed to send to user %d: %v", principal.UserID, err)
+		respondError(w, http.StatusInternalServerError, "Gagal mengirim ulang verifikasi")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, Response{
+		Success: true,
+		Message: "Email verifikasi telah dikirim",
+	})
+}
+
+// RequireVerified guards endpoints unverified accounts may not use. It wraps
+// RequireAuth, so routes use it in place of RequireAuth; under
+// UnverifiedAccessFull it only authenticates, otherwise the user must also be
+// verified.
+func (h *Handler) RequireVerified(next http.HandlerFunc) http.HandlerFunc {
+	if h.Config.UnverifiedAccess == UnverifiedAccessFull {
+		return h.RequireAuth(next)
+	}
+	return h.RequireAuth(func(w http.ResponseWriter, r *http.Request) {
+		principal, _ := principalFromContext(r.Context())
+
+		var verified bool
+		err := h.DB.QueryRow(
+			"SELECT email_verified_at IS NOT NULL FROM users WHERE id = ?",
+			principal.UserID,
+		).Scan(&verified)
+		if err != nil {
+			respondError(w, http.StatusUnauthorized, "User tidak ditemukan")
+			return
+		}
+		if !verified {
+			respondError(w, http.StatusForbidden, "Email belum diverifikasi")
+			return
+		}
+		next(w, r)
+	})
+}
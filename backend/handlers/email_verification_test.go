@@ -0,0 +1,255 @@
+package handlers
+
+import (
+	"context"
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testVerification is an email_verifications row on a fakeDB.
+type testVerification struct {
+	id      int
+	userID  int
+	used    bool
+	expired bool
+}
+
+// verificationState models email_verifications and the verification state of
+// user 2, registered as user@example.com, on a fakeDB.
+type verificationState struct {
+	verifications map[string]*testVerification // by token hash
+	verified      bool
+	resendWait    int64
+}
+
+func newVerificationState(f *fakeDB) *verificationState {
+	s := &verificationState{verifications: map[string]*testVerification{}}
+
+	f.on("UPDATE email_verifications SET used_at = NOW() WHERE user_id = ?", func(args []driver.Value) fakeResult {
+		for _, v := range s.verifications {
+			if v.userID == int(args[0].(int64)) {
+				v.used = true
+			}
+		}
+		return fakeResult{affected: 1}
+	})
+	f.on("INSERT INTO email_verifications", func(args []driver.Value) fakeResult {
+		s.verifications[args[1].(string)] = &testVerification{id: len(s.verifications) + 1, userID: int(args[0].(int64))}
+		return fakeResult{affected: 1}
+	})
+	f.on("FROM email_verifications WHERE token_hash = ?", func(args []driver.Value) fakeResult {
+		v, ok := s.verifications[args[0].(string)]
+		if !ok || v.used || v.expired {
+			return fakeResult{}
+		}
+		return row(int64(v.id), int64(v.userID))
+	})
+	f.on("UPDATE email_verifications SET used_at = NOW() WHERE id = ?", func(args []driver.Value) fakeResult {
+		for _, v := range s.verifications {
+			if v.id == int(args[0].(int64)) {
+				v.used = true
+			}
+		}
+		return fakeResult{affected: 1}
+	})
+	f.on("UPDATE users SET email_verified_at", func([]driver.Value) fakeResult {
+		s.verified = true
+		return fakeResult{affected: 1}
+	})
+	f.on("SELECT email, email_verified_at IS NOT NULL FROM users WHERE id = ?", func([]driver.Value) fakeResult {
+		return row("user@example.com", s.verified)
+	})
+	f.on("SELECT email_verified_at IS NOT NULL FROM users WHERE id = ?", func([]driver.Value) fakeResult {
+		return row(s.verified)
+	})
+	f.on("SELECT COALESCE(MAX(TIMESTAMPDIFF(SECOND, NOW(), created_at + INTERVAL ? SECOND)), 0)", func([]driver.Value) fakeResult {
+		return row(s.resendWait)
+	})
+	return s
+}
+
+var verificationTokenPattern = regexp.MustCompile(`Token verifikasi email: (\S+)`)
+
+// verificationToken returns the token in the last verification email sent through m.
+func verificationToken(t *testing.T, m *recordingMailer) string {
+	t.Helper()
+	if len(m.sent) == 0 {
+		t.Fatal("no verification email sent")
+	}
+	match := verificationTokenPattern.FindStringSubmatch(m.sent[len(m.sent)-1].body)
+	if match == nil {
+		t.Fatalf("no token in %q", m.sent[len(m.sent)-1].body)
+	}
+	return match[1]
+}
+
+func newVerificationHandler(t *testing.T, unverifiedAccess string) (*Handler, *verificationState, *recordingMailer) {
+	t.Helper()
+	db, f := newFakeDB(t)
+	mailer := &recordingMailer{}
+	h := NewHandler(db, Config{
+		TokenSecret:                []byte("test-secret"),
+		AccessTokenTTL:             time.Hour,
+		EmailVerificationTTL:       time.Hour,
+		VerificationResendInterval: time.Minute,
+		UnverifiedAccess:           unverifiedAccess,
+		Mailer:                     mailer,
+	})
+	onAccountCheck(f)
+	return h, newVerificationState(f), mailer
+}
+
+func TestVerifyEmail(t *testing.T) {
+	h, s, mailer := newVerificationHandler(t, UnverifiedAccessBrowse)
+	verify := func(token string) *httptest.ResponseRecorder {
+		return postJSON(h.VerifyEmail, "/api/auth/verify-email", map[string]string{"token": token})
+	}
+
+	if err := h.sendEmailVerification(2, "user@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	first := verificationToken(t, mailer)
+	if err := h.sendEmailVerification(2, "user@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	second := verificationToken(t, mailer)
+
+	// Only the newest link stays usable
+	if rec := verify(first); rec.Code != http.StatusBadRequest || s.verified {
+		t.Fatalf("older token: status %d, verified %v", rec.Code, s.verified)
+	}
+	if rec := verify("unknown"); rec.Code != http.StatusBadRequest {
+		t.Errorf("unknown token: status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+
+	s.verifications[hashToken(second)].expired = true
+	if rec := verify(second); rec.Code != http.StatusBadRequest || s.verified {
+		t.Fatalf("expired token: status %d, verified %v", rec.Code, s.verified)
+	}
+	s.verifications[hashToken(second)].expired = false
+
+	if rec := verify(second); rec.Code != http.StatusOK || !s.verified {
+		t.Fatalf("status %d, verified %v: %s", rec.Code, s.verified, rec.Body)
+	}
+	if rec := verify(second); rec.Code != http.StatusBadRequest {
+		t.Errorf("reused token: status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestResendEmailVerification(t *testing.T) {
+	h, s, mailer := newVerificationHandler(t, UnverifiedAccessBrowse)
+	resend := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/auth/verify-email/resend", nil)
+		req = req.WithContext(context.WithValue(req.Context(), principalKey, Principal{UserID: 2, Role: "user"}))
+		rec := httptest.NewRecorder()
+		h.ResendEmailVerification(rec, req)
+		return rec
+	}
+
+	if rec := resend(); rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	if len(mailer.sent) != 1 || mailer.sent[0].to != "user@example.com" {
+		t.Fatalf("sent %+v, want one email to user@example.com", mailer.sent)
+	}
+	verificationToken(t, mailer)
+
+	// Within the resend interval the request is refused with the time left
+	s.resendWait = 42
+	rec := resend()
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "42" {
+		t.Errorf("within interval: status %d, Retry-After %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	if len(mailer.sent) != 1 {
+		t.Errorf("%d emails sent within the resend interval, want 1", len(mailer.sent))
+	}
+
+	s.resendWait = 0
+	s.verified = true
+	if rec := resend(); rec.Code != http.StatusConflict {
+		t.Errorf("verified account: status %d, want %d", rec.Code, http.StatusConflict)
+	}
+}
+
+func TestRequireVerified(t *testing.T) {
+	tests := []struct {
+		mode                         string
+		anonymous, unverified, valid int
+	}{
+		{UnverifiedAccessFull, http.StatusUnauthorized, http.StatusOK, http.StatusOK},
+		{UnverifiedAccessBrowse, http.StatusUnauthorized, http.StatusForbidden, http.StatusOK},
+		{UnverifiedAccessNone, http.StatusUnauthorized, http.StatusForbidden, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			h, s, _ := newVerificationHandler(t, tt.mode)
+			token, _, err := h.issueAccessToken(2, "user")
+			if err != nil {
+				t.Fatal(err)
+			}
+			handler := h.RequireVerified(func(w http.ResponseWriter, r *http.Request) {
+				respondSuccess(w, nil)
+			})
+			call := func(authorization string) int {
+				req := httptest.NewRequest("POST", "/api/orders", nil)
+				if authorization != "" {
+					req.Header.Set("Authorization", authorization)
+				}
+				rec := httptest.NewRecorder()
+				handler(rec, req)
+				return rec.Code
+			}
+
+			if got := call(""); got != tt.anonymous {
+				t.Errorf("anonymous: status %d, want %d", got, tt.anonymous)
+			}
+			if got := call("Bearer " + token); got != tt.unverified {
+				t.Errorf("unverified: status %d, want %d", got, tt.unverified)
+			}
+			s.verified = true
+			if got := call("Bearer " + token); got != tt.valid {
+				t.Errorf("verified: status %d, want %d", got, tt.valid)
+			}
+		})
+	}
+}
+
+func TestLoginUnverified(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("Rahasia123"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		mode string
+		want int
+	}{
+		{UnverifiedAccessFull, http.StatusOK},
+		{UnverifiedAccessBrowse, http.StatusOK},
+		{UnverifiedAccessNone, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			db, f := newFakeDB(t)
+			h := NewHandler(db, Config{
+				TokenSecret:      []byte("test-secret"),
+				AccessTokenTTL:   time.Hour,
+				RefreshTokenTTL:  time.Hour,
+				UnverifiedAccess: tt.mode,
+			})
+			f.on("FROM users WHERE email = ?", func([]driver.Value) fakeResult {
+				return row(int64(2), "user@example.com", "Test User", string(hash), "user", int64(1), false)
+			})
+			rec := postJSON(h.Login, "/api/auth/login",
+				map[string]string{"email": "user@example.com", "password": "Rahasia123"})
+			if rec.Code != tt.want {
+				t.Errorf("status %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeResult is the answer to one statement sent to a fakeDB.
+type fakeResult struct {
+	columns  []string
+	rows     [][]driver.Value
+	affected int64
+	lastID   int64
+	err      error
+}
+
+type fakeResponder struct {
+	match string
+	fn    func(args []driver.Value) fakeResult
+}
+
+// fakeDB is a database/sql driver whose statements are answered by functions
+// a test registers for fragments of the SQL, so handler logic can be tested
+// without MySQL. Statements are answered one at a time; those no responder
+// matches succeed with no rows and nothing affected.
+type fakeDB struct {
+	mu         sync.Mutex
+	responders []fakeResponder
+}
+
+// newFakeDB returns a *sql.DB backed by a new fakeDB.
+func newFakeDB(t *testing.T) (*sql.DB, *fakeDB) {
+	t.Helper()
+	f := &fakeDB{}
+	db := sql.OpenDB(f)
+	t.Cleanup(func() { db.Close() })
+	return db, f
+}
+
+// on answers statements containing match, after collapsing whitespace, with fn.
+// The first responder registered for a statement wins.
+func (f *fakeDB) on(match string, fn func(args []driver.Value) fakeResult) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.responders = append(f.responders, fakeResponder{match: match, fn: fn})
+}
+
+func (f *fakeDB) answer(query string, args []driver.Value) fakeResult {
+	query = strings.Join(strings.Fields(query), " ")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, r := range f.responders {
+		if strings.Contains(query, r.match) {
+			return r.fn(args)
+		}
+	}
+	return fakeResult{}
+}
+
+func (f *fakeDB) Connect(context.Context) (driver.Conn, error) { return fakeConn{f}, nil }
+func (f *fakeDB) Driver() driver.Driver                        { return fakeDriver{f} }
+
+type fakeDriver struct{ f *fakeDB }
+
+func (d fakeDriver) Open(string) (driver.Conn, error) { return fakeConn{d.f}, nil }
+
+type fakeConn struct{ f *fakeDB }
+
+func (c fakeConn) Prepare(query string) (driver.Stmt, error) { return fakeStmt{c.f, query}, nil }
+func (c fakeConn) Close() error                              { return nil }
+func (c fakeConn) Begin() (driver.Tx, error)                 { return fakeTx{}, nil }
+
+type fakeTx struct{}
+
+func (fakeTx) Commit() error   { return nil }
+func (fakeTx) Rollback() error { return nil }
+
+type fakeStmt struct {
+	f     *fakeDB
+	query string
+}
+
+func (s fakeStmt) Close() error  { return nil }
+func (s fakeStmt) NumInput() int { return -1 }
+
+func (s fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	res := s.f.answer(s.query, args)
+	if res.err != nil {
+		return nil, res.err
+	}
+	return fakeExecResult{res.lastID, res.affected}, nil
+}
+
+func (s fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	res := s.f.answer(s.query, args)
+	if res.err != nil {
+		return nil, res.err
+	}
+	return &fakeRows{columns: res.columns, rows: res.rows}, nil
+}
+
+type fakeExecResult struct{ lastID, affected int64 }
+
+func (r fakeExecResult) LastInsertId() (int64, error) { return r.lastID, nil }
+func (r fakeExecResult) RowsAffected() (int64, error) { return r.affected, nil }
+
+type fakeRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return r.columns }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+// row is a fakeResult with a single row; its columns are named c0, c1 and so on.
+func row(values ...driver.Value) fakeResult {
+	columns := make([]string, len(values))
+	for i := range columns {
+		columns[i] = "c" + strconv.Itoa(i)
+	}
+	return fakeResult{columns: columns, rows: [][]driver.Value{values}}
+}
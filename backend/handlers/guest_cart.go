@@ -0,0 +1,252 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"strings"
+)
+
+// cartTokenHeader carries the client-generated identifier of an anonymous cart.
+const cartTokenHeader = "X-Cart-Token"
+
+// maxGuestCartLines is the most distinct products an anonymous cart may hold.
+const maxGuestCartLines = 50
+
+// Values for Config.CartMergeStrategy.
+const (
+	// CartMergeSum adds the guest quantity to the quantity already in the user's cart.
+	CartMergeSum = "sum"
+	// CartMergeMax keeps the larger of the two quantities.
+	CartMergeMax = "max"
+)
+
+// CartAdjustment describes a guest cart line whose quantity was not simply copied over.
+type CartAdjustment struct {
+	ProductID     int    `json:"product_id"`
+	GuestQuantity int    `json:"guest_quantity"`
+	UserQuantity  int    `json:"user_quantity"`
+	Quantity      int    `json:"quantity"`
+	Reason        string `json:"reason"`
+}
+
+// CartMergeResult reports what happened to a guest cart on login.
+type CartMergeResult struct {
+	MergedItems int              `json:"merged_items"`
+	Adjustments []CartAdjustment `json:"adjustments"`
+}
+
+// guestCartToken returns the cart token from the request, or "" if absent or malformed.
+func guestCartToken(r *http.Request) string {
+	token := strings.TrimSpace(r.Header.Get(cartTokenHeader))
+	if len(token) < 16 || len(token) > 128 {
+		return ""
+	}
+	return token
+}
+
+func guestCart(token string) cartRef {
+	return cartRef{table: "guest_cart_items", ownerCol: "cart_token_hash", owner: hashToken(token), maxLines: maxGuestCartLines}
+}
+
+// guestCartFromRequest resolves the guest cart, writing an error if the token is
+// missing. Every line of the cart is marked as used now, so expireGuestCarts
+// only removes carts nobody has touched for Config.GuestCartTTL.
+func (h *Handler) guestCartFromRequest(w http.ResponseWriter, r *http.Request) (cartRef, bool) {
+	token := guestCartToken(r)
+	if token == "" {
+		respondError(w, http.StatusBadRequest, "Header "+cartTokenHeader+" wajib diisi (16-128 karakter)")
+		return cartRef{}, false
+	}
+	ref := guestCart(token)
+	if _, err := h.DB.Exec(
+		"UPDATE guest_cart_items SET updated_at = NOW() WHERE cart_token_hash = ?", ref.owner,
+	); err != nil {
+		log.Printf("guest cart: failed to touch cart: %v", err)
+	}
+	return ref, true
+}
+
+// GetGuestCart returns the anonymous cart identified by X-Cart-Token.
+func (h *Handler) GetGuestCart(w http.ResponseWriter, r *http.Request) {
+	if ref, ok := h.guestCartFromRequest(w, r); ok {
+		h.respondCart(w, ref)
+	}
+}
+
+// AddGuestCartItem adds a product to the anonymous cart.
+func (h *Handler) AddGuestCartItem(w http.ResponseWriter, r *http.Request) {
+	if ref, ok := h.guestCartFromRequest(w, r); ok {
+		h.addCartItem(w, r, ref)
+	}
+}
+
+// UpdateGuestCartItem sets the quantity of an anonymous cart line; zero removes it.
+func (h *Handler) UpdateGuestCartItem(w http.ResponseWriter, r *http.Request) {
+	if ref, ok := h.guestCartFromRequest(w, r); ok {
+		h.updateCartItem(w, r, ref)
+	}
+}
+
+// RemoveGuestCartItem deletes a product from the anonymous cart.
+func (h *Handler) RemoveGuestCartItem(w http.ResponseWriter, r *http.Request) {
+	if ref, ok := h.guestCartFromRequest(w, r); ok {
+		h.removeCartItem(w, r, ref)
+	}
+}
+
+// ClearGuestCart empties the anonymous cart.
+func (h *Handler) ClearGuestCart(w http.ResponseWriter, r *http.Request) {
+	if ref, ok := h.guestCartFromRequest(w, r); ok {
+		h.clearCart(w, ref)
+	}
+}
+
+// mergeGuestCartFromRequest merges the request's guest cart into the user's cart.
+// It returns nil when no cart token was sent; merge failures are logged and
+// never fail the login.
+func (h *Handler) mergeGuestCartFromRequest(r *http.Request, userID int) *CartMergeResult {
+	token := guestCartToken(r)
+	if token == "" {
+		return nil
+	}
+
+	result, err := h.mergeGuestCart(token, userID)
+	if err != nil {
+		log.Printf("cart merge: failed for user %d: %v", userID, err)
+		return nil
+	}
+	return result
+}
+
+// mergeGuestCart moves every guest cart line into the user's cart according to
+// Config.CartMergeStrategy and Config.CartMergeCapAtStock, then deletes the guest cart.
+func (h *Handler) mergeGuestCart(token string, userID int) (*CartMergeResult, error) {
+	tokenHash := hashToken(token)
+
+	tx, err := h.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Lock the guest lines first so two concurrent logins cannot merge the same cart twice.
+	locked, err := tx.Query("SELECT id FROM guest_cart_items WHERE cart_token_hash = ? FOR UPDATE", tokenHash)
+	if err != nil {
+		return nil, err
+	}
+	locked.Close()
+
+	rows, err := tx.Query(`
+		SELECT g.product_id, g.quantity, p.stock, p.is_active, COALESCE(ci.quantity, 0)
+		FROM guest_cart_items g
+		JOIN products p ON g.product_id = p.id
+		LEFT JOIN cart_items ci ON ci.user_id = ? AND ci.product_id = g.product_id
+		WHERE g.cart_token_hash = ?
+	`, userID, tokenHash)
+	if err != nil {
+		return nil, err
+	}
+
+	type guestLine struct {
+		productID, guestQty, stock, userQty int
+		active                              bool
+	}
+	var lines []guestLine
+	for rows.Next() {
+		var (
+			l        guestLine
+			isActive int
+		)
+		if err := rows.Scan(&l.productID, &l.guestQty, &l.stock, &isActive, &l.userQty); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		l.active = isActive == 1
+		lines = append(lines, l)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	result := &CartMergeResult{Adjustments: []CartAdjustment{}}
+	for _, l := range lines {
+		adj := CartAdjustment{
+			ProductID:     l.productID,
+			GuestQuantity: l.guestQty,
+			UserQuantity:  l.userQty,
+		}
+
+		if !l.active {
+			adj.Quantity = l.userQty
+			adj.Reason = "product_unavailable"
+			result.Adjustments = append(result.Adjustments, adj)
+			continue
+		}
+
+		qty := l.guestQty
+		if l.userQty > 0 {
+			if h.Config.CartMergeStrategy == CartMergeMax {
+				if l.userQty > qty {
+					qty = l.userQty
+				}
+				adj.Reason = "kept_max"
+			} else {
+				qty += l.userQty
+				adj.Reason = "summed"
+			}
+		}
+
+		if h.Config.CartMergeCapAtStock && qty > l.stock {
+			if l.stock <= 0 {
+				// Leave whatever the user already had; the cart flags it as out of stock.
+				adj.Quantity = l.userQty
+				adj.Reason = "out_of_stock"
+				result.Adjustments = append(result.Adjustments, adj)
+				continue
+			}
+			qty = l.stock
+			adj.Reason = "capped_at_stock"
+		}
+
+		if qty > maxCartQuantity {
+			qty = maxCartQuantity
+			adj.Reason = "capped_at_max"
+		}
+
+		adj.Quantity = qty
+		if adj.Reason != "" {
+			result.Adjustments = append(result.Adjustments, adj)
+		}
+
+		if _, err := tx.Exec(`
+			INSERT INTO cart_items (user_id, product_id, quantity) VALUES (?, ?, ?)
+			ON DUPLICATE KEY UPDATE quantity = VALUES(quantity)
+		`, userID, l.productID, qty); err != nil {
+			return nil, err
+		}
+		result.MergedItems++
+	}
+
+	if _, err := tx.Exec("DELETE FROM guest_cart_items WHERE cart_token_hash = ?", tokenHash); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// expireGuestCarts deletes a batch of lines from anonymous carts unused for
+// Config.GuestCartTTL and returns how many were deleted.
+func (h *Handler) expireGuestCarts() (int64, error) {
+	res, err := h.DB.Exec(
+		"DELETE FROM guest_cart_items WHERE updated_at < NOW() - INTERVAL ? SECOND LIMIT 1000",
+		int(h.Config.GuestCartTTL.Seconds()),
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
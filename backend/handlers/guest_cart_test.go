@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestGuestCartToken(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{"", ""},
+		{"too-short", ""},
+		{" guest-cart-token-0123456789 ", "guest-cart-token-0123456789"},
+		{strings.Repeat("a", 129), ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/api/guest-cart", nil)
+		req.Header.Set(cartTokenHeader, tt.header)
+		if got := guestCartToken(req); got != tt.want {
+			t.Errorf("guestCartToken(%q) = %q, want %q", tt.header, got, tt.want)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	(&Handler{}).GetGuestCart(rec, httptest.NewRequest("GET", "/api/guest-cart", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("no cart token: status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestMergeGuestCart(t *testing.T) {
+	tests := []struct {
+		name       string
+		strategy   string
+		capAtStock bool
+		guest      int64
+		user       int64
+		stock      int64
+		active     int64
+		want       int64 // quantity written to cart_items, 0 for none
+		wantReason string
+	}{
+		{"new line", CartMergeSum, true, 2, 0, 10, 1, 2, ""},
+		{"sum", CartMergeSum, true, 2, 3, 10, 1, 5, "summed"},
+		{"max keeps the user quantity", CartMergeMax, true, 2, 3, 10, 1, 3, "kept_max"},
+		{"max keeps the guest quantity", CartMergeMax, true, 4, 3, 10, 1, 4, "kept_max"},
+		{"sum capped at stock", CartMergeSum, true, 4, 3, 5, 1, 5, "capped_at_stock"},
+		{"sum past stock without the cap", CartMergeSum, false, 4, 3, 5, 1, 7, "summed"},
+		{"out of stock", CartMergeSum, true, 2, 3, 0, 1, 0, "out_of_stock"},
+		{"inactive product", CartMergeSum, true, 2, 3, 10, 0, 0, "product_unavailable"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, f := newFakeDB(t)
+			h := &Handler{DB: db, Config: Config{CartMergeStrategy: tt.strategy, CartMergeCapAtStock: tt.capAtStock}}
+
+			token := "guest-cart-token-0123456789"
+			f.on("FROM guest_cart_items g JOIN products p", func(args []driver.Value) fakeResult {
+				if !reflect.DeepEqual(args, []driver.Value{int64(2), hashToken(token)}) {
+					t.Errorf("guest lines read with %v", args)
+				}
+				return row(int64(1), tt.guest, tt.stock, tt.active, tt.user)
+			})
+			var written int64
+			f.on("INSERT INTO cart_items", func(args []driver.Value) fakeResult {
+				written = args[2].(int64)
+				return fakeResult{affected: 1}
+			})
+			deleted := false
+			f.on("DELETE FROM guest_cart_items WHERE cart_token_hash = ?", func([]driver.Value) fakeResult {
+				deleted = true
+				return fakeResult{affected: 1}
+			})
+
+			result, err := h.mergeGuestCart(token, 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if written != tt.want {
+				t.Errorf("wrote quantity %d, want %d", written, tt.want)
+			}
+			if !deleted {
+				t.Error("guest cart not deleted")
+			}
+
+			var reason string
+			if len(result.Adjustments) > 0 {
+				reason = result.Adjustments[0].Reason
+			}
+			if reason != tt.wantReason {
+				t.Errorf("adjustment reason %q, want %q", reason, tt.wantReason)
+			}
+			if wantMerged := boolToInt(tt.want > 0); result.MergedItems != wantMerged {
+				t.Errorf("merged %d items, want %d", result.MergedItems, wantMerged)
+			}
+		})
+	}
+}
@@ -3,17 +3,132 @@ package handlers
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"net"
 	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
 )
 
+// Config holds the settings handlers need beyond the DB connection.
+type Config struct {
+	// TokenSecret is the HMAC key used to sign access tokens.
+	TokenSecret []byte
+	// AccessTokenTTL is how long an issued access token stays valid.
+	AccessTokenTTL time.Duration
+	// RefreshTokenTTL is how long a refresh token can be exchanged.
+	RefreshTokenTTL time.Duration
+	// PasswordResetTTL is how long a password reset token stays valid.
+	PasswordResetTTL time.Duration
+	// PasswordResetURL, when set, is prefixed to the reset token to build a link in the email.
+	PasswordResetURL string
+	// Mailer delivers password reset and other account emails.
+	Mailer Mailer
+	// AccountThrottle and IPThrottle slow down repeated failed logins per email and per client IP.
+	AccountThrottle LoginThrottle
+	IPThrottle      LoginThrottle
+	// TrustedProxies are the reverse proxies whose X-Forwarded-For entries are
+	// believed when working out the client IP; with none the header is ignored.
+	TrustedProxies []*net.IPNet
+	// PasswordPolicy is enforced whenever a password is set.
+	PasswordPolicy PasswordPolicy
+	// EmailVerificationTTL is how long an email verification token stays valid.
+	EmailVerificationTTL time.Duration
+	// EmailVerificationURL, when set, is prefixed to the verification token to build a link.
+	EmailVerificationURL string
+	// VerificationResendInterval is the minimum time between verification emails.
+	VerificationResendInterval time.Duration
+	// UnverifiedAccess is one of the UnverifiedAccess* constants.
+	UnverifiedAccess string
+	// TwoFactorIssuer is the account issuer shown in authenticator apps.
+	TwoFactorIssuer string
+	// TwoFactorChallengeTTL is how long a client has to submit the second factor after the password.
+	TwoFactorChallengeTTL time.Duration
+	// TwoFactorRoles lists roles that may only use staff endpoints once 2FA is enabled.
+	TwoFactorRoles map[string]bool
+	// CartMergeStrategy is CartMergeSum or CartMergeMax and decides how a guest cart
+	// line combines with the same product already in the user's cart on login.
+	CartMergeStrategy string
+	// CartMergeCapAtStock limits merged quantities to the product's current stock.
+	CartMergeCapAtStock bool
+	// GuestCartTTL is how long an anonymous cart is kept after it was last used.
+	GuestCartTTL time.Duration
+	// OrderHoldTTL is how long a pending order keeps its stock before the hold
+	// sweeper cancels it; zero means holds never expire.
+	OrderHoldTTL time.Duration
+	// OrderHoldMaxAge caps how long after placement a pending payment may keep
+	// extending an order's hold.
+	OrderHoldMaxAge time.Duration
+	// IdempotencyKeyTTL is how long a stored Idempotency-Key response is replayed.
+	IdempotencyKeyTTL time.Duration
+	// PaymentGateway collects payments for orders; it defaults to a FakeGateway.
+	PaymentGateway PaymentGateway
+	// PaymentWebhookSecret signs payment webhooks; the endpoint is disabled while it is empty.
+	PaymentWebhookSecret []byte
+	// PaymentWebhookTolerance is how far a webhook timestamp may be from now.
+	PaymentWebhookTolerance time.Duration
+}
+
 // Handler groups shared dependencies for HTTP handlers.
 type Handler struct {
-	DB *sql.DB
+	DB     *sql.DB
+	Config Config
+}
+
+// NewHandler creates a Handler with the provided DB connection and config.
+func NewHandler(db *sql.DB, cfg Config) *Handler {
+	if cfg.Mailer == nil {
+		cfg.Mailer = &WriterMailer{W: os.Stdout}
+	}
+	if cfg.PaymentGateway == nil {
+		cfg.PaymentGateway = &FakeGateway{}
+	}
+	return &Handler{DB: db, Config: cfg}
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// isDuplicateKey reports whether err is a MySQL unique constraint violation.
+func isDuplicateKey(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == 1062
+}
+
+// parsePagination reads the page and limit query parameters. Page defaults to 1
+// and limit to 20, capped at 100.
+func parsePagination(r *http.Request) (page, limit, offset int) {
+	page, _ = strconv.Atoi(r.URL.Query().Get("page"))
+	if page < 1 {
+		page = 1
+	}
+	limit, _ = strconv.Atoi(r.URL.Query().Get("limit"))
+	if limit < 1 {
+		limit = 20
+	}
+	if limit > 100 {
+		limit = 100
+	}
+	return page, limit, (page - 1) * limit
+}
+
+// nullableInt returns v as an int, or nil (JSON null) when it is NULL.
+func nullableInt(v sql.NullInt64) interface{} {
+	if !v.Valid {
+		return nil
+	}
+	return int(v.Int64)
 }
 
-// NewHandler creates a Handler with the provided DB connection.
-func NewHandler(db *sql.DB) *Handler {
-	return &Handler{DB: db}
+// queryer is satisfied by both *sql.DB and *sql.Tx.
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
 }
 
 type Response struct {
@@ -21,6 +136,8 @@ type Response struct {
 	Data    interface{} `json:"data,omitempty"`
 	Message string      `json:"message,omitempty"`
 	Error   string      `json:"error,omitempty"`
+	// Errors maps request field names to validation messages.
+	Errors map[string]string `json:"errors,omitempty"`
 }
 
 func respondJSON(w http.ResponseWriter, status int, data interface{}) {
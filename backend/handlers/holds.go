@@ -0,0 +1,177 @@
+package handlers
+
+import (
+	"database/sql"
+	"log"
+	"time"
+)
+
+// holdExpiry is the argument for "NOW() + INTERVAL ? SECOND" that sets
+// orders.hold_expires_at on a new order. It is nil when holds never expire,
+// which makes the expression NULL.
+func (h *Handler) holdExpiry() interface{} {
+	if h.Config.OrderHoldTTL <= 0 {
+		return nil
+	}
+	return int(h.Config.OrderHoldTTL.Seconds())
+}
+
+// restockOrder puts the quantities of every line of an order back into stock,
+// less any units a completed refund has already restocked.
+func restockOrder(q execer, orderID int) error {
+	_, err := q.Exec(`
+		UPDATE products p
+		JOIN (
+			SELECT oi.product_id, SUM(oi.quantity - COALESCE(back.quantity, 0)) AS quantity
+			FROM order_items oi
+			LEFT JOIN (
+				SELECT ri.order_item_id, SUM(ri.quantity) AS quantity
+				FROM refund_items ri
+				JOIN refunds rf ON ri.refund_id = rf.id
+				WHERE rf.order_id = ? AND rf.restocked = 1 AND rf.status = 'completed'
+				GROUP BY ri.order_item_id
+			) back ON back.order_item_id = oi.id
+			WHERE oi.order_id = ?
+			GROUP BY oi.product_id
+		) owed ON owed.product_id = p.id
+		SET p.stock = p.stock + owed.quantity
+	`, orderID, orderID)
+	return err
+}
+
+// StartHoldSweeper runs sweep every interval in a background goroutine. The
+// interval must be positive.
+func (h *Handler) StartHoldSweeper(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			h.sweep()
+		}
+	}()
+}
+
+// sweep expires unpaid holds, retries refunds left pending, purges expired
+// idempotency keys and deletes unused guest carts, logging what it did.
+func (h *Handler) sweep() {
+	if n, err := h.expireHolds(); err != nil {
+		log.Printf("hold sweeper: %v", err)
+	} else if n > 0 {
+		log.Printf("hold sweeper: cancelled %d unpaid orders", n)
+	}
+	if n, err := h.retryPendingRefunds(); err != nil {
+		log.Printf("hold sweeper: %v", err)
+	} else if n > 0 {
+		log.Printf("hold sweeper: settled %d pending refunds", n)
+	}
+	if n, err := h.purgeIdempotencyKeys(); err != nil {
+		log.Printf("hold sweeper: %v", err)
+	} else if n > 0 {
+		log.Printf("hold sweeper: purged %d expired idempotency keys", n)
+	}
+	if n, err := h.expireGuestCarts(); err != nil {
+		log.Printf("hold sweeper: %v", err)
+	} else if n > 0 {
+		log.Printf("hold sweeper: deleted %d lines from expired guest carts", n)
+	}
+}
+
+// expireHolds cancels pending orders whose hold has run out and releases their
+// stock. An order that fails is logged and left for the next sweep, so it
+// does not hold up the others. It returns the number of orders cancelled.
+func (h *Handler) expireHolds() (int, error) {
+	rows, err := h.DB.Query(
+		"SELECT id FROM orders WHERE status = 'pending' AND hold_expires_at <= NOW() ORDER BY hold_expires_at LIMIT 100",
+	)
+	if err != nil {
+		return 0, err
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	cancelled := 0
+	for _, id := range ids {
+		ok, err := h.expireHold(id)
+		if err != nil {
+			log.Printf("hold sweeper: expiring order %d failed: %v", id, err)
+			continue
+		}
+		if ok {
+			cancelled++
+		}
+	}
+	return cancelled, nil
+}
+
+// expireHold cancels one order if it is still pending with an expired hold;
+// the order may have been paid or cancelled since it was selected. While a
+// payment is still pending at the gateway the customer may yet pay, so the
+// hold is extended by another OrderHoldTTL instead, but never beyond
+// OrderHoldMaxAge after the order was placed; it runs out once the gateway
+// reports the charge expired or failed, or that limit is reached.
+func (h *Handler) expireHold(orderID int) (bool, error) {
+	// A payment that has gone through moves the order to processing first
+	payments, err := loadPayments(h.DB, orderID)
+	if err != nil {
+		return false, err
+	}
+	for _, p := range payments {
+		if err := h.refreshPayment(p); err != nil {
+			return false, err
+		}
+	}
+
+	tx, err := h.DB.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var expired bool
+	err = tx.QueryRow(
+		"SELECT status = 'pending' AND hold_expires_at IS NOT NULL AND hold_expires_at <= NOW() FROM orders WHERE id = ? FOR UPDATE",
+		orderID,
+	).Scan(&expired)
+	if err == sql.ErrNoRows || (err == nil && !expired) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	maxAge := int(h.Config.OrderHoldMaxAge.Seconds())
+	var paying bool
+	if err := tx.QueryRow(`
+		SELECT EXISTS(SELECT 1 FROM payments WHERE order_id = o.id AND status = 'pending')
+			AND o.created_at > NOW() - INTERVAL ? SECOND
+		FROM orders o WHERE o.id = ?
+	`, maxAge, orderID).Scan(&paying); err != nil {
+		return false, err
+	}
+	if paying {
+		if _, err := tx.Exec(
+			"UPDATE orders SET hold_expires_at = LEAST(NOW() + INTERVAL ? SECOND, created_at + INTERVAL ? SECOND) WHERE id = ?",
+			h.holdExpiry(), maxAge, orderID,
+		); err != nil {
+			return false, err
+		}
+		return false, tx.Commit()
+	}
+
+	if _, err := transitionOrder(tx, orderID, OrderCancelled, 0, "Payment window expired"); err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
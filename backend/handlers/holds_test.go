@@ -0,0 +1,127 @@
+package handlers
+
+import (
+	"database/sql/driver"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestHoldExpiry(t *testing.T) {
+	if got := (&Handler{}).holdExpiry(); got != nil {
+		t.Errorf("no TTL: got %v, want nil so hold_expires_at stays NULL", got)
+	}
+	h := &Handler{Config: Config{OrderHoldTTL: 30 * time.Minute}}
+	if got := h.holdExpiry(); got != 1800 {
+		t.Errorf("30m TTL: got %v, want 1800 seconds", got)
+	}
+}
+
+// TestExpireHolds checks that the sweeper cancels and restocks only orders
+// that are still pending with an expired hold when it locks them, extends
+// the hold of an order whose payment is still pending, and carries on past an
+// order it fails to expire.
+func TestExpireHolds(t *testing.T) {
+	db, f := newFakeDB(t)
+	h := NewHandler(db, Config{OrderHoldTTL: 30 * time.Minute})
+
+	// Order 6 cannot be locked; order 8 was paid between the sweep query and
+	// the lock; order 9 has a payment pending at the gateway
+	f.on("SELECT id FROM orders WHERE status = 'pending' AND hold_expires_at <= NOW()", func([]driver.Value) fakeResult {
+		return fakeResult{columns: []string{"id"}, rows: [][]driver.Value{{int64(6)}, {int64(7)}, {int64(8)}, {int64(9)}}}
+	})
+	f.on("hold_expires_at <= NOW() FROM orders WHERE id = ? FOR UPDATE", func(args []driver.Value) fakeResult {
+		if args[0] == int64(6) {
+			return fakeResult{err: errors.New("lock wait timeout exceeded")}
+		}
+		return row(args[0] != int64(8))
+	})
+	f.on("SELECT EXISTS(SELECT 1 FROM payments", func(args []driver.Value) fakeResult {
+		return row(args[len(args)-1] == int64(9))
+	})
+	var extended []driver.Value
+	f.on("UPDATE orders SET hold_expires_at", func(args []driver.Value) fakeResult {
+		extended = append(extended, args[len(args)-1])
+		return fakeResult{affected: 1}
+	})
+	f.on("SELECT status FROM orders WHERE id = ? FOR UPDATE", func([]driver.Value) fakeResult {
+		return row(OrderPending)
+	})
+	var restocked, cancelled []driver.Value
+	f.on("UPDATE products p JOIN", func(args []driver.Value) fakeResult {
+		restocked = append(restocked, args[len(args)-1])
+		return fakeResult{affected: 1}
+	})
+	f.on("UPDATE orders SET status", func(args []driver.Value) fakeResult {
+		cancelled = append(cancelled, args[len(args)-1])
+		return fakeResult{affected: 1}
+	})
+
+	n, err := h.expireHolds()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("cancelled %d orders, want 1", n)
+	}
+	want := []driver.Value{int64(7)}
+	if !reflect.DeepEqual(restocked, want) || !reflect.DeepEqual(cancelled, want) {
+		t.Errorf("restocked %v and cancelled %v, want only order 7", restocked, cancelled)
+	}
+	if !reflect.DeepEqual(extended, []driver.Value{int64(9)}) {
+		t.Errorf("extended the holds of %v, want order 9", extended)
+	}
+}
+
+// TestExpireHoldCancelsUnknownCharge checks that a pending payment whose charge
+// the gateway has lost, e.g. after a restart, no longer keeps the hold alive.
+func TestExpireHoldCancelsUnknownCharge(t *testing.T) {
+	db, f := newFakeDB(t)
+	h := NewHandler(db, Config{
+		PaymentGateway:  &FakeGateway{},
+		OrderHoldTTL:    30 * time.Minute,
+		OrderHoldMaxAge: 24 * time.Hour,
+	})
+
+	paymentStatus := PaymentPending
+	orderStatus := OrderPending
+	var maxAgeArg driver.Value
+	f.on("FROM payments WHERE order_id = ? ORDER BY", func([]driver.Value) fakeResult {
+		return fakeResult{columns: make([]string, 12), rows: [][]driver.Value{paymentRow(4, 9, "fake_ch_lost", paymentStatus, 50000)}}
+	})
+	f.on("SELECT order_id FROM payments", func([]driver.Value) fakeResult { return row(int64(9)) })
+	f.on("SELECT status FROM orders", func([]driver.Value) fakeResult { return row(orderStatus) })
+	f.on("SELECT status FROM payments", func([]driver.Value) fakeResult { return row(paymentStatus) })
+	f.on("UPDATE payments SET status", func(args []driver.Value) fakeResult {
+		paymentStatus = args[0].(string)
+		return fakeResult{affected: 1}
+	})
+	f.on("hold_expires_at <= NOW() FROM orders", func([]driver.Value) fakeResult { return row(true) })
+	f.on("SELECT EXISTS(SELECT 1 FROM payments", func(args []driver.Value) fakeResult {
+		maxAgeArg = args[0]
+		return row(paymentStatus == PaymentPending)
+	})
+	f.on("UPDATE orders SET hold_expires_at = LEAST", func([]driver.Value) fakeResult {
+		t.Error("hold extended for a charge the gateway does not know")
+		return fakeResult{affected: 1}
+	})
+	f.on("UPDATE orders SET status", func(args []driver.Value) fakeResult {
+		orderStatus = args[0].(string)
+		return fakeResult{affected: 1}
+	})
+
+	cancelled, err := h.expireHold(9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if paymentStatus != PaymentExpired {
+		t.Errorf("payment status %q, want %q", paymentStatus, PaymentExpired)
+	}
+	if !cancelled || orderStatus != OrderCancelled {
+		t.Errorf("cancelled %v, order status %q; want the order cancelled", cancelled, orderStatus)
+	}
+	if maxAgeArg != int64(24*60*60) {
+		t.Errorf("max age argument %v, want %d seconds", maxAgeArg, 24*60*60)
+	}
+}
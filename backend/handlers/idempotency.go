@@ -0,0 +1,170 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// maxIdempotentBodyBytes bounds the request body Idempotent reads into memory
+// to hash it.
+const maxIdempotentBodyBytes = 1 << 20
+
+// idempotencyRecorder passes a response through while keeping a copy of it.
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *idempotencyRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *idempotencyRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// Idempotent makes a POST endpoint safe to retry. When the request carries an
+// Idempotency-Key header, the first response for that key is stored and
+// replayed for later requests with the same key and body; reusing the key
+// with a different body is rejected with 422. Keys are scoped to the
+// endpoint and to the authenticated user, so it must run after RequireAuth.
+// Server errors are not stored, so those requests can be retried.
+func (h *Handler) Idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimSpace(r.Header.Get(idempotencyKeyHeader))
+		if key == "" {
+			next(w, r)
+			return
+		}
+		if len(key) > 255 {
+			respondError(w, http.StatusBadRequest, idempotencyKeyHeader+" must be at most 255 characters")
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxIdempotentBodyBytes))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			respondError(w, http.StatusRequestEntityTooLarge, "Request body too large")
+			return
+		}
+		if err != nil {
+			respondError(w, http.StatusBadRequest, "Invalid request body")
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		principal, ok := principalFromContext(r.Context())
+		if !ok {
+			respondError(w, http.StatusUnauthorized, "Authentication required")
+			return
+		}
+		keyHash := hashToken(fmt.Sprintf("user:%d:%s %s:%s", principal.UserID, r.Method, r.URL.Path, key))
+		sum := sha256.Sum256(body)
+		fingerprint := hex.EncodeToString(sum[:])
+
+		// An expired key may be reused as if it were new
+		if _, err := h.DB.Exec(
+			"DELETE FROM idempotency_keys WHERE key_hash = ? AND expires_at <= NOW()", keyHash,
+		); err != nil {
+			respondError(w, http.StatusInternalServerError, "Failed to check idempotency key")
+			return
+		}
+
+		_, err = h.DB.Exec(
+			`INSERT INTO idempotency_keys (key_hash, request_hash, expires_at)
+			 VALUES (?, ?, NOW() + INTERVAL ? SECOND)`,
+			keyHash, fingerprint, int(h.Config.IdempotencyKeyTTL.Seconds()),
+		)
+		if isDuplicateKey(err) {
+			h.replayIdempotent(w, keyHash, fingerprint)
+			return
+		}
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, "Failed to check idempotency key")
+			return
+		}
+
+		// Release the key unless a response was stored, including when next
+		// panics, so the client is not locked out of it until it expires
+		stored := false
+		defer func() {
+			if stored {
+				return
+			}
+			if _, err := h.DB.Exec("DELETE FROM idempotency_keys WHERE key_hash = ?", keyHash); err != nil {
+				log.Printf("idempotency: failed to release key: %v", err)
+			}
+		}()
+
+		rec := &idempotencyRecorder{ResponseWriter: w}
+		next(rec, r)
+
+		if rec.status >= http.StatusInternalServerError || rec.status == 0 {
+			return
+		}
+
+		if _, err := h.DB.Exec(
+			"UPDATE idempotency_keys SET status_code = ?, response_body = ?, completed_at = NOW() WHERE key_hash = ?",
+			rec.status, rec.body.String(), keyHash,
+		); err != nil {
+			log.Printf("idempotency: failed to store response: %v", err)
+			return
+		}
+		stored = true
+	}
+}
+
+// replayIdempotent answers a request whose key has been seen before.
+func (h *Handler) replayIdempotent(w http.ResponseWriter, keyHash, fingerprint string) {
+	var (
+		requestHash string
+		status      int
+		body        string
+		completed   bool
+	)
+	err := h.DB.QueryRow(`
+		SELECT request_hash, COALESCE(status_code, 0), COALESCE(response_body, ''), completed_at IS NOT NULL
+		FROM idempotency_keys WHERE key_hash = ?
+	`, keyHash).Scan(&requestHash, &status, &body, &completed)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to check idempotency key")
+		return
+	}
+
+	switch {
+	case requestHash != fingerprint:
+		respondError(w, http.StatusUnprocessableEntity, idempotencyKeyHeader+" was already used with a different request")
+	case !completed:
+		respondError(w, http.StatusConflict, "A request with this "+idempotencyKeyHeader+" is still being processed")
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Idempotent-Replayed", "true")
+		w.WriteHeader(status)
+		io.WriteString(w, body)
+	}
+}
+
+// purgeIdempotencyKeys deletes a batch of expired idempotency keys and returns
+// how many were deleted.
+func (h *Handler) purgeIdempotencyKeys() (int64, error) {
+	res, err := h.DB.Exec("DELETE FROM idempotency_keys WHERE expires_at <= NOW() LIMIT 1000")
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,251 @@
+package handlers
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// storedKey is one idempotency_keys row on a fakeDB.
+type storedKey struct {
+	requestHash string
+	status      driver.Value
+	body        driver.Value
+	completed   bool
+}
+
+func newIdempotencyState(f *fakeDB) map[string]*storedKey {
+	keys := map[string]*storedKey{}
+	// Keys in these tests never expire
+	f.on("DELETE FROM idempotency_keys WHERE key_hash = ? AND expires_at <= NOW()", func([]driver.Value) fakeResult {
+		return fakeResult{}
+	})
+	f.on("INSERT INTO idempotency_keys", func(args []driver.Value) fakeResult {
+		hash := args[0].(string)
+		if _, ok := keys[hash]; ok {
+			return fakeResult{err: &mysql.MySQLError{Number: 1062, Message: "Duplicate entry"}}
+		}
+		keys[hash] = &storedKey{requestHash: args[1].(string)}
+		return fakeResult{affected: 1}
+	})
+	f.on("SELECT request_hash", func(args []driver.Value) fakeResult {
+		k, ok := keys[args[0].(string)]
+		if !ok {
+			return fakeResult{}
+		}
+		status, body := k.status, k.body
+		if status == nil {
+			status, body = int64(0), ""
+		}
+		return row(k.requestHash, status, body, k.completed)
+	})
+	f.on("UPDATE idempotency_keys SET status_code", func(args []driver.Value) fakeResult {
+		k, ok := keys[args[2].(string)]
+		if !ok {
+			return fakeResult{}
+		}
+		k.status, k.body, k.completed = args[0], args[1], true
+		return fakeResult{affected: 1}
+	})
+	f.on("DELETE FROM idempotency_keys WHERE key_hash = ?", func(args []driver.Value) fakeResult {
+		delete(keys, args[0].(string))
+		return fakeResult{affected: 1}
+	})
+	return keys
+}
+
+// idempotentRequest sends body to handler as user 2 with the given key.
+func idempotentRequest(handler http.HandlerFunc, key, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/api/orders", strings.NewReader(body))
+	req = req.WithContext(withPrincipal(req.Context(), Principal{UserID: 2, Role: RoleUser}))
+	req.Header.Set(idempotencyKeyHeader, key)
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	return rec
+}
+
+func TestIdempotentReplaysStoredResponse(t *testing.T) {
+	db, f := newFakeDB(t)
+	newIdempotencyState(f)
+	h := &Handler{DB: db}
+
+	calls := 0
+	handler := h.Idempotent(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		respondJSON(w, http.StatusCreated, map[string]int{"order_id": calls})
+	})
+
+	first := idempotentRequest(handler, "key-1", `{"items":[1]}`)
+	if first.Code != http.StatusCreated {
+		t.Fatalf("first request: status %d", first.Code)
+	}
+	again := idempotentRequest(handler, "key-1", `{"items":[1]}`)
+	if again.Code != http.StatusCreated || again.Body.String() != first.Body.String() {
+		t.Fatalf("replay: status %d body %q, want %d %q", again.Code, again.Body, first.Code, first.Body)
+	}
+	if again.Header().Get("Idempotent-Replayed") != "true" {
+		t.Error("replay is missing the Idempotent-Replayed header")
+	}
+	if calls != 1 {
+		t.Errorf("handler ran %d times, want 1", calls)
+	}
+
+	if rec := idempotentRequest(handler, "key-2", `{"items":[1]}`); rec.Code != http.StatusCreated || calls != 2 {
+		t.Errorf("new key: status %d after %d calls, want %d after 2", rec.Code, calls, http.StatusCreated)
+	}
+}
+
+func TestIdempotentRejectsDifferentBody(t *testing.T) {
+	db, f := newFakeDB(t)
+	newIdempotencyState(f)
+	h := &Handler{DB: db}
+
+	calls := 0
+	handler := h.Idempotent(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		respondJSON(w, http.StatusCreated, map[string]int{"order_id": calls})
+	})
+
+	idempotentRequest(handler, "key-1", `{"items":[1]}`)
+	if rec := idempotentRequest(handler, "key-1", `{"items":[2]}`); rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("different body: status %d, want %d", rec.Code, http.StatusUnprocessableEntity)
+	}
+	if calls != 1 {
+		t.Errorf("handler ran %d times, want 1", calls)
+	}
+}
+
+func TestIdempotentRejectsRequestInFlight(t *testing.T) {
+	db, f := newFakeDB(t)
+	newIdempotencyState(f)
+	h := &Handler{DB: db}
+
+	var handler http.HandlerFunc
+	var inFlight *httptest.ResponseRecorder
+	handler = h.Idempotent(func(w http.ResponseWriter, r *http.Request) {
+		// The client retries before the first request has answered
+		if inFlight == nil {
+			inFlight = idempotentRequest(handler, "key-1", `{"items":[1]}`)
+		}
+		respondJSON(w, http.StatusCreated, map[string]int{"order_id": 1})
+	})
+
+	if rec := idempotentRequest(handler, "key-1", `{"items":[1]}`); rec.Code != http.StatusCreated {
+		t.Fatalf("first request: status %d", rec.Code)
+	}
+	if inFlight.Code != http.StatusConflict {
+		t.Errorf("retry while in flight: status %d, want %d", inFlight.Code, http.StatusConflict)
+	}
+}
+
+func TestIdempotentDoesNotStoreServerErrors(t *testing.T) {
+	db, f := newFakeDB(t)
+	keys := newIdempotencyState(f)
+	h := &Handler{DB: db}
+
+	calls := 0
+	handler := h.Idempotent(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			respondError(w, http.StatusInternalServerError, "Failed to create order")
+			return
+		}
+		respondJSON(w, http.StatusCreated, map[string]int{"order_id": calls})
+	})
+
+	if rec := idempotentRequest(handler, "key-1", `{"items":[1]}`); rec.Code != http.StatusInternalServerError {
+		t.Fatalf("first request: status %d", rec.Code)
+	}
+	if len(keys) != 0 {
+		t.Fatal("key kept after a server error")
+	}
+	rec := idempotentRequest(handler, "key-1", `{"items":[1]}`)
+	if rec.Code != http.StatusCreated || rec.Header().Get("Idempotent-Replayed") != "" {
+		t.Errorf("retry after a server error: status %d replayed %q, want a fresh %d",
+			rec.Code, rec.Header().Get("Idempotent-Replayed"), http.StatusCreated)
+	}
+}
+
+func TestIdempotentReleasesKeyOnPanic(t *testing.T) {
+	db, f := newFakeDB(t)
+	keys := newIdempotencyState(f)
+	h := &Handler{DB: db}
+
+	calls := 0
+	handler := h.Idempotent(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			panic("handler failed")
+		}
+		respondJSON(w, http.StatusCreated, map[string]int{"order_id": calls})
+	})
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("panic did not reach the caller")
+			}
+		}()
+		idempotentRequest(handler, "key-1", `{"items":[1]}`)
+	}()
+	if len(keys) != 0 {
+		t.Fatal("key kept after the handler panicked")
+	}
+	if rec := idempotentRequest(handler, "key-1", `{"items":[1]}`); rec.Code != http.StatusCreated || calls != 2 {
+		t.Errorf("retry after a panic: status %d after %d calls, want %d after 2", rec.Code, calls, http.StatusCreated)
+	}
+}
+
+func TestIdempotentWithoutKeyOrScope(t *testing.T) {
+	db, _ := newFakeDB(t)
+	h := &Handler{DB: db}
+
+	calls := 0
+	handler := h.Idempotent(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		respondJSON(w, http.StatusCreated, nil)
+	})
+
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest("POST", "/api/orders", strings.NewReader(`{}`)))
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("without a key: status %d", rec.Code)
+		}
+	}
+	if calls != 2 {
+		t.Errorf("handler ran %d times without a key, want 2", calls)
+	}
+
+	req := httptest.NewRequest("POST", "/api/orders", strings.NewReader(`{}`))
+	req.Header.Set(idempotencyKeyHeader, "key-1")
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("key without a signed-in user: status %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestIdempotentRejectsLargeBody(t *testing.T) {
+	db, f := newFakeDB(t)
+	keys := newIdempotencyState(f)
+	h := &Handler{DB: db}
+
+	calls := 0
+	handler := h.Idempotent(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		respondJSON(w, http.StatusCreated, nil)
+	})
+
+	body := `{"notes":"` + strings.Repeat("x", maxIdempotentBodyBytes) + `"}`
+	if rec := idempotentRequest(handler, "key-1", body); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("status %d, want %d", rec.Code, http.StatusRequestEntityTooLarge)
+	}
+	if calls != 0 || len(keys) != 0 {
+		t.Errorf("oversized body: handler ran %d times, %d keys stored", calls, len(keys))
+	}
+}
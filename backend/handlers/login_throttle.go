@@ -0,0 +1,204 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// LoginThrottle describes how failed logins for a single key (account or IP) are slowed down.
+type LoginThrottle struct {
+	// FreeAttempts is the number of failures tolerated before any delay applies.
+	FreeAttempts int
+	// BaseDelay is the first backoff delay; it doubles with every further failure.
+	BaseDelay time.Duration
+	// MaxDelay caps the exponential backoff.
+	MaxDelay time.Duration
+	// LockoutThreshold is the failure count at which the key is locked out.
+	LockoutThreshold int
+	// LockoutDuration is how long a lockout lasts. Failures older than this are forgotten.
+	LockoutDuration time.Duration
+}
+
+// delay returns how long the key is blocked after its n-th consecutive failure.
+func (t LoginThrottle) delay(failures int) time.Duration {
+	if t.LockoutThreshold > 0 && failures >= t.LockoutThreshold {
+		return t.LockoutDuration
+	}
+	if failures <= t.FreeAttempts {
+		return 0
+	}
+
+	d := t.BaseDelay
+	for i := t.FreeAttempts + 1; i < failures && d < t.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > t.MaxDelay {
+		d = t.MaxDelay
+	}
+	return d
+}
+
+func accountThrottleKey(email string) string {
+	return "email:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func ipThrottleKey(ip string) string {
+	return "ip:" + ip
+}
+
+// ParseTrustedProxies parses a comma-separated list of proxy IP addresses and
+// CIDR ranges, as used for Config.TrustedProxies.
+func ParseTrustedProxies(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid proxy address %q", entry)
+			}
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+			entry = fmt.Sprintf("%s/%d", entry, bits)
+		}
+		_, n, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy range %q", entry)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// trustedProxy reports whether ip belongs to one of the configured proxies.
+func (h *Handler) trustedProxy(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, n := range h.Config.TrustedProxies {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the caller's address. X-Forwarded-For is only read when the
+// connection comes from a trusted proxy, and then from the right: each proxy
+// appends the address it saw, so the rightmost entry that is not itself a
+// trusted proxy is the client. Entries further left are whatever the client
+// sent and are ignored.
+func (h *Handler) clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if !h.trustedProxy(ip) {
+		return ip
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		if net.ParseIP(hop) == nil {
+			// Not written by a proxy we trust; stop at the last good address
+			break
+		}
+		ip = hop
+		if !h.trustedProxy(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// loginRetryAfter reports how long the caller must wait before another attempt
+// for any of the given keys. Zero means a login may be attempted now.
+func (h *Handler) loginRetryAfter(keys ...string) time.Duration {
+	var maxSeconds int64
+	for _, key := range keys {
+		var seconds int64
+		err := h.DB.QueryRow(
+			"SELECT TIMESTAMPDIFF(SECOND, NOW(), blocked_until) FROM login_throttles WHERE throttle_key = ? AND blocked_until > NOW()",
+			key,
+		).Scan(&seconds)
+		if err != nil {
+			continue
+		}
+		if seconds > maxSeconds {
+			maxSeconds = seconds
+		}
+	}
+	if maxSeconds == 0 {
+		return 0
+	}
+	return time.Duration(maxSeconds+1) * time.Second
+}
+
+// recordLoginFailure bumps the failure counter of a key and applies its backoff.
+// The counter is incremented in a single upsert and the backoff is computed from
+// the count that statement wrote while the row is still locked, so parallel
+// failures each count and none of them can shorten another's block.
+func (h *Handler) recordLoginFailure(key string, policy LoginThrottle) {
+	tx, err := h.DB.Begin()
+	if err != nil {
+		log.Printf("login throttle: failed to record %s: %v", key, err)
+		return
+	}
+	defer tx.Rollback()
+
+	// failures is assigned before last_failure_at, so it still sees the old value
+	_, err = tx.Exec(`
+		INSERT INTO login_throttles (throttle_key, failures, last_failure_at)
+		VALUES (?, 1, NOW())
+		ON DUPLICATE KEY UPDATE
+			failures = IF(last_failure_at < NOW() - INTERVAL ? SECOND, 1, failures + 1),
+			last_failure_at = NOW()
+	`, key, int(policy.LockoutDuration.Seconds()))
+	if err != nil {
+		log.Printf("login throttle: failed to record %s: %v", key, err)
+		return
+	}
+
+	var failures int
+	if err := tx.QueryRow("SELECT failures FROM login_throttles WHERE throttle_key = ?", key).Scan(&failures); err != nil {
+		log.Printf("login throttle: failed to read %s: %v", key, err)
+		return
+	}
+
+	if delay := int(policy.delay(failures).Seconds()); delay > 0 {
+		_, err = tx.Exec(`
+			UPDATE login_throttles
+			SET blocked_until = GREATEST(COALESCE(blocked_until, NOW()), NOW() + INTERVAL ? SECOND)
+			WHERE throttle_key = ?
+		`, delay, key)
+		if err != nil {
+			log.Printf("login throttle: failed to block %s: %v", key, err)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("login throttle: failed to record %s: %v", key, err)
+	}
+}
+
+// clearLoginFailures forgets the failures of a key after a successful login.
+func (h *Handler) clearLoginFailures(key string) {
+	if _, err := h.DB.Exec("DELETE FROM login_throttles WHERE throttle_key = ?", key); err != nil {
+		log.Printf("login throttle: failed to clear %s: %v", key, err)
+	}
+}
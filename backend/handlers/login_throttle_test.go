@@ -0,0 +1,207 @@
+package handlers
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestLoginThrottleDelay(t *testing.T) {
+	policy := LoginThrottle{
+		FreeAttempts:     2,
+		BaseDelay:        time.Second,
+		MaxDelay:         10 * time.Second,
+		LockoutThreshold: 8,
+		LockoutDuration:  time.Hour,
+	}
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{1, 0},
+		{2, 0},
+		{3, time.Second},
+		{4, 2 * time.Second},
+		{5, 4 * time.Second},
+		{6, 8 * time.Second},
+		{7, 10 * time.Second},
+		{8, time.Hour},
+		{20, time.Hour},
+	}
+	for _, tt := range tests {
+		if got := policy.delay(tt.failures); got != tt.want {
+			t.Errorf("delay(%d) = %s, want %s", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	proxies, err := ParseTrustedProxies("10.0.0.0/8, 192.168.1.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		proxies    bool
+		remoteAddr string
+		forwarded  []string
+		want       string
+	}{
+		{"no proxies configured", false, "203.0.113.7:4000", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"untrusted peer", true, "203.0.113.7:4000", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"trusted peer without header", true, "10.1.2.3:4000", nil, "10.1.2.3"},
+		{"trusted peer", true, "10.1.2.3:4000", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"spoofed entries on the left", true, "10.1.2.3:4000", []string{"1.1.1.1, 2.2.2.2, 198.51.100.1"}, "198.51.100.1"},
+		{"chain of trusted proxies", true, "10.1.2.3:4000", []string{"1.1.1.1, 198.51.100.1, 192.168.1.1, 10.9.9.9"}, "198.51.100.1"},
+		{"repeated headers", true, "10.1.2.3:4000", []string{"1.1.1.1", "198.51.100.1"}, "198.51.100.1"},
+		{"garbage appended", true, "10.1.2.3:4000", []string{"198.51.100.1, not-an-ip"}, "10.1.2.3"},
+		{"only proxies", true, "10.1.2.3:4000", []string{"10.4.4.4"}, "10.4.4.4"},
+		{"untrusted IPv6 peer", true, "[2001:db8::1]:4000", []string{"198.51.100.1"}, "2001:db8::1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &Handler{}
+			if tt.proxies {
+				h.Config.TrustedProxies = proxies
+			}
+			r := httptest.NewRequest("POST", "/api/auth/login", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for _, v := range tt.forwarded {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			if got := h.clientIP(r); got != tt.want {
+				t.Errorf("clientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	for _, list := range []string{"", " , ", "127.0.0.1", "::1", "10.0.0.0/8,fd00::/8"} {
+		if _, err := ParseTrustedProxies(list); err != nil {
+			t.Errorf("ParseTrustedProxies(%q): %v", list, err)
+		}
+	}
+	for _, list := range []string{"localhost", "10.0.0.0/33", "1.2.3"} {
+		if _, err := ParseTrustedProxies(list); err == nil {
+			t.Errorf("ParseTrustedProxies(%q) succeeded, want an error", list)
+		}
+	}
+}
+
+// throttleState models login_throttles on a fakeDB.
+type throttleState struct {
+	failures map[string]int64
+	blocked  map[string]bool
+}
+
+func newThrottleState(f *fakeDB) *throttleState {
+	s := &throttleState{failures: map[string]int64{}, blocked: map[string]bool{}}
+	f.on("SELECT TIMESTAMPDIFF(SECOND, NOW(), blocked_until) FROM login_throttles", func(args []driver.Value) fakeResult {
+		if !s.blocked[args[0].(string)] {
+			return fakeResult{}
+		}
+		return row(int64(60))
+	})
+	f.on("INSERT INTO login_throttles", func(args []driver.Value) fakeResult {
+		s.failures[args[0].(string)]++
+		return fakeResult{affected: 1}
+	})
+	f.on("SELECT failures FROM login_throttles", func(args []driver.Value) fakeResult {
+		return row(s.failures[args[0].(string)])
+	})
+	f.on("UPDATE login_throttles SET blocked_until", func(args []driver.Value) fakeResult {
+		s.blocked[args[1].(string)] = true
+		return fakeResult{affected: 1}
+	})
+	f.on("DELETE FROM login_throttles", func(args []driver.Value) fakeResult {
+		delete(s.failures, args[0].(string))
+		delete(s.blocked, args[0].(string))
+		return fakeResult{affected: 1}
+	})
+	return s
+}
+
+func TestLoginThrottle(t *testing.T) {
+	db, f := newFakeDB(t)
+	h := NewHandler(db, Config{
+		TokenSecret:     []byte("test-secret"),
+		AccessTokenTTL:  time.Hour,
+		RefreshTokenTTL: time.Hour,
+		AccountThrottle: LoginThrottle{FreeAttempts: 2, BaseDelay: time.Minute, MaxDelay: time.Hour},
+		IPThrottle:      LoginThrottle{FreeAttempts: 10, BaseDelay: time.Minute, MaxDelay: time.Hour},
+	})
+	s := newThrottleState(f)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("Rahasia123"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.on("FROM users WHERE email = ?", func(args []driver.Value) fakeResult {
+		if args[0] != "user@example.com" {
+			return fakeResult{}
+		}
+		return row(int64(2), "user@example.com", "Test User", string(hash), "user", int64(1), true)
+	})
+	lastLogin := 0
+	f.on("UPDATE users SET last_login = NOW()", func([]driver.Value) fakeResult {
+		lastLogin++
+		return fakeResult{affected: 1}
+	})
+
+	login := func(email, password string) *httptest.ResponseRecorder {
+		body := `{"email":"` + email + `","password":"` + password + `"}`
+		req := httptest.NewRequest("POST", "/api/auth/login", strings.NewReader(body))
+		req.RemoteAddr = "192.0.2.1:1234"
+		rec := httptest.NewRecorder()
+		h.Login(rec, req)
+		return rec
+	}
+	account, ip := accountThrottleKey("user@example.com"), ipThrottleKey("192.0.2.1")
+
+	// Unknown emails count against the email and the IP like wrong passwords
+	if rec := login("nobody@example.com", "Rahasia123"); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("unknown email: status %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	for i := 1; i <= 3; i++ {
+		if rec := login("user@example.com", "salah"); rec.Code != http.StatusUnauthorized {
+			t.Fatalf("wrong password %d: status %d, want %d", i, rec.Code, http.StatusUnauthorized)
+		}
+	}
+	if s.failures[account] != 3 || !s.blocked[account] {
+		t.Fatalf("account after 3 failures: %d recorded, blocked %v", s.failures[account], s.blocked[account])
+	}
+	if s.failures[ip] != 4 || s.blocked[ip] {
+		t.Fatalf("IP after 4 failures: %d recorded, blocked %v", s.failures[ip], s.blocked[ip])
+	}
+
+	// While blocked, even the right password is refused
+	rec := login("user@example.com", "Rahasia123")
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("blocked login: status %d, Retry-After %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	if lastLogin != 0 {
+		t.Fatal("blocked login recorded as a login")
+	}
+
+	s.blocked[account] = false
+	if rec := login("user@example.com", "Rahasia123"); rec.Code != http.StatusOK {
+		t.Fatalf("login after the block: status %d: %s", rec.Code, rec.Body)
+	}
+	if _, ok := s.failures[account]; ok {
+		t.Error("account failures not cleared by a successful login")
+	}
+	if s.failures[ip] != 4 {
+		t.Error("a successful login cleared the failures of the IP")
+	}
+	if lastLogin != 1 {
+		t.Errorf("last_login updated %d times, want 1", lastLogin)
+	}
+}
@@ -0,0 +1,54 @@
+package handlers
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Mailer delivers transactional email such as password reset links.
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// WriterMailer writes each message to an io.Writer, typically os.Stdout.
+// It is intended for local development.
+type WriterMailer struct {
+	mu sync.Mutex
+	W  io.Writer
+}
+
+// Send implements Mailer.
+func (m *WriterMailer) Send(to, subject, body string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, err := fmt.Fprintf(m.W, "To: %s\nSubject: %s\nDate: %s\n\n%s\n\n", to, subject, time.Now().Format(time.RFC1123Z), body)
+	return err
+}
+
+// FileMailer stores each message as a separate .eml file inside Dir.
+type FileMailer struct {
+	Dir string
+}
+
+// Send implements Mailer.
+func (m *FileMailer) Send(to, subject, body string) error {
+	if err := os.MkdirAll(m.Dir, 0o755); err != nil {
+		return err
+	}
+
+	suffix, err := randomToken(6)
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%s.eml", time.Now().Format("20060102-150405"), suffix)
+	msg := fmt.Sprintf("To: %s\r\nSubject: %s\r\nDate: %s\r\n\r\n%s\r\n",
+		to, subject, time.Now().Format(time.RFC1123Z), strings.ReplaceAll(body, "\n", "\r\n"))
+
+	return os.WriteFile(filepath.Join(m.Dir, name), []byte(msg), 0o600)
+}
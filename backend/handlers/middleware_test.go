@@ -0,0 +1,153 @@
+package handlers
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// onAccountCheck answers the account lookup of RequireAuth on f. Every user
+// is active except those listed, and none has changed their password.
+func onAccountCheck(f *fakeDB, inactive ...int64) {
+	f.on("SELECT is_active, UNIX_TIMESTAMP(password_changed_at) FROM users WHERE id = ?", func(args []driver.Value) fakeResult {
+		for _, id := range inactive {
+			if args[0] == id {
+				return row(false, nil)
+			}
+		}
+		return row(true, nil)
+	})
+}
+
+func TestRequireAuth(t *testing.T) {
+	db, f := newFakeDB(t)
+	h := NewHandler(db, Config{TokenSecret: []byte("test-secret"), AccessTokenTTL: time.Hour})
+	onAccountCheck(f, 8)
+	token, _, err := h.issueAccessToken(7, RoleUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deactivated, _, err := h.issueAccessToken(8, RoleUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got Principal
+	handler := h.RequireAuth(func(w http.ResponseWriter, r *http.Request) {
+		got, _ = principalFromContext(r.Context())
+		respondSuccess(w, nil)
+	})
+
+	tests := []struct {
+		name   string
+		header string
+		want   int
+	}{
+		{"no header", "", http.StatusUnauthorized},
+		{"not a bearer token", "Basic " + token, http.StatusUnauthorized},
+		{"invalid token", "Bearer " + token[:len(token)-2] + "xx", http.StatusUnauthorized},
+		{"valid token", "Bearer " + token, http.StatusOK},
+		{"deactivated user", "Bearer " + deactivated, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got = Principal{}
+			req := httptest.NewRequest("GET", "/api/orders", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			rec := httptest.NewRecorder()
+			handler(rec, req)
+			if rec.Code != tt.want {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+			if tt.want == http.StatusOK && (got.UserID != 7 || got.Role != RoleUser) {
+				t.Errorf("principal %+v, want user 7 with role user", got)
+			}
+		})
+	}
+}
+
+func TestOwnerMiddleware(t *testing.T) {
+	db, f := newFakeDB(t)
+	h := NewHandler(db, Config{
+		TokenSecret:    []byte("test-secret"),
+		AccessTokenTTL: time.Hour,
+		TwoFactorRoles: map[string]bool{RoleAdmin: true},
+	})
+	onAccountCheck(f, 5)
+	users := map[int64]struct {
+		role      string
+		active    int64
+		twoFactor bool
+	}{
+		1: {RoleAdmin, 1, true},
+		3: {RoleUser, 1, false},
+		4: {RoleSupport, 1, false},
+		5: {RoleAdmin, 0, true},
+		6: {RoleAdmin, 1, false},
+	}
+	f.on("SELECT u.role, u.is_active, t.enabled_at IS NOT NULL", func(args []driver.Value) fakeResult {
+		u, ok := users[args[0].(int64)]
+		if !ok {
+			return fakeResult{}
+		}
+		return row(u.role, u.active, u.twoFactor)
+	})
+	audited := 0
+	f.on("INSERT INTO audit_logs", func(args []driver.Value) fakeResult {
+		audited++
+		return fakeResult{affected: 1}
+	})
+
+	r := mux.NewRouter()
+	sub := r.PathPrefix("/api/users/{userId}").Subrouter()
+	sub.Use(h.AuthMiddleware, h.OwnerMiddleware)
+	sub.HandleFunc("/cart", func(w http.ResponseWriter, r *http.Request) { respondSuccess(w, nil) }).Methods("GET", "PUT")
+
+	tests := []struct {
+		name        string
+		userID      int
+		role        string
+		method      string
+		path        string
+		want        int
+		wantAudited int
+	}{
+		{"owner", 2, RoleUser, "GET", "/api/users/2/cart", http.StatusOK, 0},
+		{"other user", 3, RoleUser, "GET", "/api/users/2/cart", http.StatusForbidden, 0},
+		{"admin", 1, RoleAdmin, "PUT", "/api/users/2/cart", http.StatusOK, 1},
+		{"support reads", 4, RoleSupport, "GET", "/api/users/2/cart", http.StatusOK, 1},
+		{"support modifies", 4, RoleSupport, "PUT", "/api/users/2/cart", http.StatusForbidden, 0},
+		{"role claimed in the token", 3, RoleAdmin, "GET", "/api/users/2/cart", http.StatusForbidden, 0},
+		{"inactive admin", 5, RoleAdmin, "GET", "/api/users/2/cart", http.StatusUnauthorized, 0},
+		{"admin without 2FA", 6, RoleAdmin, "GET", "/api/users/2/cart", http.StatusForbidden, 0},
+		{"anonymous", 0, "", "GET", "/api/users/2/cart", http.StatusUnauthorized, 0},
+		{"invalid user id", 2, RoleUser, "GET", "/api/users/me/cart", http.StatusBadRequest, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			audited = 0
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.userID != 0 {
+				token, _, err := h.issueAccessToken(tt.userID, tt.role)
+				if err != nil {
+					t.Fatal(err)
+				}
+				req.Header.Set("Authorization", "Bearer "+token)
+			}
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+			if audited != tt.wantAudited {
+				t.Errorf("%d audit entries, want %d", audited, tt.wantAudited)
+			}
+		})
+	}
+}
@@ -3,6 +3,7 @@ package handlers
 import (
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/gorilla/mux"
 )
@@ -17,6 +18,28 @@ type Notification struct {
 	CreatedAt string `json:"created_at"`
 }
 
+// notifyStaff sends a notification to every active user whose role grants perm.
+func notifyStaff(q execer, perm, title, body, kind string) error {
+	var roles []interface{}
+	for role := range rolePermissions {
+		if hasPermission(role, perm) {
+			roles = append(roles, role)
+		}
+	}
+	if len(roles) == 0 {
+		return nil
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(roles)), ",")
+	args := append([]interface{}{title, body, kind}, roles...)
+	_, err := q.Exec(
+		`INSERT INTO notifications (user_id, title, body, type)
+		 SELECT id, ?, ?, ? FROM users WHERE is_active = 1 AND role IN (`+placeholders+`)`,
+		args...,
+	)
+	return err
+}
+
 func (h *Handler) GetNotifications(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	userID := vars["userId"]
@@ -0,0 +1,146 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+)
+
+// Values of orders.status.
+const (
+	OrderPending    = "pending"
+	OrderProcessing = "processing"
+	OrderShipped    = "shipped"
+	OrderDelivered  = "delivered"
+	OrderCancelled  = "cancelled"
+)
+
+// orderTransitions lists the statuses each status may move to. An order can
+// only be cancelled before it ships; delivered and cancelled are final.
+var orderTransitions = map[string][]string{
+	OrderPending:    {OrderProcessing, OrderCancelled},
+	OrderProcessing: {OrderShipped, OrderCancelled},
+	OrderShipped:    {OrderDelivered},
+	OrderDelivered:  {},
+	OrderCancelled:  {},
+}
+
+// errIllegalTransition is returned by transitionOrder for a move the state machine does not allow.
+var errIllegalTransition = errors.New("illegal order status transition")
+
+// canTransition reports whether an order may move from one status to another.
+func canTransition(from, to string) bool {
+	for _, next := range orderTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Who made a status change, as reported in an order's timeline.
+const (
+	actorSystem   = "system"
+	actorCustomer = "customer"
+	actorStaff    = "staff"
+)
+
+// OrderStatusEvent is one entry of an order's status timeline. FromStatus is
+// empty for the entry recording the order's creation.
+type OrderStatusEvent struct {
+	FromStatus string `json:"from_status,omitempty"`
+	ToStatus   string `json:"to_status"`
+	ActorType  string `json:"actor_type"`
+	ActorID    *int   `json:"actor_id,omitempty"`
+	ActorName  string `json:"actor_name,omitempty"`
+	Note       string `json:"note,omitempty"`
+	CreatedAt  string `json:"created_at"`
+}
+
+// recordOrderStatus appends an entry to the order's timeline. An actorID of 0
+// means the change was made by the system; from is "" for a new order.
+func recordOrderStatus(q execer, orderID int, from, to string, actorID int, note string) error {
+	_, err := q.Exec(
+		`INSERT INTO order_status_history (order_id, from_status, to_status, actor_id, note)
+		 VALUES (?, NULLIF(?, ''), ?, NULLIF(?, 0), ?)`,
+		orderID, from, to, actorID, note,
+	)
+	return err
+}
+
+// loadOrderHistory returns the order's timeline, oldest first.
+func loadOrderHistory(q queryer, orderID int) ([]OrderStatusEvent, error) {
+	rows, err := q.Query(`
+		SELECT COALESCE(h.from_status, ''), h.to_status, h.actor_id, COALESCE(u.full_name, ''),
+			CASE
+				WHEN h.actor_id IS NULL THEN ?
+				WHEN h.actor_id = o.user_id THEN ?
+				ELSE ?
+			END,
+			COALESCE(h.note, ''), h.created_at
+		FROM order_status_history h
+		JOIN orders o ON h.order_id = o.id
+		LEFT JOIN users u ON h.actor_id = u.id
+		WHERE h.order_id = ?
+		ORDER BY h.created_at, h.id
+	`, actorSystem, actorCustomer, actorStaff, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := []OrderStatusEvent{}
+	for rows.Next() {
+		var (
+			e       OrderStatusEvent
+			actorID sql.NullInt64
+		)
+		if err := rows.Scan(&e.FromStatus, &e.ToStatus, &actorID, &e.ActorName, &e.ActorType, &e.Note, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		if actorID.Valid {
+			id := int(actorID.Int64)
+			e.ActorID = &id
+		}
+		history = append(history, e)
+	}
+	return history, rows.Err()
+}
+
+// customerOrderHistory hides which staff member made each change.
+func customerOrderHistory(history []OrderStatusEvent) []OrderStatusEvent {
+	for i := range history {
+		if history[i].ActorType == actorStaff {
+			history[i].ActorID = nil
+			history[i].ActorName = ""
+		}
+	}
+	return history
+}
+
+// transitionOrder moves an order to a new status inside tx and records the
+// change in its timeline. It locks the order row, rejects moves the state
+// machine does not allow with errIllegalTransition, ends any stock hold and
+// puts the stock back when the order is cancelled. It returns the previous
+// status, or sql.ErrNoRows if the order does not exist.
+func transitionOrder(tx *sql.Tx, orderID int, to string, actorID int, note string) (string, error) {
+	var from string
+	if err := tx.QueryRow("SELECT status FROM orders WHERE id = ? FOR UPDATE", orderID).Scan(&from); err != nil {
+		return "", err
+	}
+	if !canTransition(from, to) {
+		return from, errIllegalTransition
+	}
+
+	if to == OrderCancelled {
+		if err := restockOrder(tx, orderID); err != nil {
+			return from, err
+		}
+	}
+
+	if _, err := tx.Exec(
+		"UPDATE orders SET status = ?, hold_expires_at = NULL WHERE id = ?", to, orderID,
+	); err != nil {
+		return from, err
+	}
+	return from, recordOrderStatus(tx, orderID, from, to, actorID, note)
+}
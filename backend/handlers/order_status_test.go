@@ -0,0 +1,116 @@
+package handlers
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestCanTransition(t *testing.T) {
+	statuses := []string{OrderPending, OrderProcessing, OrderShipped, OrderDelivered, OrderCancelled}
+	allowed := map[[2]string]bool{
+		{OrderPending, OrderProcessing}:   true,
+		{OrderPending, OrderCancelled}:    true,
+		{OrderProcessing, OrderShipped}:   true,
+		{OrderProcessing, OrderCancelled}: true,
+		{OrderShipped, OrderDelivered}:    true,
+	}
+
+	for _, from := range statuses {
+		for _, to := range append(statuses, "refunded", "") {
+			want := allowed[[2]string{from, to}]
+			if got := canTransition(from, to); got != want {
+				t.Errorf("canTransition(%q, %q) = %v, want %v", from, to, got, want)
+			}
+		}
+	}
+	if canTransition("unknown", OrderCancelled) {
+		t.Error("an unknown status may be cancelled")
+	}
+}
+
+// staffCancel cancels order 1 through UpdateOrderStatus as a user with role.
+func staffCancel(h *Handler, role string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("PUT", "/api/admin/orders/1/status", strings.NewReader(`{"status":"cancelled","note":"Stok rusak"}`))
+	req = mux.SetURLVars(req, map[string]string{"id": "1"})
+	req = req.WithContext(withPrincipal(req.Context(), Principal{UserID: 1, Role: role}))
+	rec := httptest.NewRecorder()
+	h.UpdateOrderStatus(rec, req)
+	return rec
+}
+
+// onStaffCancel answers the statements of a cancellation on f from s and
+// counts the notifications sent to the order's customer.
+func (s *refundState) onStaffCancel(f *fakeDB) *int {
+	notified := 0
+	f.on("UPDATE orders SET status = ?, hold_expires_at = NULL", func(args []driver.Value) fakeResult {
+		s.orderStatus = args[0].(string)
+		return fakeResult{affected: 1}
+	})
+	f.on("SELECT COUNT(*) > 0 FROM payments WHERE order_id = ? AND status = 'paid'", func([]driver.Value) fakeResult {
+		return row(s.paid && s.paymentStatus == PaymentPaid)
+	})
+	f.on("FROM orders WHERE id = ? AND user_id IS NOT NULL", func([]driver.Value) fakeResult {
+		notified++
+		return fakeResult{affected: 1}
+	})
+	return &notified
+}
+
+func TestStaffCancelRefundsPaidOrder(t *testing.T) {
+	db, f := newFakeDB(t)
+	gateway := &stubGateway{}
+	h := NewHandler(db, Config{PaymentGateway: gateway})
+	s := newRefundState(f, OrderProcessing)
+	notified := s.onStaffCancel(f)
+	s.addLine(11, 101, 2, 100)
+	s.paid, s.paymentAmount = true, 200
+
+	rec := staffCancel(h, RoleAdmin)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	if !strings.Contains(rec.Body.String(), `"refund_status":"completed"`) {
+		t.Errorf("response %s, want a completed refund", rec.Body)
+	}
+	if s.orderStatus != OrderCancelled || len(s.refunds) != 1 || s.paymentRefunded != 200 {
+		t.Errorf("order %s, %d refunds, payment refunded %.2f", s.orderStatus, len(s.refunds), s.paymentRefunded)
+	}
+	if s.refunds[0].restocked {
+		t.Error("refund restocks units the cancellation already restocked")
+	}
+	if *notified != 1 {
+		t.Errorf("customer notified %d times, want 1", *notified)
+	}
+}
+
+func TestStaffCancelPaidOrderNeedsRefundPermission(t *testing.T) {
+	db, f := newFakeDB(t)
+	gateway := &stubGateway{}
+	h := NewHandler(db, Config{PaymentGateway: gateway})
+	s := newRefundState(f, OrderProcessing)
+	s.onStaffCancel(f)
+	s.addLine(11, 101, 2, 100)
+	s.paid, s.paymentAmount = true, 200
+
+	if hasPermission(RoleFulfillment, PermOrdersRefund) || !hasPermission(RoleFulfillment, PermOrdersUpdateStatus) {
+		t.Fatal("test assumes fulfillment may update order status but not refund")
+	}
+	if rec := staffCancel(h, RoleFulfillment); rec.Code != http.StatusForbidden {
+		t.Fatalf("status %d, want %d: %s", rec.Code, http.StatusForbidden, rec.Body)
+	}
+	if len(gateway.keys) != 0 {
+		t.Errorf("gateway called with %v", gateway.keys)
+	}
+
+	// An unpaid order needs no refund, so order staff may cancel it
+	s.orderStatus, s.paid = OrderPending, false
+	rec := staffCancel(h, RoleFulfillment)
+	if rec.Code != http.StatusOK || strings.Contains(rec.Body.String(), "refund_status") {
+		t.Fatalf("unpaid order: status %d: %s", rec.Code, rec.Body)
+	}
+}
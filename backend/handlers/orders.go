@@ -1,21 +1,27 @@
 package handlers
 
 import (
+	"database/sql"
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/gorilla/mux"
 )
 
 type Order struct {
-	ID            int         `json:"id"`
-	CustomerName  string      `json:"customer_name"`
-	CustomerEmail string      `json:"customer_email"`
-	CustomerPhone string      `json:"customer_phone"`
-	TotalAmount   float64     `json:"total_amount"`
-	Status        string      `json:"status"`
-	CreatedAt     string      `json:"created_at"`
-	Items         []OrderItem `json:"items,omitempty"`
+	ID              int                `json:"id"`
+	CustomerName    string             `json:"customer_name"`
+	CustomerEmail   string             `json:"customer_email"`
+	CustomerPhone   string             `json:"customer_phone"`
+	ShippingAddress *ShippingAddress   `json:"shipping_address,omitempty"`
+	TotalAmount     float64            `json:"total_amount"`
+	Status          string             `json:"status"`
+	CreatedAt       string             `json:"created_at"`
+	Items           []OrderItem        `json:"items,omitempty"`
+	History         []OrderStatusEvent `json:"history,omitempty"`
 }
 
 type OrderItem struct {
@@ -31,6 +37,10 @@ type CreateOrderRequest struct {
 	CustomerEmail string      `json:"customer_email"`
 	CustomerPhone string      `json:"customer_phone"`
 	Items         []OrderItem `json:"items"`
+	// AddressID selects one of the user's saved addresses; otherwise
+	// ShippingAddress is required.
+	AddressID       int              `json:"address_id"`
+	ShippingAddress *ShippingAddress `json:"shipping_address"`
 }
 
 func (h *Handler) CreateOrder(w http.ResponseWriter, r *http.Request) {
@@ -45,17 +55,23 @@ func (h *Handler) CreateOrder(w http.ResponseWriter, r *http.Request) {
 		respondError(w, http.StatusBadRequest, "Missing required fields")
 		return
 	}
-
-	// Calculate total amount
-	var totalAmount float64
+	if len(req.CustomerPhone) > maxPhoneLength {
+		respondError(w, http.StatusBadRequest, fmt.Sprintf("Nomor telepon maksimal %d karakter", maxPhoneLength))
+		return
+	}
+	// Lines are capped like cart lines, also once lines for the same product
+	// are combined, so the sums lockOrderItems works with cannot overflow
+	perProduct := make(map[int]int, len(req.Items))
 	for _, item := range req.Items {
-		var price float64
-		err := h.DB.QueryRow("SELECT price FROM products WHERE id = ?", item.ProductID).Scan(&price)
-		if err != nil {
-			respondError(w, http.StatusBadRequest, "Invalid product ID")
+		if item.ProductID <= 0 || item.Quantity <= 0 {
+			respondError(w, http.StatusBadRequest, "Invalid product ID or quantity")
+			return
+		}
+		if item.Quantity > maxCartQuantity || perProduct[item.ProductID] > maxCartQuantity-item.Quantity {
+			respondError(w, http.StatusBadRequest, fmt.Sprintf("Jumlah maksimal %d per produk", maxCartQuantity))
 			return
 		}
-		totalAmount += price * float64(item.Quantity)
+		perProduct[item.ProductID] += item.Quantity
 	}
 
 	// Begin transaction
@@ -66,10 +82,35 @@ func (h *Handler) CreateOrder(w http.ResponseWriter, r *http.Request) {
 	}
 	defer tx.Rollback()
 
-	// Insert order
+	principal, _ := principalFromContext(r.Context())
+	shipping, fieldErrs, err := resolveShippingAddress(tx, principal.UserID, req.AddressID, req.ShippingAddress, false)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to read address")
+		return
+	}
+	if len(fieldErrs) > 0 {
+		respondValidationError(w, fieldErrs)
+		return
+	}
+
+	// Lock and price the products; stock cannot change until commit
+	items, shortages, err := lockOrderItems(tx, req.Items)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to check stock")
+		return
+	}
+	if len(shortages) > 0 {
+		respondStockShortage(w, shortages)
+		return
+	}
+	totalAmount := orderTotal(items)
+
+	// Insert order, owned by the signed-in user so they can pay for and track it
 	result, err := tx.Exec(
-		"INSERT INTO orders (customer_name, customer_email, customer_phone, total_amount, status) VALUES (?, ?, ?, ?, ?)",
-		req.CustomerName, req.CustomerEmail, req.CustomerPhone, totalAmount, "pending",
+		`INSERT INTO orders (user_id, customer_name, customer_email, customer_phone, shipping_address, total_amount, status, hold_expires_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, NOW() + INTERVAL ? SECOND)`,
+		principal.UserID, req.CustomerName, req.CustomerEmail, req.CustomerPhone, encodeShippingAddress(shipping),
+		totalAmount, "pending", h.holdExpiry(),
 	)
 	if err != nil {
 		respondError(w, http.StatusInternalServerError, "Failed to create order")
@@ -78,33 +119,15 @@ func (h *Handler) CreateOrder(w http.ResponseWriter, r *http.Request) {
 
 	orderID, _ := result.LastInsertId()
 
-	// Insert order items
-	for _, item := range req.Items {
-		var price float64
-		err := tx.QueryRow("SELECT price FROM products WHERE id = ?", item.ProductID).Scan(&price)
-		if err != nil {
-			respondError(w, http.StatusBadRequest, "Invalid product ID")
-			return
-		}
-
-		_, err = tx.Exec(
-			"INSERT INTO order_items (order_id, product_id, quantity, price) VALUES (?, ?, ?, ?)",
-			orderID, item.ProductID, item.Quantity, price,
-		)
-		if err != nil {
-			respondError(w, http.StatusInternalServerError, "Failed to create order item")
-			return
-		}
+	if err := recordOrderStatus(tx, int(orderID), "", OrderPending, principal.UserID, ""); err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to create order")
+		return
+	}
 
-		// Update product stock
-		_, err = tx.Exec(
-			"UPDATE products SET stock = stock - ? WHERE id = ?",
-			item.Quantity, item.ProductID,
-		)
-		if err != nil {
-			respondError(w, http.StatusInternalServerError, "Failed to update stock")
-			return
-		}
+	// Insert order items
+	if err := insertOrderItems(tx, int(orderID), items); err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to create order item")
+		return
 	}
 
 	// Commit transaction
@@ -114,12 +137,14 @@ func (h *Handler) CreateOrder(w http.ResponseWriter, r *http.Request) {
 	}
 
 	order := Order{
-		ID:            int(orderID),
-		CustomerName:  req.CustomerName,
-		CustomerEmail: req.CustomerEmail,
-		CustomerPhone: req.CustomerPhone,
-		TotalAmount:   totalAmount,
-		Status:        "pending",
+		ID:              int(orderID),
+		CustomerName:    req.CustomerName,
+		CustomerEmail:   req.CustomerEmail,
+		CustomerPhone:   req.CustomerPhone,
+		ShippingAddress: shipping,
+		TotalAmount:     totalAmount,
+		Status:          "pending",
+		Items:           items,
 	}
 
 	respondJSON(w, http.StatusCreated, Response{
@@ -129,20 +154,57 @@ func (h *Handler) CreateOrder(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// insertOrderItems stores the lines of a new order and takes their quantities
+// out of stock. The decrement is conditional, so it fails with
+// errInsufficientStock rather than driving stock negative; callers are
+// expected to have locked the rows with lockOrderItems first.
+func insertOrderItems(q execer, orderID int, items []OrderItem) error {
+	for i := range items {
+		items[i].OrderID = orderID
+		item := items[i]
+
+		if _, err := q.Exec(
+			"INSERT INTO order_items (order_id, product_id, quantity, price) VALUES (?, ?, ?, ?)",
+			item.OrderID, item.ProductID, item.Quantity, item.Price,
+		); err != nil {
+			return err
+		}
+
+		result, err := q.Exec(
+			"UPDATE products SET stock = stock - ? WHERE id = ? AND stock >= ?",
+			item.Quantity, item.ProductID, item.Quantity,
+		)
+		if err != nil {
+			return err
+		}
+		if affected, _ := result.RowsAffected(); affected == 0 {
+			return errInsufficientStock
+		}
+	}
+	return nil
+}
+
+// GetOrderByID returns one of the authenticated user's orders with its items and timeline.
 func (h *Handler) GetOrderByID(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
+	principal, _ := principalFromContext(r.Context())
 
-	var order Order
+	// Other customers' orders are reported as missing rather than forbidden
+	var (
+		order    Order
+		shipping sql.NullString
+	)
 	err := h.DB.QueryRow(
-		"SELECT id, customer_name, customer_email, customer_phone, total_amount, status, created_at FROM orders WHERE id = ?",
-		id,
-	).Scan(&order.ID, &order.CustomerName, &order.CustomerEmail, &order.CustomerPhone, &order.TotalAmount, &order.Status, &order.CreatedAt)
+		"SELECT id, customer_name, customer_email, customer_phone, shipping_address, total_amount, status, created_at FROM orders WHERE id = ? AND user_id = ?",
+		id, principal.UserID,
+	).Scan(&order.ID, &order.CustomerName, &order.CustomerEmail, &order.CustomerPhone, &shipping, &order.TotalAmount, &order.Status, &order.CreatedAt)
 
 	if err != nil {
 		respondError(w, http.StatusNotFound, "Order not found")
 		return
 	}
+	order.ShippingAddress = decodeShippingAddress(shipping)
 
 	// Get order items
 	rows, err := h.DB.Query(
@@ -166,30 +228,66 @@ func (h *Handler) GetOrderByID(w http.ResponseWriter, r *http.Request) {
 	}
 	order.Items = items
 
+	history, err := loadOrderHistory(h.DB, order.ID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to fetch order history")
+		return
+	}
+	order.History = customerOrderHistory(history)
+
 	respondSuccess(w, order)
 }
 
+// GetOrders returns the authenticated user's orders.
 func (h *Handler) GetOrders(w http.ResponseWriter, r *http.Request) {
-	status := r.URL.Query().Get("status")
+	principal, _ := principalFromContext(r.Context())
+	h.listUserOrders(w, r, principal.UserID)
+}
+
+// GetUserOrders returns the orders of {userId}, newest first.
+func (h *Handler) GetUserOrders(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(mux.Vars(r)["userId"])
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+	h.listUserOrders(w, r, userID)
+}
 
-	query := "SELECT id, customer_name, customer_email, customer_phone, total_amount, status, created_at FROM orders"
-	var args []interface{}
+// listUserOrders writes a page of a user's orders, optionally filtered by ?status=.
+func (h *Handler) listUserOrders(w http.ResponseWriter, r *http.Request, userID int) {
+	page, limit, offset := parsePagination(r)
 
-	if status != "" {
-		query += " WHERE status = ?"
+	where := " WHERE user_id = ?"
+	args := []interface{}{userID}
+
+	if status := r.URL.Query().Get("status"); status != "" {
+		if _, ok := orderTransitions[status]; !ok {
+			respondError(w, http.StatusBadRequest, "Invalid status")
+			return
+		}
+		where += " AND status = ?"
 		args = append(args, status)
 	}
 
-	query += " ORDER BY created_at DESC"
+	var total int
+	if err := h.DB.QueryRow("SELECT COUNT(*) FROM orders"+where, args...).Scan(&total); err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to count orders")
+		return
+	}
 
-	rows, err := h.DB.Query(query, args...)
+	rows, err := h.DB.Query(
+		"SELECT id, customer_name, customer_email, customer_phone, total_amount, status, created_at FROM orders"+
+			where+" ORDER BY created_at DESC, id DESC LIMIT ? OFFSET ?",
+		append(args, limit, offset)...,
+	)
 	if err != nil {
 		respondError(w, http.StatusInternalServerError, "Failed to fetch orders")
 		return
 	}
 	defer rows.Close()
 
-	var orders []Order
+	orders := []Order{}
 	for rows.Next() {
 		var order Order
 		if err := rows.Scan(&order.ID, &order.CustomerName, &order.CustomerEmail, &order.CustomerPhone, &order.TotalAmount, &order.Status, &order.CreatedAt); err != nil {
@@ -199,7 +297,142 @@ func (h *Handler) GetOrders(w http.ResponseWriter, r *http.Request) {
 		orders = append(orders, order)
 	}
 
-	respondSuccess(w, orders)
+	respondSuccess(w, map[string]interface{}{
+		"orders": orders,
+		"page":   page,
+		"limit":  limit,
+		"total":  total,
+	})
+}
+
+// CancelOrder lets the customer who placed an order cancel it while it is
+// still pending or processing. Stock is restored, a paid order is refunded in
+// full and order staff are notified. The refund is committed as pending with
+// the cancellation and only then sent to the gateway, so a failure after the
+// money has gone out cannot leave the order open to a second refund.
+func (h *Handler) CancelOrder(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid order ID")
+		return
+	}
+
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	req.Reason = strings.TrimSpace(req.Reason)
+	if req.Reason == "" {
+		respondValidationError(w, map[string]string{"reason": "Alasan pembatalan wajib diisi"})
+		return
+	}
+
+	principal, _ := principalFromContext(r.Context())
+
+	tx, err := h.DB.Begin()
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	// Other customers' orders are reported as missing rather than forbidden
+	var ownerID sql.NullInt64
+	err = tx.QueryRow("SELECT user_id FROM orders WHERE id = ? FOR UPDATE", id).Scan(&ownerID)
+	if err != nil || !ownerID.Valid || int(ownerID.Int64) != principal.UserID {
+		respondError(w, http.StatusNotFound, "Order not found")
+		return
+	}
+
+	from, err := transitionOrder(tx, id, OrderCancelled, principal.UserID, req.Reason)
+	if err == errIllegalTransition {
+		respondError(w, http.StatusConflict, fmt.Sprintf("Order can no longer be cancelled (status: %s)", from))
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to cancel order")
+		return
+	}
+
+	// A processing order has normally been paid; the money goes back in full.
+	// Cancelling has already restocked the items, so the refund does not.
+	refundID, amount, err := h.refundCancelledOrder(tx, id, "Cancelled by customer: "+req.Reason, principal.UserID)
+	if err != nil {
+		respondRefundError(w, err)
+		return
+	}
+
+	body := "Reason: " + req.Reason
+	if refundID != 0 {
+		body += fmt.Sprintf("\nRefund %d of %.2f to the customer's payment has been issued.", refundID, amount)
+	}
+	if err := notifyStaff(tx, PermOrdersUpdateStatus,
+		fmt.Sprintf("Order #%d cancelled by customer", id),
+		body,
+		"order",
+	); err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to cancel order")
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to cancel order")
+		return
+	}
+
+	// A declined refund is reported to staff by completeRefund; one the
+	// gateway could not be reached for is retried by the hold sweeper
+	data := map[string]interface{}{
+		"id":       id,
+		"status":   OrderCancelled,
+		"refunded": 0.0,
+	}
+	if refundID != 0 {
+		refundStatus := h.completeRefund(refundID)
+		if refundStatus == RefundCompleted {
+			data["refunded"] = amount
+		}
+		data["refund_status"] = refundStatus
+	}
+	respondSuccess(w, data)
+}
+
+// refundCancelledOrder records a pending refund of whatever is left
+// unrefunded of a cancelled order that has a paid payment, without
+// restocking, and returns its id and amount. The caller sends it to the
+// gateway with completeRefund once tx is committed. Orders that were never
+// paid are left alone and get an id of 0.
+func (h *Handler) refundCancelledOrder(tx *sql.Tx, orderID int, reason string, actorID int) (int, float64, error) {
+	var paid bool
+	if err := tx.QueryRow(
+		"SELECT COUNT(*) > 0 FROM payments WHERE order_id = ? AND status = 'paid'", orderID,
+	).Scan(&paid); err != nil || !paid {
+		return 0, 0, err
+	}
+
+	lines, ids, err := lockOrderLines(tx, orderID)
+	if err != nil {
+		return 0, 0, err
+	}
+	requested := map[int]int{}
+	for _, lineID := range ids {
+		if remaining := lines[lineID].quantity - lines[lineID].refunded; remaining > 0 {
+			requested[lineID] = remaining
+		}
+	}
+	if len(requested) == 0 {
+		return 0, 0, nil
+	}
+
+	items, amount := refundItems(lines, ids, requested)
+	refundID, err := h.issueRefund(tx, orderID, items, amount, reason, false, actorID)
+	if err != nil {
+		return 0, 0, err
+	}
+	return refundID, amount, nil
 }
 
 // Note: UpdateOrderStatus has been moved to admin_orders.go
@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCreateOrderQuantityLimit(t *testing.T) {
+	db, f := newFakeDB(t)
+	h := NewHandler(db, Config{})
+
+	locked := 0
+	f.on("FROM products WHERE id IN", func([]driver.Value) fakeResult {
+		locked++
+		return row(int64(1), "Kaos", 10000.0, int64(5000), int64(1))
+	})
+	f.on("UPDATE products SET stock = stock - ?", func([]driver.Value) fakeResult {
+		return fakeResult{affected: 1}
+	})
+
+	tests := []struct {
+		name       string
+		quantities []int
+		want       int
+	}{
+		{"one line over the maximum", []int{maxCartQuantity + 1}, http.StatusBadRequest},
+		{"lines for one product over the maximum", []int{maxCartQuantity, 1}, http.StatusBadRequest},
+		{"lines overflowing int", []int{math.MaxInt, math.MaxInt}, http.StatusBadRequest},
+		{"lines up to the maximum", []int{maxCartQuantity - 1, 1}, http.StatusCreated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := CreateOrderRequest{
+				CustomerName:  "Budi",
+				CustomerEmail: "budi@example.com",
+				ShippingAddress: &ShippingAddress{
+					RecipientName: "Budi",
+					Phone:         "08123",
+					Street:        "Jl. Merdeka 1",
+					City:          "Jakarta",
+				},
+			}
+			for _, qty := range tt.quantities {
+				req.Items = append(req.Items, OrderItem{ProductID: 1, Quantity: qty})
+			}
+			body, _ := json.Marshal(req)
+
+			before := locked
+			rec := httptest.NewRecorder()
+			h.CreateOrder(rec, httptest.NewRequest("POST", "/api/orders", strings.NewReader(string(body))))
+			if rec.Code != tt.want {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+			if rejected := locked == before; rejected != (tt.want == http.StatusBadRequest) {
+				t.Errorf("products locked: %v", !rejected)
+			}
+		})
+	}
+}
@@ -0,0 +1,208 @@
+package handlers
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// sentMail is one message delivered through a recordingMailer.
+type sentMail struct {
+	to, subject, body string
+}
+
+// recordingMailer keeps every message sent through it.
+type recordingMailer struct {
+	mu   sync.Mutex
+	sent []sentMail
+}
+
+func (m *recordingMailer) Send(to, subject, body string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = append(m.sent, sentMail{to, subject, body})
+	return nil
+}
+
+// testReset is a password_resets row on a fakeDB.
+type testReset struct {
+	id      int
+	userID  int
+	used    bool
+	expired bool
+}
+
+// resetState models password_resets and the password of user 2, registered
+// as user@example.com, on a fakeDB.
+type resetState struct {
+	resets       map[string]*testReset // by token hash
+	passwordHash string
+	revoked      int
+}
+
+func newResetState(f *fakeDB) *resetState {
+	s := &resetState{resets: map[string]*testReset{}}
+
+	f.on("SELECT id FROM users WHERE email = ?", func(args []driver.Value) fakeResult {
+		if args[0] != "user@example.com" {
+			return fakeResult{}
+		}
+		return row(int64(2))
+	})
+	f.on("UPDATE password_resets SET used_at = NOW() WHERE user_id = ?", func(args []driver.Value) fakeResult {
+		for _, pr := range s.resets {
+			if pr.userID == int(args[0].(int64)) {
+				pr.used = true
+			}
+		}
+		return fakeResult{affected: 1}
+	})
+	f.on("INSERT INTO password_resets", func(args []driver.Value) fakeResult {
+		s.resets[args[1].(string)] = &testReset{id: len(s.resets) + 1, userID: int(args[0].(int64))}
+		return fakeResult{affected: 1}
+	})
+	f.on("FROM password_resets", func(args []driver.Value) fakeResult {
+		pr, ok := s.resets[args[0].(string)]
+		if !ok || pr.used || pr.expired {
+			return fakeResult{}
+		}
+		return row(int64(pr.id), int64(pr.userID), "user@example.com")
+	})
+	f.on("UPDATE password_resets SET used_at = NOW() WHERE id = ?", func(args []driver.Value) fakeResult {
+		for _, pr := range s.resets {
+			if pr.id == int(args[0].(int64)) {
+				pr.used = true
+			}
+		}
+		return fakeResult{affected: 1}
+	})
+	f.on("UPDATE users SET password_hash = ?", func(args []driver.Value) fakeResult {
+		s.passwordHash = args[0].(string)
+		return fakeResult{affected: 1}
+	})
+	f.on("UPDATE refresh_tokens SET revoked_at = NOW() WHERE user_id = ?", func([]driver.Value) fakeResult {
+		s.revoked++
+		return fakeResult{affected: 1}
+	})
+	return s
+}
+
+var resetTokenPattern = regexp.MustCompile(`Token reset: (\S+)`)
+
+// resetToken returns the token in the last reset email sent through m.
+func resetToken(t *testing.T, m *recordingMailer) string {
+	t.Helper()
+	if len(m.sent) == 0 {
+		t.Fatal("no reset email sent")
+	}
+	match := resetTokenPattern.FindStringSubmatch(m.sent[len(m.sent)-1].body)
+	if match == nil {
+		t.Fatalf("no token in %q", m.sent[len(m.sent)-1].body)
+	}
+	return match[1]
+}
+
+func newResetHandler(t *testing.T) (*Handler, *resetState, *recordingMailer) {
+	t.Helper()
+	db, f := newFakeDB(t)
+	mailer := &recordingMailer{}
+	h := NewHandler(db, Config{
+		PasswordResetTTL: time.Hour,
+		Mailer:           mailer,
+		PasswordPolicy:   PasswordPolicy{MinLength: 10},
+	})
+	return h, newResetState(f), mailer
+}
+
+func postJSON(handler http.HandlerFunc, path string, v interface{}) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(v)
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("POST", path, strings.NewReader(string(body))))
+	return rec
+}
+
+func TestRequestPasswordReset(t *testing.T) {
+	h, s, mailer := newResetHandler(t)
+	request := func(email string) *httptest.ResponseRecorder {
+		return postJSON(h.RequestPasswordReset, "/api/auth/password-reset/request", map[string]string{"email": email})
+	}
+
+	unknown := request("nobody@example.com")
+	if unknown.Code != http.StatusOK || len(mailer.sent) != 0 {
+		t.Fatalf("unknown email: status %d, %d mails sent", unknown.Code, len(mailer.sent))
+	}
+
+	known := request("user@example.com")
+	if known.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", known.Code, known.Body)
+	}
+	if known.Body.String() != unknown.Body.String() {
+		t.Errorf("response for a registered email %s differs from %s", known.Body, unknown.Body)
+	}
+	if len(mailer.sent) != 1 || mailer.sent[0].to != "user@example.com" {
+		t.Fatalf("mails sent %+v, want one to user@example.com", mailer.sent)
+	}
+	first := resetToken(t, mailer)
+	if pr, ok := s.resets[hashToken(first)]; !ok || pr.userID != 2 {
+		t.Fatalf("reset stored %+v, want one for user 2 under the token hash", pr)
+	}
+
+	// A new request leaves only the newest token usable
+	request("user@example.com")
+	if second := resetToken(t, mailer); second == first || s.resets[hashToken(second)].used {
+		t.Error("second request did not issue a new usable token")
+	}
+	if !s.resets[hashToken(first)].used {
+		t.Error("older reset token still usable after a new request")
+	}
+}
+
+func TestConfirmPasswordReset(t *testing.T) {
+	h, s, mailer := newResetHandler(t)
+	confirm := func(token, password string) *httptest.ResponseRecorder {
+		return postJSON(h.ConfirmPasswordReset, "/api/auth/password-reset/confirm",
+			map[string]string{"token": token, "new_password": password})
+	}
+	postJSON(h.RequestPasswordReset, "/api/auth/password-reset/request", map[string]string{"email": "user@example.com"})
+	token := resetToken(t, mailer)
+
+	if rec := confirm("unknown", "NewPassword123"); rec.Code != http.StatusBadRequest {
+		t.Errorf("unknown token: status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+
+	// A password the policy rejects leaves the token usable
+	if rec := confirm(token, "pendek"); rec.Code != http.StatusBadRequest || s.passwordHash != "" {
+		t.Errorf("weak password: status %d, password changed %v", rec.Code, s.passwordHash != "")
+	}
+
+	if rec := confirm(token, "NewPassword123"); rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	if bcrypt.CompareHashAndPassword([]byte(s.passwordHash), []byte("NewPassword123")) != nil {
+		t.Error("password not changed to the new one")
+	}
+	if s.revoked != 1 {
+		t.Errorf("sessions revoked %d times, want 1", s.revoked)
+	}
+
+	// Tokens are single-use
+	s.passwordHash = ""
+	if rec := confirm(token, "OtherPassword123"); rec.Code != http.StatusBadRequest || s.passwordHash != "" {
+		t.Errorf("reused token: status %d, password changed %v", rec.Code, s.passwordHash != "")
+	}
+
+	postJSON(h.RequestPasswordReset, "/api/auth/password-reset/request", map[string]string{"email": "user@example.com"})
+	expired := resetToken(t, mailer)
+	s.resets[hashToken(expired)].expired = true
+	if rec := confirm(expired, "OtherPassword123"); rec.Code != http.StatusBadRequest || s.passwordHash != "" {
+		t.Errorf("expired token: status %d, password changed %v", rec.Code, s.passwordHash != "")
+	}
+}
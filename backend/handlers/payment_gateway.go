@@ -0,0 +1,181 @@
+package handlers
+
+import (
+	"errors"
+	"sync"
+)
+
+// Statuses of a charge, shared by payments.status.
+const (
+	PaymentPending  = "pending"
+	PaymentPaid     = "paid"
+	PaymentFailed   = "failed"
+	PaymentExpired  = "expired"
+	PaymentRefunded = "refunded"
+)
+
+// Payment methods offered at checkout.
+const (
+	MethodBankTransfer = "bank_transfer"
+	MethodEWallet      = "ewallet"
+	MethodCard         = "card"
+	MethodQRIS         = "qris"
+)
+
+var paymentMethods = map[string]bool{
+	MethodBankTransfer: true,
+	MethodEWallet:      true,
+	MethodCard:         true,
+	MethodQRIS:         true,
+}
+
+// ChargeRequest asks a gateway to collect money for an order.
+type ChargeRequest struct {
+	OrderID       int
+	Amount        float64
+	Method        string
+	CustomerEmail string
+	// IdempotencyKey identifies the payment the charge is for.
+	IdempotencyKey string
+}
+
+// Charge is a gateway's view of a payment.
+type Charge struct {
+	ProviderRef    string
+	Status         string
+	Amount         float64
+	RefundedAmount float64
+	// Instructions tell the customer how to pay, e.g. a transfer account or a redirect URL.
+	Instructions string
+}
+
+// RefundResult is a gateway's record of a refund.
+type RefundResult struct {
+	ProviderRef string
+	Amount      float64
+}
+
+// PaymentGateway is implemented by each payment provider.
+type PaymentGateway interface {
+	// Name identifies the provider in payments.provider.
+	Name() string
+	// CreateCharge must create at most one charge per IdempotencyKey and
+	// return that charge for later calls with the same key, so a charge whose
+	// outcome was lost can be asked for again without charging twice.
+	CreateCharge(req ChargeRequest) (Charge, error)
+	// ChargeStatus returns errChargeNotFound when the gateway has no record of
+	// the charge, which is treated as expired; any other error may be temporary.
+	ChargeStatus(providerRef string) (Charge, error)
+	// Refund returns amount of a charge. Calls with the same idempotencyKey
+	// must refund at most once and return the first call's result, so a
+	// refund whose outcome was lost can be retried safely. errChargeNotFound
+	// and errRefundTooLarge mean the refund was declined for good; any other
+	// error may be temporary.
+	Refund(providerRef string, amount float64, idempotencyKey string) (RefundResult, error)
+}
+
+var (
+	errChargeNotFound = errors.New("charge not found")
+	errRefundTooLarge = errors.New("refund exceeds the amount paid")
+)
+
+// refundDeclined reports whether a gateway Refund error is final rather than
+// a failure worth retrying.
+func refundDeclined(err error) bool {
+	return errors.Is(err, errChargeNotFound) || errors.Is(err, errRefundTooLarge)
+}
+
+// chargeGone reports whether a ChargeStatus error means the charge can never
+// be paid, so its payment should be treated as expired.
+func chargeGone(err error) bool {
+	return errors.Is(err, errChargeNotFound)
+}
+
+// FakeGateway is an in-memory PaymentGateway for local development. Charges
+// stay pending until a payment webhook reports otherwise, unless AutoPay marks
+// them paid as soon as they are created.
+type FakeGateway struct {
+	AutoPay bool
+
+	mu      sync.Mutex
+	charges map[string]*Charge
+	keys    map[string]string // charge idempotency key to provider ref
+	refunds map[string]RefundResult
+}
+
+func (g *FakeGateway) Name() string { return "fake" }
+
+func (g *FakeGateway) CreateCharge(req ChargeRequest) (Charge, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if ref, ok := g.keys[req.IdempotencyKey]; ok {
+		return *g.charges[ref], nil
+	}
+
+	ref, err := randomToken(12)
+	if err != nil {
+		return Charge{}, err
+	}
+
+	c := &Charge{
+		ProviderRef:  "fake_ch_" + ref,
+		Status:       PaymentPending,
+		Amount:       req.Amount,
+		Instructions: "Fake " + req.Method + " payment; no money is moved",
+	}
+	if g.AutoPay {
+		c.Status = PaymentPaid
+	}
+
+	if g.charges == nil {
+		g.charges = make(map[string]*Charge)
+	}
+	g.charges[c.ProviderRef] = c
+	if req.IdempotencyKey != "" {
+		if g.keys == nil {
+			g.keys = make(map[string]string)
+		}
+		g.keys[req.IdempotencyKey] = c.ProviderRef
+	}
+	return *c, nil
+}
+
+func (g *FakeGateway) ChargeStatus(providerRef string) (Charge, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	c, ok := g.charges[providerRef]
+	if !ok {
+		return Charge{}, errChargeNotFound
+	}
+	return *c, nil
+}
+
+func (g *FakeGateway) Refund(providerRef string, amount float64, idempotencyKey string) (RefundResult, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if result, ok := g.refunds[idempotencyKey]; ok {
+		return result, nil
+	}
+	c, ok := g.charges[providerRef]
+	if !ok {
+		return RefundResult{}, errChargeNotFound
+	}
+	if amount <= 0 || c.RefundedAmount+amount > c.Amount+0.005 {
+		return RefundResult{}, errRefundTooLarge
+	}
+
+	ref, err := randomToken(12)
+	if err != nil {
+		return RefundResult{}, err
+	}
+	c.RefundedAmount += amount
+	if c.RefundedAmount >= c.Amount-0.005 {
+		c.Status = PaymentRefunded
+	}
+	result := RefundResult{ProviderRef: "fake_rf_" + ref, Amount: amount}
+	if g.refunds == nil {
+		g.refunds = make(map[string]RefundResult)
+	}
+	g.refunds[idempotencyKey] = result
+	return result, nil
+}
@@ -0,0 +1,163 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Headers carrying the webhook signature and the time it was made.
+const (
+	WebhookSignatureHeader = "X-Webhook-Signature"
+	WebhookTimestampHeader = "X-Webhook-Timestamp"
+)
+
+// paymentEvent is the body of a payment webhook.
+type paymentEvent struct {
+	EventID     string `json:"event_id"`
+	ProviderRef string `json:"provider_ref"`
+	Status      string `json:"status"`
+}
+
+// SignPaymentWebhook returns the hex HMAC-SHA256 of "<timestamp>.<body>", the
+// value expected in the X-Webhook-Signature header.
+func SignPaymentWebhook(secret []byte, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+var (
+	errWebhookTimestamp = errors.New("missing or invalid webhook timestamp")
+	errWebhookStale     = errors.New("webhook timestamp outside tolerance")
+	errWebhookSignature = errors.New("invalid webhook signature")
+)
+
+// verifyPaymentWebhook checks the timestamp and signature headers of a webhook
+// received at now. The timestamp may be off by up to tolerance either way.
+func verifyPaymentWebhook(secret []byte, tolerance time.Duration, now time.Time, timestamp, signature string, body []byte) error {
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errWebhookTimestamp
+	}
+	age := now.Sub(time.Unix(ts, 0))
+	if age > tolerance || age < -tolerance {
+		return errWebhookStale
+	}
+
+	expected := SignPaymentWebhook(secret, ts, body)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return errWebhookSignature
+	}
+	return nil
+}
+
+// PaymentWebhook receives charge status updates from the payment gateway. The
+// request must be signed with Config.PaymentWebhookSecret and be no older than
+// Config.PaymentWebhookTolerance; each provider event id is processed once.
+func (h *Handler) PaymentWebhook(w http.ResponseWriter, r *http.Request) {
+	if len(h.Config.PaymentWebhookSecret) == 0 {
+		respondError(w, http.StatusServiceUnavailable, "Payment webhook is not configured")
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	err = verifyPaymentWebhook(
+		h.Config.PaymentWebhookSecret, h.Config.PaymentWebhookTolerance, time.Now(),
+		r.Header.Get(WebhookTimestampHeader), r.Header.Get(WebhookSignatureHeader), body,
+	)
+	switch err {
+	case nil:
+	case errWebhookTimestamp:
+		respondError(w, http.StatusUnauthorized, "Missing or invalid webhook timestamp")
+		return
+	case errWebhookStale:
+		respondError(w, http.StatusUnauthorized, "Webhook timestamp outside tolerance")
+		return
+	default:
+		respondError(w, http.StatusUnauthorized, "Invalid webhook signature")
+		return
+	}
+
+	var event paymentEvent
+	if err := json.Unmarshal(body, &event); err != nil || event.EventID == "" || event.ProviderRef == "" {
+		respondError(w, http.StatusBadRequest, "Invalid webhook payload")
+		return
+	}
+	switch event.Status {
+	case PaymentPending, PaymentPaid, PaymentFailed, PaymentExpired:
+	default:
+		respondError(w, http.StatusBadRequest, "Unsupported payment status")
+		return
+	}
+
+	provider := h.Config.PaymentGateway.Name()
+
+	tx, err := h.DB.Begin()
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(
+		"INSERT INTO payment_webhook_events (provider, event_id, payload) VALUES (?, ?, ?)",
+		provider, event.EventID, string(body),
+	)
+	if isDuplicateKey(err) {
+		respondSuccess(w, map[string]interface{}{"event_id": event.EventID, "duplicate": true})
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to record webhook event")
+		return
+	}
+
+	var paymentID int
+	err = tx.QueryRow(
+		"SELECT id FROM payments WHERE provider = ? AND provider_ref = ?", provider, event.ProviderRef,
+	).Scan(&paymentID)
+	if err == sql.ErrNoRows {
+		respondError(w, http.StatusNotFound, "Payment not found")
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to find payment")
+		return
+	}
+
+	refundID, err := h.applyPaymentStatus(tx, paymentID, event.Status)
+	if err != nil {
+		log.Printf("payment webhook: event %s for payment %d failed: %v", event.EventID, paymentID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to update payment")
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to update payment")
+		return
+	}
+
+	// A payment for an order cancelled in the meantime is refunded straight
+	// away; a refund the gateway cannot take yet is retried by the hold sweeper
+	if refundID != 0 {
+		h.completeRefund(refundID)
+	}
+
+	respondSuccess(w, map[string]interface{}{"event_id": event.EventID, "payment_id": paymentID})
+}
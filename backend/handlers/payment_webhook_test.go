@@ -0,0 +1,226 @@
+package handlers
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+func TestVerifyPaymentWebhook(t *testing.T) {
+	secret := []byte("webhook-secret")
+	body := []byte(`{"event_id":"evt_1","provider_ref":"ch_1","status":"paid"}`)
+	now := time.Unix(1700000000, 0)
+	tolerance := 5 * time.Minute
+	at := func(offset time.Duration) int64 { return now.Add(offset).Unix() }
+	ts := func(offset time.Duration) string { return strconv.FormatInt(at(offset), 10) }
+
+	tests := []struct {
+		name      string
+		timestamp string
+		signature string
+		body      []byte
+		want      error
+	}{
+		{"valid", ts(0), SignPaymentWebhook(secret, at(0), body), body, nil},
+		{"oldest allowed", ts(-tolerance), SignPaymentWebhook(secret, at(-tolerance), body), body, nil},
+		{"newest allowed", ts(tolerance), SignPaymentWebhook(secret, at(tolerance), body), body, nil},
+		{"too old", ts(-tolerance - time.Second), SignPaymentWebhook(secret, at(-tolerance-time.Second), body), body, errWebhookStale},
+		{"too far ahead", ts(tolerance + time.Second), SignPaymentWebhook(secret, at(tolerance+time.Second), body), body, errWebhookStale},
+		{"missing timestamp", "", SignPaymentWebhook(secret, at(0), body), body, errWebhookTimestamp},
+		{"non-numeric timestamp", "yesterday", SignPaymentWebhook(secret, at(0), body), body, errWebhookTimestamp},
+		{"missing signature", ts(0), "", body, errWebhookSignature},
+		{"wrong secret", ts(0), SignPaymentWebhook([]byte("other-secret"), at(0), body), body, errWebhookSignature},
+		{"signed for another timestamp", ts(0), SignPaymentWebhook(secret, at(-time.Second), body), body, errWebhookSignature},
+		{"tampered body", ts(0), SignPaymentWebhook(secret, at(0), body), []byte(strings.Replace(string(body), "paid", "failed", 1)), errWebhookSignature},
+		{"uppercase hex", ts(0), strings.ToUpper(SignPaymentWebhook(secret, at(0), body)), body, errWebhookSignature},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := verifyPaymentWebhook(secret, tolerance, now, tt.timestamp, tt.signature, tt.body)
+			if got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPaymentWebhookAuthentication(t *testing.T) {
+	db, _ := newFakeDB(t)
+	secret := []byte("webhook-secret")
+	h := NewHandler(db, Config{
+		PaymentGateway:          &FakeGateway{},
+		PaymentWebhookSecret:    secret,
+		PaymentWebhookTolerance: 5 * time.Minute,
+	})
+	body := `{"event_id":"evt_1","provider_ref":"ch_1","status":"paid"}`
+	now := time.Now().Unix()
+	stale := now - 10*60
+
+	tests := []struct {
+		name      string
+		timestamp string
+		signature string
+		want      int
+	}{
+		{"missing timestamp", "", SignPaymentWebhook(secret, now, []byte(body)), http.StatusUnauthorized},
+		{"stale timestamp", strconv.FormatInt(stale, 10), SignPaymentWebhook(secret, stale, []byte(body)), http.StatusUnauthorized},
+		{"wrong secret", strconv.FormatInt(now, 10), SignPaymentWebhook([]byte("other-secret"), now, []byte(body)), http.StatusUnauthorized},
+		{"unknown payment", strconv.FormatInt(now, 10), SignPaymentWebhook(secret, now, []byte(body)), http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/api/payments/webhook", strings.NewReader(body))
+			req.Header.Set(WebhookTimestampHeader, tt.timestamp)
+			req.Header.Set(WebhookSignatureHeader, tt.signature)
+			rec := httptest.NewRecorder()
+			h.PaymentWebhook(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("status %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+		})
+	}
+
+	// Without a secret nothing can be verified
+	h.Config.PaymentWebhookSecret = nil
+	rec := httptest.NewRecorder()
+	h.PaymentWebhook(rec, httptest.NewRequest("POST", "/api/payments/webhook", strings.NewReader(body)))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("unconfigured webhook: status %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestPaymentWebhookDeduplicatesEvents(t *testing.T) {
+	db, f := newFakeDB(t)
+	secret := []byte("webhook-secret")
+	h := NewHandler(db, Config{
+		PaymentGateway:          &FakeGateway{},
+		PaymentWebhookSecret:    secret,
+		PaymentWebhookTolerance: 5 * time.Minute,
+	})
+
+	events := map[string]bool{}
+	updates := 0
+	f.on("INSERT INTO payment_webhook_events", func(args []driver.Value) fakeResult {
+		key := args[0].(string) + "/" + args[1].(string)
+		if events[key] {
+			return fakeResult{err: &mysql.MySQLError{Number: 1062, Message: "Duplicate entry"}}
+		}
+		events[key] = true
+		return fakeResult{affected: 1}
+	})
+	f.on("SELECT id FROM payments WHERE provider = ? AND provider_ref = ?", func([]driver.Value) fakeResult {
+		return row(int64(7))
+	})
+	f.on("SELECT order_id FROM payments", func([]driver.Value) fakeResult {
+		return row(int64(3))
+	})
+	f.on("SELECT status FROM orders", func([]driver.Value) fakeResult {
+		return row(OrderPending)
+	})
+	f.on("SELECT status FROM payments", func([]driver.Value) fakeResult {
+		return row(PaymentPending)
+	})
+	f.on("UPDATE payments SET status", func([]driver.Value) fakeResult {
+		updates++
+		return fakeResult{affected: 1}
+	})
+
+	send := func(eventID string) *httptest.ResponseRecorder {
+		body := `{"event_id":"` + eventID + `","provider_ref":"ch_1","status":"failed"}`
+		now := time.Now().Unix()
+		req := httptest.NewRequest("POST", "/api/payments/webhook", strings.NewReader(body))
+		req.Header.Set(WebhookTimestampHeader, strconv.FormatInt(now, 10))
+		req.Header.Set(WebhookSignatureHeader, SignPaymentWebhook(secret, now, []byte(body)))
+		rec := httptest.NewRecorder()
+		h.PaymentWebhook(rec, req)
+		return rec
+	}
+
+	if rec := send("evt_1"); rec.Code != http.StatusOK || strings.Contains(rec.Body.String(), `"duplicate"`) {
+		t.Fatalf("first delivery: status %d: %s", rec.Code, rec.Body)
+	}
+	if rec := send("evt_1"); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"duplicate":true`) {
+		t.Fatalf("redelivery: status %d: %s", rec.Code, rec.Body)
+	}
+	if updates != 1 {
+		t.Fatalf("payment updated %d times after one event delivered twice, want 1", updates)
+	}
+
+	if rec := send("evt_2"); rec.Code != http.StatusOK || strings.Contains(rec.Body.String(), `"duplicate"`) {
+		t.Fatalf("new event: status %d: %s", rec.Code, rec.Body)
+	}
+	if updates != 2 {
+		t.Errorf("payment updated %d times after a second event, want 2", updates)
+	}
+}
+
+// TestPaymentWebhookRefundsCancelledOrder checks that a charge reported paid
+// after its order was cancelled, e.g. once ORDER_HOLD_MAX_AGE ran out, is
+// refunded in full without moving the order on.
+func TestPaymentWebhookRefundsCancelledOrder(t *testing.T) {
+	db, f := newFakeDB(t)
+	secret := []byte("webhook-secret")
+	gateway := &stubGateway{}
+	h := NewHandler(db, Config{
+		PaymentGateway:          gateway,
+		PaymentWebhookSecret:    secret,
+		PaymentWebhookTolerance: 5 * time.Minute,
+	})
+	s := newRefundState(f, OrderCancelled)
+	s.addLine(11, 101, 2, 25000)
+	s.paid, s.paymentAmount, s.paymentStatus = true, 50000, PaymentPending
+
+	f.on("INSERT INTO payment_webhook_events", func([]driver.Value) fakeResult {
+		return fakeResult{affected: 1}
+	})
+	f.on("SELECT id FROM payments WHERE provider = ? AND provider_ref = ?", func([]driver.Value) fakeResult {
+		return row(int64(5))
+	})
+	f.on("SELECT order_id FROM payments WHERE id = ?", func([]driver.Value) fakeResult {
+		return row(int64(1))
+	})
+	f.on("SELECT status FROM payments WHERE id = ? FOR UPDATE", func([]driver.Value) fakeResult {
+		return row(s.paymentStatus)
+	})
+	f.on("UPDATE payments SET status = ?", func(args []driver.Value) fakeResult {
+		s.paymentStatus = args[0].(string)
+		return fakeResult{affected: 1}
+	})
+	f.on("SELECT COUNT(*) > 0 FROM payments WHERE order_id = ? AND status = 'paid'", func([]driver.Value) fakeResult {
+		return row(s.paymentStatus == PaymentPaid)
+	})
+	f.on("UPDATE orders SET status", func([]driver.Value) fakeResult {
+		t.Error("cancelled order moved on by a late payment")
+		return fakeResult{affected: 1}
+	})
+
+	body := `{"event_id":"evt_1","provider_ref":"ch_1","status":"paid"}`
+	now := time.Now().Unix()
+	req := httptest.NewRequest("POST", "/api/payments/webhook", strings.NewReader(body))
+	req.Header.Set(WebhookTimestampHeader, strconv.FormatInt(now, 10))
+	req.Header.Set(WebhookSignatureHeader, SignPaymentWebhook(secret, now, []byte(body)))
+	rec := httptest.NewRecorder()
+	h.PaymentWebhook(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+
+	if len(s.refunds) != 1 || s.refunds[0].amount != 50000 || s.refunds[0].status != RefundCompleted {
+		t.Fatalf("refunds %+v, want one completed refund of 50000", s.refunds)
+	}
+	if s.refunds[0].restocked || len(s.stock) != 0 {
+		t.Errorf("late payment refund restocked %v; the cancellation already did", s.stock)
+	}
+	if len(gateway.keys) != 1 || gateway.keys[0] != "refund-1" {
+		t.Errorf("gateway refund keys %v, want [refund-1]", gateway.keys)
+	}
+	if s.paymentStatus != PaymentRefunded || s.staff != 1 {
+		t.Errorf("payment %q and %d staff notifications, want %q and 1", s.paymentStatus, s.staff, PaymentRefunded)
+	}
+}
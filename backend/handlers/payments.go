@@ -0,0 +1,402 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// Payment is an attempt to pay for an order through a PaymentGateway.
+type Payment struct {
+	ID             int     `json:"id"`
+	OrderID        int     `json:"order_id"`
+	Provider       string  `json:"provider"`
+	Method         string  `json:"method"`
+	ProviderRef    string  `json:"provider_ref"`
+	Amount         float64 `json:"amount"`
+	RefundedAmount float64 `json:"refunded_amount"`
+	Status         string  `json:"status"`
+	Instructions   string  `json:"instructions,omitempty"`
+	PaidAt         *string `json:"paid_at,omitempty"`
+	CreatedAt      string  `json:"created_at"`
+	UpdatedAt      string  `json:"updated_at"`
+}
+
+const paymentColumns = `id, order_id, provider, method, COALESCE(provider_ref, ''), amount, refunded_amount, status,
+	COALESCE(instructions, ''), paid_at, created_at, updated_at`
+
+func scanPayment(row interface{ Scan(...interface{}) error }) (Payment, error) {
+	var (
+		p      Payment
+		paidAt sql.NullString
+	)
+	err := row.Scan(&p.ID, &p.OrderID, &p.Provider, &p.Method, &p.ProviderRef, &p.Amount, &p.RefundedAmount,
+		&p.Status, &p.Instructions, &paidAt, &p.CreatedAt, &p.UpdatedAt)
+	if paidAt.Valid {
+		p.PaidAt = &paidAt.String
+	}
+	return p, err
+}
+
+// loadPayments returns the payments of an order, newest first.
+func loadPayments(q queryer, orderID int) ([]Payment, error) {
+	rows, err := q.Query("SELECT "+paymentColumns+" FROM payments WHERE order_id = ? ORDER BY created_at DESC, id DESC", orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	payments := []Payment{}
+	for rows.Next() {
+		p, err := scanPayment(rows)
+		if err != nil {
+			return nil, err
+		}
+		payments = append(payments, p)
+	}
+	return payments, rows.Err()
+}
+
+// applyPaymentStatus records a new status reported by the gateway. Only
+// pending payments change; a payment that becomes paid moves its order from
+// pending to processing. If the order was cancelled in the meantime, e.g. by
+// the hold sweeper, the payment is refunded and the returned refund id must
+// be passed to completeRefund once tx is committed. Order staff are notified
+// of a payment for an order in any other status, or one that cannot be
+// refunded, so the money can be refunded by hand.
+func (h *Handler) applyPaymentStatus(tx *sql.Tx, paymentID int, status string) (int, error) {
+	var orderID int
+	if err := tx.QueryRow("SELECT order_id FROM payments WHERE id = ?", paymentID).Scan(&orderID); err != nil {
+		return 0, err
+	}
+
+	// Lock the order before the payment, in the same order as CreatePayment
+	var orderStatus string
+	if err := tx.QueryRow("SELECT status FROM orders WHERE id = ? FOR UPDATE", orderID).Scan(&orderStatus); err != nil {
+		return 0, err
+	}
+
+	var current string
+	if err := tx.QueryRow("SELECT status FROM payments WHERE id = ? FOR UPDATE", paymentID).Scan(&current); err != nil {
+		return 0, err
+	}
+	if current != PaymentPending || status == PaymentPending {
+		return 0, nil
+	}
+
+	if _, err := tx.Exec(
+		"UPDATE payments SET status = ?, paid_at = IF(? = 'paid', NOW(), paid_at) WHERE id = ?",
+		status, status, paymentID,
+	); err != nil {
+		return 0, err
+	}
+	if status != PaymentPaid {
+		return 0, nil
+	}
+
+	_, err := transitionOrder(tx, orderID, OrderProcessing, 0, "Payment received")
+	if err != errIllegalTransition {
+		return 0, err
+	}
+	log.Printf("payments: payment %d paid for order %d in status %s", paymentID, orderID, orderStatus)
+
+	if orderStatus == OrderCancelled {
+		refundID, amount, err := h.refundCancelledOrder(tx, orderID,
+			fmt.Sprintf("Payment %d received after the order was cancelled", paymentID), 0)
+		switch {
+		case err == nil && refundID != 0:
+			return refundID, notifyStaff(tx, PermOrdersUpdateStatus,
+				fmt.Sprintf("Payment received for cancelled order #%d", orderID),
+				fmt.Sprintf("Payment %d was paid after the order was cancelled; refund %d of %.2f has been issued.", paymentID, refundID, amount),
+				"payment",
+			)
+		case err != nil && err != errRefundNotPaid && err != errRefundExceedsPayment && err != errRefundGatewayMissing:
+			return 0, err
+		}
+		log.Printf("payments: payment %d for cancelled order %d cannot be refunded: %v", paymentID, orderID, err)
+	}
+
+	return 0, notifyStaff(tx, PermOrdersUpdateStatus,
+		fmt.Sprintf("Payment received for %s order #%d", orderStatus, orderID),
+		fmt.Sprintf("Payment %d was paid after the order left pending and should be refunded.", paymentID),
+		"payment",
+	)
+}
+
+// errChargeNotCreated wraps a gateway error from CreateCharge; the payment
+// stays pending without a charge until it is asked for again.
+var errChargeNotCreated = errors.New("payment gateway did not create the charge")
+
+// chargePayment asks the gateway for the charge of a pending payment that has
+// none recorded yet and records it. The payment is committed before the
+// gateway is called and its id is the idempotency key, so a charge whose
+// outcome was lost is returned again rather than created twice.
+func (h *Handler) chargePayment(p Payment) error {
+	var email string
+	if err := h.DB.QueryRow("SELECT customer_email FROM orders WHERE id = ?", p.OrderID).Scan(&email); err != nil {
+		return err
+	}
+
+	charge, err := h.Config.PaymentGateway.CreateCharge(ChargeRequest{
+		OrderID:        p.OrderID,
+		Amount:         p.Amount,
+		Method:         p.Method,
+		CustomerEmail:  email,
+		IdempotencyKey: fmt.Sprintf("payment-%d", p.ID),
+	})
+	if err != nil {
+		return fmt.Errorf("%w: %v", errChargeNotCreated, err)
+	}
+
+	tx, err := h.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Lock the order before the payment, in the same order as CreatePayment
+	var orderStatus string
+	if err := tx.QueryRow("SELECT status FROM orders WHERE id = ? FOR UPDATE", p.OrderID).Scan(&orderStatus); err != nil {
+		return err
+	}
+	result, err := tx.Exec(
+		"UPDATE payments SET provider_ref = ?, instructions = ? WHERE id = ? AND provider_ref IS NULL",
+		charge.ProviderRef, charge.Instructions, p.ID,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		// Recorded in the meantime by another call
+		return nil
+	}
+	refundID, err := h.applyPaymentStatus(tx, p.ID, charge.Status)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if refundID != 0 {
+		h.completeRefund(refundID)
+	}
+	return nil
+}
+
+// refreshPayment asks the gateway for the current status of a pending payment
+// and records any change. A payment without a charge asks for it again. A
+// charge the gateway no longer knows is recorded as expired; other gateway
+// errors are logged and leave the payment as is.
+func (h *Handler) refreshPayment(p Payment) error {
+	if p.Status != PaymentPending || p.Provider != h.Config.PaymentGateway.Name() {
+		return nil
+	}
+	if p.ProviderRef == "" {
+		err := h.chargePayment(p)
+		if errors.Is(err, errChargeNotCreated) {
+			log.Printf("payments: create charge for payment %d failed: %v", p.ID, err)
+			return nil
+		}
+		return err
+	}
+
+	charge, err := h.Config.PaymentGateway.ChargeStatus(p.ProviderRef)
+	if chargeGone(err) {
+		log.Printf("payments: gateway has no charge for payment %d, marking it expired: %v", p.ID, err)
+		charge = Charge{Status: PaymentExpired}
+	} else if err != nil {
+		log.Printf("payments: status check for payment %d failed: %v", p.ID, err)
+		return nil
+	}
+	if charge.Status == p.Status {
+		return nil
+	}
+
+	tx, err := h.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	refundID, err := h.applyPaymentStatus(tx, p.ID, charge.Status)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if refundID != 0 {
+		h.completeRefund(refundID)
+	}
+	return nil
+}
+
+// CreatePayment starts paying for one of the authenticated user's pending
+// orders with the configured gateway. The payment is committed as pending
+// before the charge is created; if the gateway fails it stays pending without
+// a charge, and the next call resumes it with the method it was started with.
+func (h *Handler) CreatePayment(w http.ResponseWriter, r *http.Request) {
+	orderID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid order ID")
+		return
+	}
+
+	var req struct {
+		Method string `json:"method"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if !paymentMethods[req.Method] {
+		respondValidationError(w, map[string]string{"method": "Metode pembayaran tidak dikenal"})
+		return
+	}
+
+	principal, _ := principalFromContext(r.Context())
+
+	tx, err := h.DB.Begin()
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	// The order is locked so two payments cannot start at once
+	var (
+		ownerID sql.NullInt64
+		status  string
+		total   float64
+	)
+	err = tx.QueryRow(
+		"SELECT user_id, status, total_amount FROM orders WHERE id = ? FOR UPDATE", orderID,
+	).Scan(&ownerID, &status, &total)
+	if err != nil || !ownerID.Valid || int(ownerID.Int64) != principal.UserID {
+		respondError(w, http.StatusNotFound, "Order not found")
+		return
+	}
+	if status != OrderPending {
+		respondError(w, http.StatusConflict, "Order is not awaiting payment")
+		return
+	}
+
+	gateway := h.Config.PaymentGateway
+	payment, err := scanPayment(tx.QueryRow(
+		"SELECT "+paymentColumns+" FROM payments WHERE order_id = ? AND status IN ('pending', 'paid') LIMIT 1", orderID,
+	))
+	switch {
+	case err == sql.ErrNoRows:
+		result, err := tx.Exec(
+			"INSERT INTO payments (order_id, provider, method, amount, status) VALUES (?, ?, ?, ?, ?)",
+			orderID, gateway.Name(), req.Method, total, PaymentPending,
+		)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, "Failed to create payment")
+			return
+		}
+		id, _ := result.LastInsertId()
+		payment = Payment{ID: int(id), OrderID: orderID, Provider: gateway.Name(), Method: req.Method, Amount: total}
+	case err != nil:
+		respondError(w, http.StatusInternalServerError, "Failed to check payments")
+		return
+	case payment.Status != PaymentPending || payment.ProviderRef != "" || payment.Provider != gateway.Name():
+		respondJSON(w, http.StatusConflict, Response{
+			Success: false,
+			Error:   "Order already has an active payment",
+			Data:    payment,
+		})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to create payment")
+		return
+	}
+
+	if err := h.chargePayment(payment); err != nil {
+		log.Printf("payments: create charge for payment %d failed: %v", payment.ID, err)
+		if errors.Is(err, errChargeNotCreated) {
+			respondError(w, http.StatusBadGateway, "Payment gateway error")
+		} else {
+			respondError(w, http.StatusInternalServerError, "Failed to create payment")
+		}
+		return
+	}
+
+	payment, err = scanPayment(h.DB.QueryRow("SELECT "+paymentColumns+" FROM payments WHERE id = ?", payment.ID))
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to fetch payment")
+		return
+	}
+
+	respondJSON(w, http.StatusCreated, Response{
+		Success: true,
+		Message: "Payment created",
+		Data:    payment,
+	})
+}
+
+// GetOrderPayments lists the payments of one of the authenticated user's orders.
+func (h *Handler) GetOrderPayments(w http.ResponseWriter, r *http.Request) {
+	orderID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid order ID")
+		return
+	}
+	principal, _ := principalFromContext(r.Context())
+
+	var exists bool
+	h.DB.QueryRow(
+		"SELECT EXISTS(SELECT 1 FROM orders WHERE id = ? AND user_id = ?)", orderID, principal.UserID,
+	).Scan(&exists)
+	if !exists {
+		respondError(w, http.StatusNotFound, "Order not found")
+		return
+	}
+
+	payments, err := loadPayments(h.DB, orderID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to fetch payments")
+		return
+	}
+	respondSuccess(w, payments)
+}
+
+// GetPayment returns one of the authenticated user's payments, first checking
+// with the gateway whether a pending payment has completed.
+func (h *Handler) GetPayment(w http.ResponseWriter, r *http.Request) {
+	paymentID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid payment ID")
+		return
+	}
+	principal, _ := principalFromContext(r.Context())
+
+	query := "SELECT " + paymentColumns + ` FROM payments
+		WHERE id = ? AND order_id IN (SELECT id FROM orders WHERE user_id = ?)`
+
+	payment, err := scanPayment(h.DB.QueryRow(query, paymentID, principal.UserID))
+	if err != nil {
+		respondError(w, http.StatusNotFound, "Payment not found")
+		return
+	}
+
+	if err := h.refreshPayment(payment); err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to update payment")
+		return
+	}
+
+	payment, err = scanPayment(h.DB.QueryRow(query, paymentID, principal.UserID))
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to fetch payment")
+		return
+	}
+	respondSuccess(w, payment)
+}
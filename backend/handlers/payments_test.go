@@ -0,0 +1,275 @@
+package handlers
+
+import (
+	"database/sql/driver"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// paymentRow is a payments row as selected with paymentColumns.
+func paymentRow(id, orderID int, providerRef, status string, amount float64) []driver.Value {
+	return []driver.Value{
+		int64(id), int64(orderID), "fake", MethodBankTransfer, providerRef, amount, 0.0, status,
+		"", nil, "2026-01-01 00:00:00", "2026-01-01 00:00:00",
+	}
+}
+
+// failingGateway is a FakeGateway that cannot create charges.
+type failingGateway struct{ FakeGateway }
+
+func (g *failingGateway) CreateCharge(ChargeRequest) (Charge, error) {
+	return Charge{}, errors.New("gateway unavailable")
+}
+
+// paymentState models order 9 of user 2 and its payments on a fakeDB.
+type paymentState struct {
+	orderOwner  driver.Value
+	orderStatus string
+	payments    []*testPayment
+}
+
+type testPayment struct {
+	id                  int
+	providerRef, status string
+}
+
+func (s *paymentState) payment(id int64) *testPayment {
+	for _, p := range s.payments {
+		if int64(p.id) == id {
+			return p
+		}
+	}
+	return nil
+}
+
+func newPaymentState(f *fakeDB) *paymentState {
+	s := &paymentState{orderOwner: int64(2), orderStatus: OrderPending}
+	f.on("SELECT user_id, status, total_amount FROM orders WHERE id = ? FOR UPDATE", func([]driver.Value) fakeResult {
+		return row(s.orderOwner, s.orderStatus, 50000.0)
+	})
+	f.on("SELECT customer_email FROM orders WHERE id = ?", func([]driver.Value) fakeResult {
+		return row("budi@example.com")
+	})
+	f.on("FROM payments WHERE order_id = ? AND status IN ('pending', 'paid')", func([]driver.Value) fakeResult {
+		for _, p := range s.payments {
+			if p.status == PaymentPending || p.status == PaymentPaid {
+				return row(paymentRow(p.id, 9, p.providerRef, p.status, 50000)...)
+			}
+		}
+		return fakeResult{}
+	})
+	f.on("INSERT INTO payments", func(args []driver.Value) fakeResult {
+		p := &testPayment{id: len(s.payments) + 1, status: args[4].(string)}
+		s.payments = append(s.payments, p)
+		return fakeResult{affected: 1, lastID: int64(p.id)}
+	})
+	f.on("UPDATE payments SET provider_ref = ?", func(args []driver.Value) fakeResult {
+		p := s.payment(args[2].(int64))
+		if p.providerRef != "" {
+			return fakeResult{}
+		}
+		p.providerRef = args[0].(string)
+		return fakeResult{affected: 1}
+	})
+	f.on("SELECT order_id FROM payments WHERE id = ?", func([]driver.Value) fakeResult {
+		return row(int64(9))
+	})
+	f.on("SELECT status FROM orders WHERE id = ? FOR UPDATE", func([]driver.Value) fakeResult {
+		return row(s.orderStatus)
+	})
+	f.on("SELECT status FROM payments WHERE id = ? FOR UPDATE", func(args []driver.Value) fakeResult {
+		return row(s.payment(args[0].(int64)).status)
+	})
+	f.on("UPDATE payments SET status = ?", func(args []driver.Value) fakeResult {
+		s.payment(args[2].(int64)).status = args[0].(string)
+		return fakeResult{affected: 1}
+	})
+	f.on("UPDATE orders SET status = ?", func(args []driver.Value) fakeResult {
+		s.orderStatus = args[0].(string)
+		return fakeResult{affected: 1}
+	})
+	f.on("FROM payments WHERE id = ?", func(args []driver.Value) fakeResult {
+		p := s.payment(args[0].(int64))
+		if p == nil || (len(args) > 1 && args[1] != s.orderOwner) {
+			return fakeResult{}
+		}
+		return row(paymentRow(p.id, 9, p.providerRef, p.status, 50000)...)
+	})
+	return s
+}
+
+// createPayment pays for order 9 through CreatePayment as user 2.
+func createPayment(h *Handler, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/api/orders/9/payments", strings.NewReader(body))
+	req = mux.SetURLVars(req, map[string]string{"id": "9"})
+	req = req.WithContext(withPrincipal(req.Context(), Principal{UserID: 2, Role: RoleUser}))
+	rec := httptest.NewRecorder()
+	h.CreatePayment(rec, req)
+	return rec
+}
+
+func TestCreatePayment(t *testing.T) {
+	for _, autoPay := range []bool{false, true} {
+		db, f := newFakeDB(t)
+		gateway := &FakeGateway{AutoPay: autoPay}
+		h := NewHandler(db, Config{PaymentGateway: gateway})
+		s := newPaymentState(f)
+
+		rec := createPayment(h, `{"method":"bank_transfer"}`)
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("auto pay %v: status %d: %s", autoPay, rec.Code, rec.Body)
+		}
+		if len(s.payments) != 1 || !strings.HasPrefix(s.payments[0].providerRef, "fake_ch_") {
+			t.Fatalf("auto pay %v: payments %+v, want one fake charge", autoPay, s.payments)
+		}
+		if gateway.keys["payment-1"] != s.payments[0].providerRef {
+			t.Errorf("auto pay %v: charge keys %v, want payment-1 for the charge", autoPay, gateway.keys)
+		}
+
+		// A charge that is paid at once moves the order on
+		wantPayment, wantOrder := PaymentPending, OrderPending
+		if autoPay {
+			wantPayment, wantOrder = PaymentPaid, OrderProcessing
+		}
+		if s.payments[0].status != wantPayment || s.orderStatus != wantOrder {
+			t.Errorf("auto pay %v: payment %q and order %q, want %q and %q",
+				autoPay, s.payments[0].status, s.orderStatus, wantPayment, wantOrder)
+		}
+		if !strings.Contains(rec.Body.String(), `"status":"`+wantPayment+`"`) {
+			t.Errorf("auto pay %v: response %s, want the %s payment", autoPay, rec.Body, wantPayment)
+		}
+	}
+}
+
+func TestCreatePaymentRefused(t *testing.T) {
+	tests := []struct {
+		name     string
+		setup    func(s *paymentState)
+		body     string
+		want     int
+		payments int
+	}{
+		{name: "unknown method", body: `{"method":"cash"}`, want: http.StatusBadRequest},
+		{name: "another customer's order", setup: func(s *paymentState) { s.orderOwner = int64(5) }, want: http.StatusNotFound},
+		{name: "guest order", setup: func(s *paymentState) { s.orderOwner = nil }, want: http.StatusNotFound},
+		{name: "order not pending", setup: func(s *paymentState) { s.orderStatus = OrderCancelled }, want: http.StatusConflict},
+		{
+			name: "active payment",
+			setup: func(s *paymentState) {
+				s.payments = []*testPayment{{id: 1, providerRef: "fake_ch_1", status: PaymentPending}}
+			},
+			want:     http.StatusConflict,
+			payments: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, f := newFakeDB(t)
+			h := NewHandler(db, Config{PaymentGateway: &FakeGateway{}})
+			s := newPaymentState(f)
+			if tt.setup != nil {
+				tt.setup(s)
+			}
+			body := tt.body
+			if body == "" {
+				body = `{"method":"qris"}`
+			}
+
+			if rec := createPayment(h, body); rec.Code != tt.want {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+			if len(s.payments) != tt.payments {
+				t.Errorf("%d payments, want %d", len(s.payments), tt.payments)
+			}
+		})
+	}
+}
+
+// TestCreatePaymentGatewayDown checks that a payment is kept pending without a
+// charge when the gateway fails, and that retrying or reading it later asks
+// for the charge of the same payment again.
+func TestCreatePaymentGatewayDown(t *testing.T) {
+	resume := map[string]func(h *Handler) *httptest.ResponseRecorder{
+		"retry": func(h *Handler) *httptest.ResponseRecorder {
+			return createPayment(h, `{"method":"card"}`)
+		},
+		"read": func(h *Handler) *httptest.ResponseRecorder {
+			req := httptest.NewRequest("GET", "/api/payments/1", nil)
+			req = mux.SetURLVars(req, map[string]string{"id": "1"})
+			req = req.WithContext(withPrincipal(req.Context(), Principal{UserID: 2, Role: RoleUser}))
+			rec := httptest.NewRecorder()
+			h.GetPayment(rec, req)
+			return rec
+		},
+	}
+	for name, call := range resume {
+		t.Run(name, func(t *testing.T) {
+			db, f := newFakeDB(t)
+			h := NewHandler(db, Config{PaymentGateway: &failingGateway{}})
+			s := newPaymentState(f)
+
+			if rec := createPayment(h, `{"method":"qris"}`); rec.Code != http.StatusBadGateway {
+				t.Fatalf("gateway down: status %d, want %d: %s", rec.Code, http.StatusBadGateway, rec.Body)
+			}
+			if len(s.payments) != 1 || s.payments[0].status != PaymentPending || s.payments[0].providerRef != "" {
+				t.Fatalf("gateway down: payments %+v, want one pending without a charge", s.payments)
+			}
+
+			gateway := &FakeGateway{}
+			h.Config.PaymentGateway = gateway
+			if rec := call(h); rec.Code != http.StatusCreated && rec.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", rec.Code, rec.Body)
+			}
+			if len(s.payments) != 1 || gateway.keys["payment-1"] == "" || s.payments[0].providerRef != gateway.keys["payment-1"] {
+				t.Errorf("payments %+v and charge keys %v, want payment 1 charged once", s.payments, gateway.keys)
+			}
+
+			if rec := createPayment(h, `{"method":"card"}`); rec.Code != http.StatusConflict {
+				t.Errorf("charged payment: status %d, want %d", rec.Code, http.StatusConflict)
+			}
+		})
+	}
+}
+
+func TestGetPayment(t *testing.T) {
+	db, f := newFakeDB(t)
+	gateway := &FakeGateway{}
+	h := NewHandler(db, Config{PaymentGateway: gateway})
+	s := newPaymentState(f)
+
+	charge, _ := gateway.CreateCharge(ChargeRequest{OrderID: 9, Amount: 50000, Method: MethodQRIS})
+	s.payments = []*testPayment{{id: 1, providerRef: charge.ProviderRef, status: PaymentPending}}
+
+	get := func(userID int) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/payments/1", nil)
+		req = mux.SetURLVars(req, map[string]string{"id": "1"})
+		req = req.WithContext(withPrincipal(req.Context(), Principal{UserID: userID, Role: RoleUser}))
+		rec := httptest.NewRecorder()
+		h.GetPayment(rec, req)
+		return rec
+	}
+
+	if rec := get(5); rec.Code != http.StatusNotFound {
+		t.Errorf("another customer's payment: status %d, want %d", rec.Code, http.StatusNotFound)
+	}
+
+	rec := get(2)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"status":"pending"`) {
+		t.Fatalf("unpaid charge: status %d: %s", rec.Code, rec.Body)
+	}
+
+	// The customer pays at the gateway; reading the payment picks it up
+	gateway.charges[charge.ProviderRef].Status = PaymentPaid
+	rec = get(2)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"status":"paid"`) {
+		t.Fatalf("paid charge: status %d: %s", rec.Code, rec.Body)
+	}
+	if s.orderStatus != OrderProcessing {
+		t.Errorf("order status %q after payment, want %q", s.orderStatus, OrderProcessing)
+	}
+}
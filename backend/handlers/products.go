@@ -17,6 +17,18 @@ type Product struct {
 	CreatedAt   string  `json:"created_at"`
 }
 
+// ProductDetail adds stock held by unpaid pending orders to a Product. Stock
+// is what can still be ordered. Held counts only live holds: expired holds are
+// about to be released, and pending orders without an expiry are only holds
+// when ORDER_HOLD_TTL disables expiry. OnHand is Stock plus every unit of a
+// pending order, since an expired hold keeps its units until the sweeper
+// releases them.
+type ProductDetail struct {
+	Product
+	Held   int `json:"held"`
+	OnHand int `json:"on_hand"`
+}
+
 func (h *Handler) GetProducts(w http.ResponseWriter, r *http.Request) {
 	search := r.URL.Query().Get("search")
 	minPrice := r.URL.Query().Get("min_price")
@@ -67,16 +79,32 @@ func (h *Handler) GetProductByID(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
 
-	var p Product
-	err := h.DB.QueryRow(
-		"SELECT id, category_id, name, description, price, stock, image_url, created_at FROM products WHERE id = ?",
-		id,
-	).Scan(&p.ID, &p.CategoryID, &p.Name, &p.Description, &p.Price, &p.Stock, &p.ImageURL, &p.CreatedAt)
+	var (
+		p            ProductDetail
+		pendingUnits int
+	)
+	err := h.DB.QueryRow(`
+		SELECT p.id, p.category_id, p.name, p.description, p.price, p.stock, p.image_url, p.created_at,
+			COALESCE(pending.live, 0), COALESCE(pending.total, 0)
+		FROM products p
+		LEFT JOIN (
+			SELECT oi.product_id,
+				SUM(IF(o.hold_expires_at > NOW() OR (o.hold_expires_at IS NULL AND ?), oi.quantity, 0)) AS live,
+				SUM(oi.quantity) AS total
+			FROM order_items oi
+			JOIN orders o ON oi.order_id = o.id
+			WHERE oi.product_id = ? AND o.status = 'pending'
+			GROUP BY oi.product_id
+		) pending ON pending.product_id = p.id
+		WHERE p.id = ?
+	`, h.Config.OrderHoldTTL <= 0, id, id).Scan(&p.ID, &p.CategoryID, &p.Name, &p.Description, &p.Price, &p.Stock,
+		&p.ImageURL, &p.CreatedAt, &p.Held, &pendingUnits)
 
 	if err != nil {
 		respondError(w, http.StatusNotFound, "Product not found")
 		return
 	}
+	p.OnHand = p.Stock + pendingUnits
 
 	respondSuccess(w, p)
 }
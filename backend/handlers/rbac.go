@@ -0,0 +1,236 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// Roles stored in users.role.
+const (
+	RoleUser           = "user"
+	RoleSupport        = "support"
+	RoleFulfillment    = "fulfillment"
+	RoleCatalogManager = "catalog_manager"
+	RoleAdmin          = "admin"
+	RoleSuperAdmin     = "super_admin"
+)
+
+// Permissions checked by RequirePermission.
+const (
+	PermProductsRead       = "products:read"
+	PermProductsWrite      = "products:write"
+	PermProductsDelete     = "products:delete"
+	PermOrdersRead         = "orders:read"
+	PermOrdersUpdateStatus = "orders:update_status"
+	PermOrdersRefund       = "orders:refund"
+	PermDashboardView      = "dashboard:view"
+	PermUsersRead          = "users:read"
+	PermUsersManage        = "users:manage"
+	PermRolesAssign        = "roles:assign"
+)
+
+// rolePermissions is the permission matrix. Customers (RoleUser) have no staff permissions.
+var rolePermissions = map[string][]string{
+	RoleUser: {},
+	RoleSupport: {
+		PermOrdersRead,
+		PermUsersRead,
+	},
+	RoleFulfillment: {
+		PermProductsRead,
+		PermOrdersRead,
+		PermOrdersUpdateStatus,
+	},
+	RoleCatalogManager: {
+		PermProductsRead,
+		PermProductsWrite,
+		PermProductsDelete,
+		PermDashboardView,
+	},
+	RoleAdmin: {
+		PermProductsRead,
+		PermProductsWrite,
+		PermProductsDelete,
+		PermOrdersRead,
+		PermOrdersUpdateStatus,
+		PermOrdersRefund,
+		PermDashboardView,
+		PermUsersRead,
+		PermUsersManage,
+	},
+	RoleSuperAdmin: {
+		PermProductsRead,
+		PermProductsWrite,
+		PermProductsDelete,
+		PermOrdersRead,
+		PermOrdersUpdateStatus,
+		PermOrdersRefund,
+		PermDashboardView,
+		PermUsersRead,
+		PermUsersManage,
+		PermRolesAssign,
+	},
+}
+
+// hasPermission reports whether role grants perm.
+func hasPermission(role, perm string) bool {
+	for _, p := range rolePermissions[role] {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// staffRole reads the current role of the principal's account from the
+// database, so that role changes and deactivations apply immediately. It
+// refuses inactive accounts and roles in Config.TwoFactorRoles that have not
+// enrolled in 2FA, writing the response itself; ok is false when the request
+// must stop.
+func (h *Handler) staffRole(w http.ResponseWriter, principal Principal) (role string, ok bool) {
+	var (
+		isActive  int
+		twoFactor bool
+	)
+	err := h.DB.QueryRow(`
+		SELECT u.role, u.is_active, t.enabled_at IS NOT NULL
+		FROM users u
+		LEFT JOIN user_totp t ON t.user_id = u.id
+		WHERE u.id = ?
+	`, principal.UserID).Scan(&role, &isActive, &twoFactor)
+	if err != nil || isActive == 0 {
+		respondError(w, http.StatusUnauthorized, "Akun tidak aktif")
+		return "", false
+	}
+
+	if h.Config.TwoFactorRoles[role] && !twoFactor {
+		respondError(w, http.StatusForbidden, "Two-factor authentication must be enabled for this role")
+		return "", false
+	}
+	return role, true
+}
+
+// RequirePermission authenticates the request and allows it only if the user's
+// current role grants every listed permission. The role is checked by staffRole.
+func (h *Handler) RequirePermission(perms ...string) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return h.RequireAuth(func(w http.ResponseWriter, r *http.Request) {
+			principal, _ := principalFromContext(r.Context())
+
+			role, ok := h.staffRole(w, principal)
+			if !ok {
+				return
+			}
+
+			for _, perm := range perms {
+				if !hasPermission(role, perm) {
+					respondError(w, http.StatusForbidden, "Permission denied")
+					return
+				}
+			}
+
+			principal.Role = role
+			next(w, r.WithContext(withPrincipal(r.Context(), principal)))
+		})
+	}
+}
+
+// GetRoles returns the permission matrix.
+func (h *Handler) GetRoles(w http.ResponseWriter, r *http.Request) {
+	roles := make([]string, 0, len(rolePermissions))
+	for role := range rolePermissions {
+		roles = append(roles, role)
+	}
+	sort.Strings(roles)
+
+	result := make([]map[string]interface{}, 0, len(roles))
+	for _, role := range roles {
+		result = append(result, map[string]interface{}{
+			"role":        role,
+			"permissions": rolePermissions[role],
+		})
+	}
+
+	respondSuccess(w, result)
+}
+
+// AssignRole changes the role of a user.
+func (h *Handler) AssignRole(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	userID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+
+	var req struct {
+		Role string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if _, ok := rolePermissions[req.Role]; !ok {
+		respondValidationError(w, map[string]string{"role": "Role tidak dikenal"})
+		return
+	}
+
+	principal, _ := principalFromContext(r.Context())
+
+	tx, err := h.DB.Begin()
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	var (
+		current  string
+		isActive int
+	)
+	if err := tx.QueryRow(
+		"SELECT role, is_active FROM users WHERE id = ? FOR UPDATE", userID,
+	).Scan(&current, &isActive); err != nil {
+		respondError(w, http.StatusNotFound, "User not found")
+		return
+	}
+
+	// Only demoting an active super admin can leave nobody able to manage
+	// roles; an inactive one is not counted among the remaining super admins
+	if current == RoleSuperAdmin && isActive == 1 && req.Role != RoleSuperAdmin {
+		var superAdmins int
+		if err := tx.QueryRow(
+			"SELECT COUNT(*) FROM users WHERE role = ? AND is_active = 1 FOR UPDATE", RoleSuperAdmin,
+		).Scan(&superAdmins); err != nil {
+			respondError(w, http.StatusInternalServerError, "Failed to update role")
+			return
+		}
+		if superAdmins <= 1 {
+			respondError(w, http.StatusConflict, "Cannot remove the last super admin")
+			return
+		}
+	}
+
+	if _, err := tx.Exec("UPDATE users SET role = ? WHERE id = ?", req.Role, userID); err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to update role")
+		return
+	}
+
+	h.audit(tx, principal.UserID, "role_assigned", "user", userID, fmt.Sprintf("%s -> %s", current, req.Role))
+
+	if err := tx.Commit(); err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to update role")
+		return
+	}
+
+	respondSuccess(w, map[string]interface{}{
+		"id":          userID,
+		"role":        req.Role,
+		"permissions": rolePermissions[req.Role],
+	})
+}
@@ -0,0 +1,92 @@
+package handlers
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestAssignRoleKeepsLastActiveSuperAdmin(t *testing.T) {
+	type user struct {
+		role   string
+		active bool
+	}
+
+	tests := []struct {
+		name   string
+		users  map[int64]user
+		target int64
+		want   int
+	}{
+		{
+			"last active super admin",
+			map[int64]user{1: {RoleSuperAdmin, true}},
+			1, http.StatusConflict,
+		},
+		{
+			"last active super admin beside an inactive one",
+			map[int64]user{1: {RoleSuperAdmin, true}, 2: {RoleSuperAdmin, false}},
+			1, http.StatusConflict,
+		},
+		{
+			"inactive super admin beside the last active one",
+			map[int64]user{1: {RoleSuperAdmin, true}, 2: {RoleSuperAdmin, false}},
+			2, http.StatusOK,
+		},
+		{
+			"one of two active super admins",
+			map[int64]user{1: {RoleSuperAdmin, true}, 2: {RoleSuperAdmin, true}},
+			2, http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, f := newFakeDB(t)
+			h := &Handler{DB: db}
+
+			f.on("SELECT role, is_active FROM users WHERE id = ?", func(args []driver.Value) fakeResult {
+				u, ok := tt.users[args[0].(int64)]
+				if !ok {
+					return fakeResult{}
+				}
+				active := int64(0)
+				if u.active {
+					active = 1
+				}
+				return row(u.role, active)
+			})
+			f.on("SELECT COUNT(*) FROM users WHERE role = ? AND is_active = 1", func(args []driver.Value) fakeResult {
+				n := int64(0)
+				for _, u := range tt.users {
+					if u.role == args[0].(string) && u.active {
+						n++
+					}
+				}
+				return row(n)
+			})
+			demoted := false
+			f.on("UPDATE users SET role = ?", func([]driver.Value) fakeResult {
+				demoted = true
+				return fakeResult{affected: 1}
+			})
+
+			req := httptest.NewRequest("PUT", "/", strings.NewReader(`{"role":"admin"}`))
+			req = mux.SetURLVars(req, map[string]string{"id": strconv.FormatInt(tt.target, 10)})
+			req = req.WithContext(withPrincipal(req.Context(), Principal{UserID: 1, Role: RoleSuperAdmin}))
+			rec := httptest.NewRecorder()
+			h.AssignRole(rec, req)
+
+			if rec.Code != tt.want {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+			if demoted != (tt.want == http.StatusOK) {
+				t.Errorf("role updated: %v", demoted)
+			}
+		})
+	}
+}
@@ -0,0 +1,642 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Statuses of a refund (refunds.status). A refund is recorded as pending and
+// committed before the payment gateway is called, so money that has gone out
+// is never without a refund row; it becomes completed or failed once the
+// gateway has answered.
+const (
+	RefundPending   = "pending"
+	RefundCompleted = "completed"
+	RefundFailed    = "failed"
+)
+
+// Refund is money returned to the customer for some or all of an order's lines.
+type Refund struct {
+	ID          int          `json:"id"`
+	OrderID     int          `json:"order_id"`
+	PaymentID   *int         `json:"payment_id,omitempty"`
+	Amount      float64      `json:"amount"`
+	Reason      string       `json:"reason,omitempty"`
+	Status      string       `json:"status"`
+	ProviderRef string       `json:"provider_ref,omitempty"`
+	Restocked   bool         `json:"restocked"`
+	ActorID     *int         `json:"actor_id,omitempty"`
+	CreatedAt   string       `json:"created_at"`
+	Items       []RefundItem `json:"items"`
+}
+
+// RefundItem is the quantity of one order line covered by a refund.
+type RefundItem struct {
+	OrderItemID int     `json:"order_item_id"`
+	ProductID   int     `json:"product_id"`
+	Quantity    int     `json:"quantity"`
+	Amount      float64 `json:"amount"`
+}
+
+type refundRequest struct {
+	// Full refunds every quantity not refunded yet; otherwise Items lists the lines.
+	Full  bool `json:"full"`
+	Items []struct {
+		OrderItemID int `json:"order_item_id"`
+		Quantity    int `json:"quantity"`
+	} `json:"items"`
+	Reason string `json:"reason"`
+	// Restock returns the refunded units to stock. It defaults to true only
+	// while the order is processing, since shipped and delivered goods have
+	// not come back, and is ignored for cancelled orders, whose stock was
+	// restored on cancellation.
+	Restock *bool `json:"restock"`
+}
+
+// loadRefunds returns an order's refunds with their lines, oldest first.
+func loadRefunds(q queryer, orderID int) ([]Refund, error) {
+	rows, err := q.Query(`
+		SELECT id, order_id, payment_id, amount, COALESCE(reason, ''), status, COALESCE(provider_ref, ''), restocked,
+			actor_id, created_at
+		FROM refunds WHERE order_id = ? ORDER BY created_at, id
+	`, orderID)
+	if err != nil {
+		return nil, err
+	}
+
+	refunds := []Refund{}
+	index := map[int]int{}
+	for rows.Next() {
+		var (
+			rf                 Refund
+			paymentID, actorID sql.NullInt64
+		)
+		if err := rows.Scan(&rf.ID, &rf.OrderID, &paymentID, &rf.Amount, &rf.Reason, &rf.Status, &rf.ProviderRef,
+			&rf.Restocked, &actorID, &rf.CreatedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if paymentID.Valid {
+			id := int(paymentID.Int64)
+			rf.PaymentID = &id
+		}
+		if actorID.Valid {
+			id := int(actorID.Int64)
+			rf.ActorID = &id
+		}
+		rf.Items = []RefundItem{}
+		index[rf.ID] = len(refunds)
+		refunds = append(refunds, rf)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	itemRows, err := q.Query(`
+		SELECT ri.refund_id, ri.order_item_id, oi.product_id, ri.quantity, ri.amount
+		FROM refund_items ri
+		JOIN refunds rf ON ri.refund_id = rf.id
+		JOIN order_items oi ON ri.order_item_id = oi.id
+		WHERE rf.order_id = ?
+		ORDER BY ri.id
+	`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer itemRows.Close()
+
+	for itemRows.Next() {
+		var (
+			refundID int
+			item     RefundItem
+		)
+		if err := itemRows.Scan(&refundID, &item.OrderItemID, &item.ProductID, &item.Quantity, &item.Amount); err != nil {
+			return nil, err
+		}
+		if i, ok := index[refundID]; ok {
+			refunds[i].Items = append(refunds[i].Items, item)
+		}
+	}
+	return refunds, itemRows.Err()
+}
+
+var (
+	errRefundNotPaid        = errors.New("order has no paid payment")
+	errRefundExceedsPayment = errors.New("refund exceeds the amount paid")
+	errRefundGatewayMissing = errors.New("payment gateway not configured")
+	errRefundGateway        = errors.New("payment gateway refused the refund")
+)
+
+// orderLine is a locked order_items row.
+type orderLine struct {
+	productID, quantity, refunded int
+	price                         float64
+}
+
+// lockOrderLines locks an order's lines and returns them by id, along with
+// the ids in table order.
+func lockOrderLines(tx *sql.Tx, orderID int) (map[int]*orderLine, []int, error) {
+	rows, err := tx.Query(
+		"SELECT id, product_id, quantity, refunded_quantity, price FROM order_items WHERE order_id = ? ORDER BY id FOR UPDATE",
+		orderID,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	lines := map[int]*orderLine{}
+	var ids []int
+	for rows.Next() {
+		var (
+			id int
+			l  orderLine
+		)
+		if err := rows.Scan(&id, &l.productID, &l.quantity, &l.refunded, &l.price); err != nil {
+			return nil, nil, err
+		}
+		lines[id] = &l
+		ids = append(ids, id)
+	}
+	return lines, ids, rows.Err()
+}
+
+// refundItems prices the requested quantity of each line, in line order.
+func refundItems(lines map[int]*orderLine, ids []int, requested map[int]int) ([]RefundItem, float64) {
+	var (
+		items  []RefundItem
+		amount float64
+	)
+	for _, id := range ids {
+		qty, ok := requested[id]
+		if !ok {
+			continue
+		}
+		lineAmount := lines[id].price * float64(qty)
+		items = append(items, RefundItem{OrderItemID: id, ProductID: lines[id].productID, Quantity: qty, Amount: lineAmount})
+		amount += lineAmount
+	}
+	return items, amount
+}
+
+// issueRefund records a pending refund of amount for items of an order inside
+// tx, whose order row and lines must already be locked. The order needs a paid
+// payment with at least amount left unrefunded, or errRefundNotPaid or
+// errRefundExceedsPayment is returned. It bumps the refunded quantities and
+// totals straight away so the units cannot be refunded twice. The caller must
+// pass the returned id to completeRefund once tx is committed; the items are
+// restocked when the refund completes, if asked.
+func (h *Handler) issueRefund(tx *sql.Tx, orderID int, items []RefundItem, amount float64, reason string, restock bool, actorID int) (int, error) {
+	var (
+		paymentID   int
+		provider    string
+		paid        float64
+		refundedSum float64
+	)
+	err := tx.QueryRow(`
+		SELECT id, provider, amount, refunded_amount FROM payments
+		WHERE order_id = ? AND status = 'paid' ORDER BY id DESC LIMIT 1 FOR UPDATE
+	`, orderID).Scan(&paymentID, &provider, &paid, &refundedSum)
+	if err == sql.ErrNoRows {
+		return 0, errRefundNotPaid
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	// Refunds still waiting on the gateway count against the payment too
+	var pendingSum float64
+	if err := tx.QueryRow(
+		"SELECT COALESCE(SUM(amount), 0) FROM refunds WHERE payment_id = ? AND status = 'pending'", paymentID,
+	).Scan(&pendingSum); err != nil {
+		return 0, err
+	}
+	if refundedSum+pendingSum+amount > paid+0.005 {
+		return 0, errRefundExceedsPayment
+	}
+	if provider != h.Config.PaymentGateway.Name() {
+		return 0, errRefundGatewayMissing
+	}
+
+	result, err := tx.Exec(
+		`INSERT INTO refunds (order_id, payment_id, amount, reason, status, restocked, actor_id)
+		 VALUES (?, ?, ?, ?, ?, ?, NULLIF(?, 0))`,
+		orderID, paymentID, amount, reason, RefundPending, restock, actorID,
+	)
+	if err != nil {
+		return 0, err
+	}
+	refundID, _ := result.LastInsertId()
+
+	for _, item := range items {
+		if _, err := tx.Exec(
+			"INSERT INTO refund_items (refund_id, order_item_id, quantity, amount) VALUES (?, ?, ?, ?)",
+			refundID, item.OrderItemID, item.Quantity, item.Amount,
+		); err != nil {
+			return 0, err
+		}
+		if _, err := tx.Exec(
+			"UPDATE order_items SET refunded_quantity = refunded_quantity + ? WHERE id = ?",
+			item.Quantity, item.OrderItemID,
+		); err != nil {
+			return 0, err
+		}
+	}
+
+	if _, err := tx.Exec(
+		"UPDATE orders SET refunded_amount = refunded_amount + ? WHERE id = ?", amount, orderID,
+	); err != nil {
+		return 0, err
+	}
+
+	h.audit(tx, actorID, "order_refunded", "order", orderID, fmt.Sprintf("refund %d: %.2f", refundID, amount))
+	return int(refundID), nil
+}
+
+// restockRefund puts the units of a refund's lines back into stock.
+func restockRefund(q execer, refundID int) error {
+	_, err := q.Exec(`
+		UPDATE products p
+		JOIN (
+			SELECT oi.product_id, SUM(ri.quantity) AS quantity
+			FROM refund_items ri
+			JOIN order_items oi ON ri.order_item_id = oi.id
+			WHERE ri.refund_id = ?
+			GROUP BY oi.product_id
+		) back ON back.product_id = p.id
+		SET p.stock = p.stock + back.quantity
+	`, refundID)
+	return err
+}
+
+// completeRefund sends a pending refund to the payment gateway and records the
+// outcome. The refund id is the gateway's idempotency key, so a refund whose
+// outcome was lost can be sent again without paying out twice. It returns the
+// refund's status afterwards: a refund that could not be settled stays
+// pending and is retried by the hold sweeper.
+func (h *Handler) completeRefund(refundID int) string {
+	var (
+		chargeRef, provider string
+		amount              float64
+	)
+	err := h.DB.QueryRow(`
+		SELECT p.provider_ref, p.provider, rf.amount FROM refunds rf
+		JOIN payments p ON rf.payment_id = p.id
+		WHERE rf.id = ? AND rf.status = 'pending'
+	`, refundID).Scan(&chargeRef, &provider, &amount)
+	if err == sql.ErrNoRows {
+		// Settled in the meantime by another call
+		var status string
+		h.DB.QueryRow("SELECT status FROM refunds WHERE id = ?", refundID).Scan(&status)
+		return status
+	}
+	if err != nil {
+		log.Printf("refunds: loading refund %d failed: %v", refundID, err)
+		return RefundPending
+	}
+	if provider != h.Config.PaymentGateway.Name() {
+		log.Printf("refunds: refund %d is for gateway %q, which is not configured", refundID, provider)
+		return RefundPending
+	}
+
+	result, err := h.Config.PaymentGateway.Refund(chargeRef, amount, fmt.Sprintf("refund-%d", refundID))
+	status := RefundCompleted
+	if err != nil {
+		if !refundDeclined(err) {
+			log.Printf("refunds: gateway refund %d failed, will retry: %v", refundID, err)
+			return RefundPending
+		}
+		log.Printf("refunds: gateway declined refund %d: %v", refundID, err)
+		status = RefundFailed
+	}
+
+	if err := h.settleRefund(refundID, status, result.ProviderRef); err != nil {
+		log.Printf("refunds: recording the outcome of refund %d failed, will retry: %v", refundID, err)
+		return RefundPending
+	}
+	return status
+}
+
+// settleRefund records the gateway's answer for a pending refund. A completed
+// refund is added to its payment and restocked if it asked to be, unless the
+// order has been cancelled since and its stock restored that way. A failed
+// refund releases the quantities and amount it held, reopens a return it was
+// refunding, and order staff are told.
+func (h *Handler) settleRefund(refundID int, status, providerRef string) error {
+	tx, err := h.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var (
+		orderID   int
+		paymentID sql.NullInt64
+	)
+	if err := tx.QueryRow(
+		"SELECT order_id, payment_id FROM refunds WHERE id = ?", refundID,
+	).Scan(&orderID, &paymentID); err != nil {
+		return err
+	}
+
+	// Lock in the same order as issueRefund: order, lines, payment, then the refund
+	var orderStatus string
+	if err := tx.QueryRow("SELECT status FROM orders WHERE id = ? FOR UPDATE", orderID).Scan(&orderStatus); err != nil {
+		return err
+	}
+	if _, _, err := lockOrderLines(tx, orderID); err != nil {
+		return err
+	}
+	if paymentID.Valid {
+		var locked int
+		if err := tx.QueryRow("SELECT id FROM payments WHERE id = ? FOR UPDATE", paymentID.Int64).Scan(&locked); err != nil {
+			return err
+		}
+	}
+
+	var (
+		current   string
+		amount    float64
+		restocked bool
+	)
+	if err := tx.QueryRow(
+		"SELECT status, amount, restocked FROM refunds WHERE id = ? FOR UPDATE", refundID,
+	).Scan(&current, &amount, &restocked); err != nil {
+		return err
+	}
+	if current != RefundPending {
+		return nil
+	}
+
+	if status == RefundCompleted {
+		if _, err := tx.Exec(
+			"UPDATE refunds SET status = ?, provider_ref = ? WHERE id = ?", RefundCompleted, providerRef, refundID,
+		); err != nil {
+			return err
+		}
+		if paymentID.Valid {
+			if _, err := tx.Exec(`
+				UPDATE payments SET refunded_amount = refunded_amount + ?,
+					status = IF(refunded_amount >= amount - 0.005, 'refunded', status)
+				WHERE id = ?
+			`, amount, paymentID.Int64); err != nil {
+				return err
+			}
+		}
+		switch {
+		case restocked && orderStatus == OrderCancelled:
+			// Cancelling the order has restocked these units already
+			if _, err := tx.Exec("UPDATE refunds SET restocked = 0 WHERE id = ?", refundID); err != nil {
+				return err
+			}
+		case restocked:
+			if err := restockRefund(tx, refundID); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.Exec(`
+			INSERT INTO notifications (user_id, title, body, type)
+			SELECT user_id, CONCAT('Pengembalian pesanan #', order_id), ?, 'return' FROM returns WHERE refund_id = ?
+		`, fmt.Sprintf("Dana sebesar %.2f telah dikembalikan.", amount), refundID); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}
+
+	if _, err := tx.Exec("UPDATE refunds SET status = ? WHERE id = ?", RefundFailed, refundID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`
+		UPDATE order_items oi
+		JOIN refund_items ri ON ri.order_item_id = oi.id
+		SET oi.refunded_quantity = oi.refunded_quantity - ri.quantity
+		WHERE ri.refund_id = ?
+	`, refundID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(
+		"UPDATE orders SET refunded_amount = refunded_amount - ? WHERE id = ?", amount, orderID,
+	); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(
+		"UPDATE returns SET status = ?, refund_id = NULL WHERE refund_id = ?", ReturnReceived, refundID,
+	); err != nil {
+		return err
+	}
+	if err := notifyStaff(tx, PermOrdersRefund,
+		fmt.Sprintf("Refund declined for order #%d", orderID),
+		fmt.Sprintf("The payment gateway declined refund %d of %.2f. Its items can be refunded again.", refundID, amount),
+		"refund",
+	); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// retryPendingRefunds sends refunds that are still pending to the gateway
+// again, e.g. after the gateway was unreachable or the outcome could not be
+// written. Refunds younger than a minute are left to the request that made
+// them. It returns the number of refunds settled.
+func (h *Handler) retryPendingRefunds() (int, error) {
+	rows, err := h.DB.Query(
+		"SELECT id FROM refunds WHERE status = 'pending' AND created_at <= NOW() - INTERVAL 1 MINUTE ORDER BY id LIMIT 100",
+	)
+	if err != nil {
+		return 0, err
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	settled := 0
+	for _, id := range ids {
+		if h.completeRefund(id) != RefundPending {
+			settled++
+		}
+	}
+	return settled, nil
+}
+
+// refundableMessage explains how many units of a line can still be refunded
+// when some of the unrefunded units are in an open return.
+func refundableMessage(unrefunded, inReturn int) string {
+	if inReturn == 0 {
+		return fmt.Sprintf("Only %d left to refund", unrefunded)
+	}
+	return fmt.Sprintf("Only %d left to refund; %d are in an open return", unrefunded-inReturn, inReturn)
+}
+
+// respondRefundError maps an issueRefund error, or errRefundGateway for a
+// refund the gateway declined, to a response.
+func respondRefundError(w http.ResponseWriter, err error) {
+	switch err {
+	case errRefundNotPaid:
+		respondError(w, http.StatusConflict, "Order has no paid payment to refund")
+	case errRefundExceedsPayment:
+		respondError(w, http.StatusConflict, "Refund exceeds the amount paid")
+	case errRefundGatewayMissing:
+		respondError(w, http.StatusConflict, "Payment was made through a gateway that is not configured")
+	case errRefundGateway:
+		respondError(w, http.StatusBadGateway, "Payment gateway refused the refund")
+	default:
+		respondError(w, http.StatusInternalServerError, "Failed to record refund")
+	}
+}
+
+// RefundOrder refunds all remaining or selected quantities of an order's
+// lines through the gateway of its paid payment; an order without one is
+// answered with 409. A refund the gateway could not be reached for is
+// answered with 202 and stays pending until the hold sweeper retries it.
+func (h *Handler) RefundOrder(w http.ResponseWriter, r *http.Request) {
+	orderID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid order ID")
+		return
+	}
+
+	var req refundRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if !req.Full && len(req.Items) == 0 {
+		respondValidationError(w, map[string]string{"items": "Select items to refund or set full"})
+		return
+	}
+	req.Reason = strings.TrimSpace(req.Reason)
+
+	principal, _ := principalFromContext(r.Context())
+
+	tx, err := h.DB.Begin()
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	var status string
+	if err := tx.QueryRow("SELECT status FROM orders WHERE id = ? FOR UPDATE", orderID).Scan(&status); err != nil {
+		respondError(w, http.StatusNotFound, "Order not found")
+		return
+	}
+	if status == OrderPending {
+		respondError(w, http.StatusConflict, "Pending orders have not been paid; cancel the order instead")
+		return
+	}
+
+	lines, lineIDs, err := lockOrderLines(tx, orderID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to fetch order items")
+		return
+	}
+
+	// Units in an open return are refunded through the return once it is
+	// received, so they cannot be refunded here as well
+	open, err := openReturnQuantities(tx, orderID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to check returns")
+		return
+	}
+
+	// Work out what to refund per line
+	requested := map[int]int{}
+	if req.Full {
+		for _, id := range lineIDs {
+			if remaining := lines[id].quantity - lines[id].refunded - open[id]; remaining > 0 {
+				requested[id] = remaining
+			}
+		}
+	} else {
+		fieldErrs := map[string]string{}
+		for i, item := range req.Items {
+			requested[item.OrderItemID] += item.Quantity
+			key := fmt.Sprintf("items.%d", i)
+			l, ok := lines[item.OrderItemID]
+			switch {
+			case !ok:
+				fieldErrs[key] = "Item does not belong to this order"
+			case item.Quantity <= 0:
+				fieldErrs[key] = "Quantity must be positive"
+			case requested[item.OrderItemID] > l.quantity-l.refunded-open[item.OrderItemID]:
+				fieldErrs[key] = refundableMessage(l.quantity-l.refunded, open[item.OrderItemID])
+			}
+		}
+		if len(fieldErrs) > 0 {
+			respondValidationError(w, fieldErrs)
+			return
+		}
+	}
+	if len(requested) == 0 {
+		if len(open) > 0 {
+			respondError(w, http.StatusConflict, "The remaining items are in an open return; refund them through the return")
+			return
+		}
+		respondError(w, http.StatusConflict, "Order is already fully refunded")
+		return
+	}
+
+	items, amount := refundItems(lines, lineIDs, requested)
+	restock := status == OrderProcessing
+	if req.Restock != nil {
+		restock = *req.Restock
+	}
+	restock = restock && status != OrderCancelled
+
+	refundID, err := h.issueRefund(tx, orderID, items, amount, req.Reason, restock, principal.UserID)
+	if err != nil {
+		respondRefundError(w, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to record refund")
+		return
+	}
+
+	if h.completeRefund(refundID) == RefundFailed {
+		respondRefundError(w, errRefundGateway)
+		return
+	}
+
+	refunds, err := loadRefunds(h.DB, orderID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to fetch refund")
+		return
+	}
+	for _, refund := range refunds {
+		if refund.ID != refundID {
+			continue
+		}
+		code, message := http.StatusCreated, "Refund issued"
+		if refund.Status == RefundPending {
+			code, message = http.StatusAccepted, "Refund recorded; the payment gateway will be retried"
+		}
+		respondJSON(w, code, Response{
+			Success: true,
+			Message: message,
+			Data:    refund,
+		})
+		return
+	}
+	respondError(w, http.StatusInternalServerError, "Failed to fetch refund")
+}
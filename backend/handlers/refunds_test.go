@@ -0,0 +1,538 @@
+package handlers
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// stubGateway is a PaymentGateway whose refunds answer with err, recording
+// the idempotency key of every call.
+type stubGateway struct {
+	err  error
+	keys []string
+}
+
+func (g *stubGateway) Name() string { return "fake" }
+
+func (g *stubGateway) CreateCharge(ChargeRequest) (Charge, error) {
+	return Charge{}, errors.New("not supported")
+}
+
+func (g *stubGateway) ChargeStatus(string) (Charge, error) { return Charge{}, errChargeNotFound }
+
+func (g *stubGateway) Refund(providerRef string, amount float64, idempotencyKey string) (RefundResult, error) {
+	g.keys = append(g.keys, idempotencyKey)
+	if g.err != nil {
+		return RefundResult{}, g.err
+	}
+	return RefundResult{ProviderRef: "rf_" + idempotencyKey, Amount: amount}, nil
+}
+
+type testLine struct {
+	productID, quantity, refunded int
+	price                         float64
+}
+
+type testRefund struct {
+	status    string
+	amount    float64
+	restocked bool
+	items     map[int]int
+	lineIDs   []int
+}
+
+type testReturn struct {
+	userID   int
+	status   string
+	refundID int
+	items    map[int]int
+}
+
+// refundState models order 1 with its lines, its payment 5, refunds and
+// returns, and the stock of its products on a fakeDB.
+type refundState struct {
+	orderStatus   string
+	orderRefunded float64
+	lines         map[int]*testLine
+	lineIDs       []int
+
+	paid            bool // whether payment 5 exists and is paid
+	paymentAmount   float64
+	paymentRefunded float64
+	paymentStatus   string
+
+	refunds  []*testRefund // refund id n is refunds[n-1]
+	returns  map[int]*testReturn
+	stock    map[int]int
+	staff    int // staff notifications sent
+	customer int // customer notifications sent
+}
+
+// addLine adds an order line for productID.
+func (s *refundState) addLine(id, productID, quantity int, price float64) {
+	s.lines[id] = &testLine{productID: productID, quantity: quantity, price: price}
+	s.lineIDs = append(s.lineIDs, id)
+}
+
+func (s *refundState) refund(id int64) *testRefund {
+	if id < 1 || int(id) > len(s.refunds) {
+		return nil
+	}
+	return s.refunds[id-1]
+}
+
+func newRefundState(f *fakeDB, orderStatus string) *refundState {
+	s := &refundState{
+		orderStatus:   orderStatus,
+		lines:         map[int]*testLine{},
+		paymentStatus: PaymentPaid,
+		returns:       map[int]*testReturn{},
+		stock:         map[int]int{},
+	}
+
+	// Orders and lines
+	f.on("SELECT status FROM orders WHERE id = ? FOR UPDATE", func([]driver.Value) fakeResult {
+		return row(s.orderStatus)
+	})
+	f.on("SELECT id, product_id, quantity, refunded_quantity, price FROM order_items", func([]driver.Value) fakeResult {
+		res := fakeResult{columns: make([]string, 5)}
+		for _, id := range s.lineIDs {
+			l := s.lines[id]
+			res.rows = append(res.rows, []driver.Value{int64(id), int64(l.productID), int64(l.quantity), int64(l.refunded), l.price})
+		}
+		return res
+	})
+	f.on("UPDATE order_items SET refunded_quantity = refunded_quantity + ?", func(args []driver.Value) fakeResult {
+		s.lines[int(args[1].(int64))].refunded += int(args[0].(int64))
+		return fakeResult{affected: 1}
+	})
+	f.on("UPDATE order_items oi JOIN refund_items ri", func(args []driver.Value) fakeResult {
+		for id, qty := range s.refund(args[0].(int64)).items {
+			s.lines[id].refunded -= qty
+		}
+		return fakeResult{affected: 1}
+	})
+	f.on("UPDATE orders SET refunded_amount = refunded_amount + ?", func(args []driver.Value) fakeResult {
+		s.orderRefunded += args[0].(float64)
+		return fakeResult{affected: 1}
+	})
+	f.on("UPDATE orders SET refunded_amount = refunded_amount - ?", func(args []driver.Value) fakeResult {
+		s.orderRefunded -= args[0].(float64)
+		return fakeResult{affected: 1}
+	})
+
+	// Payment
+	f.on("SELECT id, provider, amount, refunded_amount FROM payments", func([]driver.Value) fakeResult {
+		if !s.paid || s.paymentStatus != PaymentPaid {
+			return fakeResult{}
+		}
+		return row(int64(5), "fake", s.paymentAmount, s.paymentRefunded)
+	})
+	f.on("SELECT id FROM payments WHERE id = ? FOR UPDATE", func([]driver.Value) fakeResult {
+		return row(int64(5))
+	})
+	f.on("UPDATE payments SET refunded_amount = refunded_amount + ?", func(args []driver.Value) fakeResult {
+		s.paymentRefunded += args[0].(float64)
+		if s.paymentRefunded >= s.paymentAmount-0.005 {
+			s.paymentStatus = PaymentRefunded
+		}
+		return fakeResult{affected: 1}
+	})
+
+	// Refunds
+	f.on("SELECT COALESCE(SUM(amount), 0) FROM refunds WHERE payment_id", func([]driver.Value) fakeResult {
+		sum := 0.0
+		for _, rf := range s.refunds {
+			if rf.status == RefundPending {
+				sum += rf.amount
+			}
+		}
+		return row(sum)
+	})
+	f.on("INSERT INTO refunds", func(args []driver.Value) fakeResult {
+		s.refunds = append(s.refunds, &testRefund{
+			amount:    args[2].(float64),
+			status:    args[4].(string),
+			restocked: args[5].(bool),
+			items:     map[int]int{},
+		})
+		return fakeResult{affected: 1, lastID: int64(len(s.refunds))}
+	})
+	f.on("INSERT INTO refund_items", func(args []driver.Value) fakeResult {
+		rf := s.refund(args[0].(int64))
+		id := int(args[1].(int64))
+		rf.items[id] += int(args[2].(int64))
+		rf.lineIDs = append(rf.lineIDs, id)
+		return fakeResult{affected: 1}
+	})
+	f.on("SELECT p.provider_ref, p.provider, rf.amount FROM refunds rf", func(args []driver.Value) fakeResult {
+		rf := s.refund(args[0].(int64))
+		if rf == nil || rf.status != RefundPending {
+			return fakeResult{}
+		}
+		return row("ch_1", "fake", rf.amount)
+	})
+	f.on("SELECT status FROM refunds WHERE id = ?", func(args []driver.Value) fakeResult {
+		return row(s.refund(args[0].(int64)).status)
+	})
+	f.on("SELECT order_id, payment_id FROM refunds WHERE id = ?", func([]driver.Value) fakeResult {
+		return row(int64(1), int64(5))
+	})
+	f.on("SELECT status, amount, restocked FROM refunds WHERE id = ?", func(args []driver.Value) fakeResult {
+		rf := s.refund(args[0].(int64))
+		return row(rf.status, rf.amount, rf.restocked)
+	})
+	f.on("UPDATE refunds SET status = ?, provider_ref = ?", func(args []driver.Value) fakeResult {
+		s.refund(args[2].(int64)).status = args[0].(string)
+		return fakeResult{affected: 1}
+	})
+	f.on("UPDATE refunds SET status = ? WHERE id = ?", func(args []driver.Value) fakeResult {
+		s.refund(args[1].(int64)).status = args[0].(string)
+		return fakeResult{affected: 1}
+	})
+	f.on("UPDATE refunds SET restocked = 0", func(args []driver.Value) fakeResult {
+		s.refund(args[0].(int64)).restocked = false
+		return fakeResult{affected: 1}
+	})
+	f.on("SET p.stock = p.stock + back.quantity", func(args []driver.Value) fakeResult {
+		for id, qty := range s.refund(args[0].(int64)).items {
+			s.stock[s.lines[id].productID] += qty
+		}
+		return fakeResult{affected: 1}
+	})
+	f.on("SELECT id FROM refunds WHERE status = 'pending'", func([]driver.Value) fakeResult {
+		res := fakeResult{columns: []string{"id"}}
+		for i, rf := range s.refunds {
+			if rf.status == RefundPending {
+				res.rows = append(res.rows, []driver.Value{int64(i + 1)})
+			}
+		}
+		return res
+	})
+	f.on("FROM refunds WHERE order_id = ? ORDER BY created_at, id", func([]driver.Value) fakeResult {
+		res := fakeResult{columns: make([]string, 10)}
+		for i, rf := range s.refunds {
+			res.rows = append(res.rows, []driver.Value{
+				int64(i + 1), int64(1), int64(5), rf.amount, "", rf.status, "", rf.restocked, int64(1), "2026-01-01 00:00:00",
+			})
+		}
+		return res
+	})
+	f.on("SELECT ri.refund_id, ri.order_item_id, oi.product_id, ri.quantity, ri.amount FROM refund_items ri", func([]driver.Value) fakeResult {
+		res := fakeResult{columns: make([]string, 5)}
+		for i, rf := range s.refunds {
+			for _, id := range rf.lineIDs {
+				l := s.lines[id]
+				res.rows = append(res.rows, []driver.Value{
+					int64(i + 1), int64(id), int64(l.productID), int64(rf.items[id]), l.price * float64(rf.items[id]),
+				})
+			}
+		}
+		return res
+	})
+
+	// Returns
+	f.on("FROM return_items ri JOIN returns r", func([]driver.Value) fakeResult {
+		open := map[int]int{}
+		for _, rt := range s.returns {
+			if rt.status == ReturnRequested || rt.status == ReturnApproved || rt.status == ReturnReceived {
+				for id, qty := range rt.items {
+					open[id] += qty
+				}
+			}
+		}
+		res := fakeResult{columns: make([]string, 2)}
+		for id, qty := range open {
+			res.rows = append(res.rows, []driver.Value{int64(id), int64(qty)})
+		}
+		return res
+	})
+	f.on("UPDATE returns SET status = ?, refund_id = NULL WHERE refund_id = ?", func(args []driver.Value) fakeResult {
+		for _, rt := range s.returns {
+			if int64(rt.refundID) == args[1].(int64) {
+				rt.status = args[0].(string)
+				rt.refundID = 0
+			}
+		}
+		return fakeResult{affected: 1}
+	})
+
+	// Notifications
+	f.on("FROM users WHERE is_active = 1 AND role IN", func([]driver.Value) fakeResult {
+		s.staff++
+		return fakeResult{affected: 1}
+	})
+	f.on("FROM returns WHERE refund_id = ?", func(args []driver.Value) fakeResult {
+		for _, rt := range s.returns {
+			if int64(rt.refundID) == args[1].(int64) {
+				s.customer++
+			}
+		}
+		return fakeResult{affected: 1}
+	})
+	f.on("INSERT INTO notifications (user_id, title, body, type) VALUES", func([]driver.Value) fakeResult {
+		s.customer++
+		return fakeResult{affected: 1}
+	})
+	return s
+}
+
+// refundRequestFor sends body to RefundOrder for order 1.
+func refundRequestFor(h *Handler, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/api/admin/orders/1/refunds", strings.NewReader(body))
+	req = mux.SetURLVars(req, map[string]string{"id": "1"})
+	req = req.WithContext(withPrincipal(req.Context(), Principal{UserID: 1, Role: RoleAdmin}))
+	rec := httptest.NewRecorder()
+	h.RefundOrder(rec, req)
+	return rec
+}
+
+func TestRefundOrderPartialRefunds(t *testing.T) {
+	db, f := newFakeDB(t)
+	gateway := &stubGateway{}
+	h := NewHandler(db, Config{PaymentGateway: gateway})
+	s := newRefundState(f, OrderProcessing)
+	s.addLine(11, 101, 3, 100)
+	s.addLine(12, 102, 1, 50)
+	s.paid, s.paymentAmount = true, 350
+
+	if rec := refundRequestFor(h, `{"items":[{"order_item_id":11,"quantity":2}]}`); rec.Code != http.StatusCreated {
+		t.Fatalf("first refund: status %d: %s", rec.Code, rec.Body)
+	}
+	if s.lines[11].refunded != 2 || s.orderRefunded != 200 || s.paymentRefunded != 200 {
+		t.Fatalf("after first refund: refunded %d units, order %.2f, payment %.2f", s.lines[11].refunded, s.orderRefunded, s.paymentRefunded)
+	}
+	if s.stock[101] != 2 {
+		t.Errorf("processing order refund restocked %d units, want 2", s.stock[101])
+	}
+
+	// Two units of line 11 have been refunded, so only one is left
+	rec := refundRequestFor(h, `{"items":[{"order_item_id":11,"quantity":1},{"order_item_id":11,"quantity":1}]}`)
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "Only 1 left to refund") {
+		t.Fatalf("refund beyond the line: status %d: %s", rec.Code, rec.Body)
+	}
+	for _, body := range []string{
+		`{"items":[{"order_item_id":99,"quantity":1}]}`,
+		`{"items":[{"order_item_id":12,"quantity":0}]}`,
+		`{}`,
+	} {
+		if rec := refundRequestFor(h, body); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want %d", body, rec.Code, http.StatusBadRequest)
+		}
+	}
+
+	if rec := refundRequestFor(h, `{"full":true,"restock":false}`); rec.Code != http.StatusCreated {
+		t.Fatalf("full refund of the rest: status %d: %s", rec.Code, rec.Body)
+	}
+	if s.lines[11].refunded != 3 || s.lines[12].refunded != 1 || s.orderRefunded != 350 {
+		t.Errorf("after full refund: lines %d and %d refunded, order %.2f", s.lines[11].refunded, s.lines[12].refunded, s.orderRefunded)
+	}
+	if s.paymentStatus != PaymentRefunded {
+		t.Errorf("payment status %q, want %q", s.paymentStatus, PaymentRefunded)
+	}
+	if s.stock[101] != 2 || s.stock[102] != 0 {
+		t.Errorf("restock false still restocked: stock %v", s.stock)
+	}
+
+	if rec := refundRequestFor(h, `{"full":true}`); rec.Code != http.StatusConflict {
+		t.Errorf("refund of a fully refunded order: status %d, want %d", rec.Code, http.StatusConflict)
+	}
+	if len(gateway.keys) != 2 || gateway.keys[0] == gateway.keys[1] {
+		t.Errorf("gateway keys %v, want two distinct keys", gateway.keys)
+	}
+}
+
+// TestRefundRestockDefault checks that refunds restock by default only while
+// the order is processing, and never for cancelled orders.
+func TestRefundRestockDefault(t *testing.T) {
+	tests := []struct {
+		status string
+		body   string
+		want   bool
+	}{
+		{OrderProcessing, `{"full":true}`, true},
+		{OrderProcessing, `{"full":true,"restock":false}`, false},
+		{OrderDelivered, `{"full":true}`, false},
+		{OrderDelivered, `{"full":true,"restock":true}`, true},
+		{OrderCancelled, `{"full":true,"restock":true}`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.status+" "+tt.body, func(t *testing.T) {
+			db, f := newFakeDB(t)
+			h := NewHandler(db, Config{PaymentGateway: &stubGateway{}})
+			s := newRefundState(f, tt.status)
+			s.addLine(11, 101, 1, 100)
+			s.paid, s.paymentAmount = true, 100
+
+			if rec := refundRequestFor(h, tt.body); rec.Code != http.StatusCreated {
+				t.Fatalf("status %d: %s", rec.Code, rec.Body)
+			}
+			if got := s.refunds[0].restocked; got != tt.want {
+				t.Errorf("restocked %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRefundOrderRequiresPaidPayment(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      string
+		paid        bool
+		amount      float64
+		pendingPaid float64 // amount of an earlier refund still pending
+	}{
+		{"pending order", OrderPending, true, 100, 0},
+		{"cancelled order never paid", OrderCancelled, false, 0, 0},
+		{"delivered order never paid", OrderDelivered, false, 0, 0},
+		{"refund larger than the payment", OrderDelivered, true, 80, 0},
+		{"pending refund uses up the payment", OrderDelivered, true, 150, 60},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, f := newFakeDB(t)
+			gateway := &stubGateway{}
+			h := NewHandler(db, Config{PaymentGateway: gateway})
+			s := newRefundState(f, tt.status)
+			s.addLine(11, 101, 1, 100)
+			s.paid, s.paymentAmount = tt.paid, tt.amount
+			if tt.pendingPaid > 0 {
+				s.addLine(12, 102, 1, tt.pendingPaid)
+				s.lines[12].refunded = 1
+				s.refunds = append(s.refunds, &testRefund{status: RefundPending, amount: tt.pendingPaid, items: map[int]int{12: 1}})
+			}
+			before := len(s.refunds)
+
+			rec := refundRequestFor(h, `{"items":[{"order_item_id":11,"quantity":1}]}`)
+			if rec.Code != http.StatusConflict {
+				t.Fatalf("status %d, want %d: %s", rec.Code, http.StatusConflict, rec.Body)
+			}
+			if len(s.refunds) != before || s.orderRefunded != 0 || s.lines[11].refunded != 0 {
+				t.Errorf("refund recorded: %d refunds, order refunded %.2f, line refunded %d", len(s.refunds), s.orderRefunded, s.lines[11].refunded)
+			}
+			if len(gateway.keys) != 0 {
+				t.Errorf("gateway called with %v", gateway.keys)
+			}
+		})
+	}
+}
+
+func TestRefundOrderGatewayUnreachable(t *testing.T) {
+	db, f := newFakeDB(t)
+	gateway := &stubGateway{err: errors.New("connection refused")}
+	h := NewHandler(db, Config{PaymentGateway: gateway})
+	s := newRefundState(f, OrderProcessing)
+	s.addLine(11, 101, 2, 100)
+	s.paid, s.paymentAmount = true, 200
+
+	rec := refundRequestFor(h, `{"full":true}`)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("status %d, want %d: %s", rec.Code, http.StatusAccepted, rec.Body)
+	}
+	var resp struct {
+		Data Refund `json:"data"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || resp.Data.Status != RefundPending {
+		t.Fatalf("response refund %+v (%v), want it pending", resp.Data, err)
+	}
+
+	// The pending refund holds its units and amount, but nothing is paid out or restocked yet
+	if s.lines[11].refunded != 2 || s.orderRefunded != 200 {
+		t.Errorf("pending refund holds %d units and %.2f, want 2 and 200", s.lines[11].refunded, s.orderRefunded)
+	}
+	if s.paymentRefunded != 0 || s.stock[101] != 0 {
+		t.Errorf("pending refund settled early: payment refunded %.2f, stock %v", s.paymentRefunded, s.stock)
+	}
+	if rec := refundRequestFor(h, `{"full":true}`); rec.Code != http.StatusConflict {
+		t.Errorf("second refund while one is pending: status %d, want %d", rec.Code, http.StatusConflict)
+	}
+
+	// Still down: the sweeper leaves it pending
+	if n, err := h.retryPendingRefunds(); err != nil || n != 0 {
+		t.Fatalf("retry while down: settled %d, err %v", n, err)
+	}
+
+	gateway.err = nil
+	if n, err := h.retryPendingRefunds(); err != nil || n != 1 {
+		t.Fatalf("retry: settled %d, err %v; want 1", n, err)
+	}
+	if rf := s.refunds[0]; rf.status != RefundCompleted || !rf.restocked {
+		t.Errorf("refund after retry: %+v, want completed and restocked", rf)
+	}
+	if s.paymentRefunded != 200 || s.stock[101] != 2 {
+		t.Errorf("after retry: payment refunded %.2f, stock %v", s.paymentRefunded, s.stock)
+	}
+	for _, key := range gateway.keys {
+		if key != "refund-1" {
+			t.Errorf("gateway keys %v, want every attempt to use refund-1", gateway.keys)
+			break
+		}
+	}
+
+	// Nothing is left to retry
+	if n, _ := h.retryPendingRefunds(); n != 0 || len(gateway.keys) != 3 {
+		t.Errorf("retry after settling: settled %d, gateway called %d times", n, len(gateway.keys))
+	}
+}
+
+func TestRefundOrderGatewayDeclines(t *testing.T) {
+	db, f := newFakeDB(t)
+	gateway := &stubGateway{err: errRefundTooLarge}
+	h := NewHandler(db, Config{PaymentGateway: gateway})
+	s := newRefundState(f, OrderProcessing)
+	s.addLine(11, 101, 2, 100)
+	s.paid, s.paymentAmount = true, 200
+
+	if rec := refundRequestFor(h, `{"full":true}`); rec.Code != http.StatusBadGateway {
+		t.Fatalf("status %d, want %d: %s", rec.Code, http.StatusBadGateway, rec.Body)
+	}
+	if s.refunds[0].status != RefundFailed {
+		t.Errorf("refund status %q, want %q", s.refunds[0].status, RefundFailed)
+	}
+	if s.lines[11].refunded != 0 || s.orderRefunded != 0 || s.paymentRefunded != 0 || s.stock[101] != 0 {
+		t.Errorf("declined refund kept effects: line refunded %d, order %.2f, payment %.2f, stock %v",
+			s.lines[11].refunded, s.orderRefunded, s.paymentRefunded, s.stock)
+	}
+	if s.staff != 1 {
+		t.Errorf("%d staff notifications, want 1", s.staff)
+	}
+
+	// The released units can be refunded again
+	gateway.err = nil
+	if rec := refundRequestFor(h, `{"full":true}`); rec.Code != http.StatusCreated {
+		t.Fatalf("refund after a decline: status %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestSettleRefundSkipsRestockOfCancelledOrder(t *testing.T) {
+	db, f := newFakeDB(t)
+	gateway := &stubGateway{err: errors.New("timeout")}
+	h := NewHandler(db, Config{PaymentGateway: gateway})
+	s := newRefundState(f, OrderProcessing)
+	s.addLine(11, 101, 2, 100)
+	s.paid, s.paymentAmount = true, 200
+
+	if rec := refundRequestFor(h, `{"items":[{"order_item_id":11,"quantity":1}]}`); rec.Code != http.StatusAccepted {
+		t.Fatalf("status %d, want %d: %s", rec.Code, http.StatusAccepted, rec.Body)
+	}
+
+	// Cancelling the order restocks every unit before the refund settles
+	s.orderStatus = OrderCancelled
+	gateway.err = nil
+	if n, err := h.retryPendingRefunds(); err != nil || n != 1 {
+		t.Fatalf("retry: settled %d, err %v", n, err)
+	}
+	if rf := s.refunds[0]; rf.status != RefundCompleted || rf.restocked {
+		t.Errorf("refund %+v, want completed and not restocked", rf)
+	}
+	if s.stock[101] != 0 {
+		t.Errorf("stock %v, want the refund not to restock again", s.stock)
+	}
+}
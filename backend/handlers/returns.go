@@ -0,0 +1,575 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// Statuses of a return request (returns.status).
+const (
+	ReturnRequested = "requested"
+	ReturnApproved  = "approved"
+	ReturnRejected  = "rejected"
+	ReturnReceived  = "received"
+	ReturnRefunded  = "refunded"
+)
+
+// maxPhotosURLLength is the size of returns.photos_url.
+const maxPhotosURLLength = 500
+
+// returnTransitions lists the statuses staff may move a return to. A return
+// becomes refunded only through RefundReturn.
+var returnTransitions = map[string][]string{
+	ReturnRequested: {ReturnApproved, ReturnRejected},
+	ReturnApproved:  {ReturnReceived, ReturnRejected},
+	ReturnReceived:  {},
+	ReturnRejected:  {},
+	ReturnRefunded:  {},
+}
+
+// OrderReturn is a customer's request to send back delivered items.
+type OrderReturn struct {
+	ID        int          `json:"id"`
+	OrderID   int          `json:"order_id"`
+	UserID    int          `json:"user_id"`
+	Status    string       `json:"status"`
+	Reason    string       `json:"reason"`
+	PhotosURL string       `json:"photos_url,omitempty"`
+	AdminNote string       `json:"admin_note,omitempty"`
+	RefundID  *int         `json:"refund_id,omitempty"`
+	CreatedAt string       `json:"created_at"`
+	UpdatedAt string       `json:"updated_at"`
+	Items     []ReturnItem `json:"items"`
+}
+
+// ReturnItem is the quantity of one order line being returned.
+type ReturnItem struct {
+	OrderItemID int     `json:"order_item_id"`
+	ProductID   int     `json:"product_id"`
+	Name        string  `json:"name"`
+	Quantity    int     `json:"quantity"`
+	Price       float64 `json:"price"`
+}
+
+// loadReturns returns the returns matching where (a condition on returns r)
+// with their items, newest first. page is appended after the ordering, e.g. a
+// LIMIT clause.
+func loadReturns(q queryer, where, page string, args ...interface{}) ([]OrderReturn, error) {
+	rows, err := q.Query(`
+		SELECT r.id, r.order_id, r.user_id, r.status, r.reason, COALESCE(r.photos_url, ''),
+			COALESCE(r.admin_note, ''), r.refund_id, r.created_at, r.updated_at
+		FROM returns r WHERE `+where+` ORDER BY r.created_at DESC, r.id DESC `+page, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	returns := []OrderReturn{}
+	index := map[int]int{}
+	var ids []interface{}
+	for rows.Next() {
+		var (
+			rt       OrderReturn
+			refundID sql.NullInt64
+		)
+		if err := rows.Scan(&rt.ID, &rt.OrderID, &rt.UserID, &rt.Status, &rt.Reason, &rt.PhotosURL,
+			&rt.AdminNote, &refundID, &rt.CreatedAt, &rt.UpdatedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if refundID.Valid {
+			id := int(refundID.Int64)
+			rt.RefundID = &id
+		}
+		rt.Items = []ReturnItem{}
+		index[rt.ID] = len(returns)
+		ids = append(ids, rt.ID)
+		returns = append(returns, rt)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || len(ids) == 0 {
+		return returns, err
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")
+	itemRows, err := q.Query(`
+		SELECT ri.return_id, ri.order_item_id, oi.product_id, p.name, ri.quantity, oi.price
+		FROM return_items ri
+		JOIN order_items oi ON ri.order_item_id = oi.id
+		JOIN products p ON oi.product_id = p.id
+		WHERE ri.return_id IN (`+placeholders+`)
+		ORDER BY ri.id
+	`, ids...)
+	if err != nil {
+		return nil, err
+	}
+	defer itemRows.Close()
+
+	for itemRows.Next() {
+		var (
+			returnID int
+			item     ReturnItem
+		)
+		if err := itemRows.Scan(&returnID, &item.OrderItemID, &item.ProductID, &item.Name, &item.Quantity, &item.Price); err != nil {
+			return nil, err
+		}
+		i := index[returnID]
+		returns[i].Items = append(returns[i].Items, item)
+	}
+	return returns, itemRows.Err()
+}
+
+// openReturnQuantities sums, per order line, the units held by returns that
+// are still open (requested, approved or received). Callers lock the order row
+// first so the result cannot change before they act on it.
+func openReturnQuantities(q queryer, orderID int) (map[int]int, error) {
+	rows, err := q.Query(`
+		SELECT ri.order_item_id, SUM(ri.quantity)
+		FROM return_items ri
+		JOIN returns r ON ri.return_id = r.id
+		WHERE r.order_id = ? AND r.status IN ('requested', 'approved', 'received')
+		GROUP BY ri.order_item_id
+	`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	open := map[int]int{}
+	for rows.Next() {
+		var id, qty int
+		if err := rows.Scan(&id, &qty); err != nil {
+			return nil, err
+		}
+		open[id] = qty
+	}
+	return open, rows.Err()
+}
+
+// respondReturn responds with the return and its items.
+func (h *Handler) respondReturn(w http.ResponseWriter, status int, id int) {
+	returns, err := loadReturns(h.DB, "r.id = ?", "", id)
+	if err != nil || len(returns) == 0 {
+		respondError(w, http.StatusInternalServerError, "Failed to fetch return")
+		return
+	}
+	respondJSON(w, status, Response{Success: true, Data: returns[0]})
+}
+
+// CreateReturn lets the customer who placed a delivered order ask to return
+// some of its items.
+func (h *Handler) CreateReturn(w http.ResponseWriter, r *http.Request) {
+	orderID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid order ID")
+		return
+	}
+
+	var req struct {
+		Items []struct {
+			OrderItemID int `json:"order_item_id"`
+			Quantity    int `json:"quantity"`
+		} `json:"items"`
+		Reason    string `json:"reason"`
+		PhotosURL string `json:"photos_url"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	fieldErrs := map[string]string{}
+	req.Reason = strings.TrimSpace(req.Reason)
+	if req.Reason == "" {
+		fieldErrs["reason"] = "Alasan pengembalian wajib diisi"
+	}
+	req.PhotosURL = strings.TrimSpace(req.PhotosURL)
+	if req.PhotosURL != "" {
+		if u, err := url.Parse(req.PhotosURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			fieldErrs["photos_url"] = "URL foto tidak valid"
+		} else if utf8.RuneCountInString(req.PhotosURL) > maxPhotosURLLength {
+			fieldErrs["photos_url"] = fmt.Sprintf("URL foto maksimal %d karakter", maxPhotosURLLength)
+		}
+	}
+	if len(req.Items) == 0 {
+		fieldErrs["items"] = "Pilih produk yang akan dikembalikan"
+	}
+	if len(fieldErrs) > 0 {
+		respondValidationError(w, fieldErrs)
+		return
+	}
+
+	principal, _ := principalFromContext(r.Context())
+
+	tx, err := h.DB.Begin()
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	var (
+		ownerID sql.NullInt64
+		status  string
+	)
+	err = tx.QueryRow("SELECT user_id, status FROM orders WHERE id = ? FOR UPDATE", orderID).Scan(&ownerID, &status)
+	if err != nil || !ownerID.Valid || int(ownerID.Int64) != principal.UserID {
+		respondError(w, http.StatusNotFound, "Order not found")
+		return
+	}
+	if status != OrderDelivered {
+		respondError(w, http.StatusConflict, "Only delivered orders can be returned")
+		return
+	}
+
+	lines, _, err := lockOrderLines(tx, orderID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to fetch order items")
+		return
+	}
+
+	// Units already in an open return cannot be requested again
+	open, err := openReturnQuantities(tx, orderID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to check returns")
+		return
+	}
+
+	requested := map[int]int{}
+	for i, item := range req.Items {
+		requested[item.OrderItemID] += item.Quantity
+		key := fmt.Sprintf("items.%d", i)
+		l, ok := lines[item.OrderItemID]
+		if !ok {
+			fieldErrs[key] = "Produk tidak ada di pesanan ini"
+			continue
+		}
+		available := l.quantity - l.refunded - open[item.OrderItemID]
+		switch {
+		case item.Quantity <= 0:
+			fieldErrs[key] = "Jumlah tidak valid"
+		case requested[item.OrderItemID] > available:
+			fieldErrs[key] = fmt.Sprintf("Maksimal %d dapat dikembalikan", available)
+		}
+	}
+	if len(fieldErrs) > 0 {
+		respondValidationError(w, fieldErrs)
+		return
+	}
+
+	result, err := tx.Exec(
+		"INSERT INTO returns (order_id, user_id, status, reason, photos_url) VALUES (?, ?, ?, ?, NULLIF(?, ''))",
+		orderID, principal.UserID, ReturnRequested, req.Reason, req.PhotosURL,
+	)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to create return")
+		return
+	}
+	returnID, _ := result.LastInsertId()
+
+	for id, qty := range requested {
+		if _, err := tx.Exec(
+			"INSERT INTO return_items (return_id, order_item_id, quantity) VALUES (?, ?, ?)",
+			returnID, id, qty,
+		); err != nil {
+			respondError(w, http.StatusInternalServerError, "Failed to create return")
+			return
+		}
+	}
+
+	if err := notifyStaff(tx, PermOrdersUpdateStatus,
+		fmt.Sprintf("Return requested for order #%d", orderID),
+		"Reason: "+req.Reason,
+		"return",
+	); err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to create return")
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to create return")
+		return
+	}
+
+	h.respondReturn(w, http.StatusCreated, int(returnID))
+}
+
+// GetOrderReturns lists the returns of one of the authenticated user's orders.
+func (h *Handler) GetOrderReturns(w http.ResponseWriter, r *http.Request) {
+	orderID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid order ID")
+		return
+	}
+	principal, _ := principalFromContext(r.Context())
+
+	returns, err := loadReturns(h.DB, "r.order_id = ? AND r.user_id = ?", "", orderID, principal.UserID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to fetch returns")
+		return
+	}
+	respondSuccess(w, returns)
+}
+
+// GetAllReturns returns a page of returns for staff, optionally filtered by ?status=.
+func (h *Handler) GetAllReturns(w http.ResponseWriter, r *http.Request) {
+	page, limit, offset := parsePagination(r)
+
+	where := "1=1"
+	var args []interface{}
+	if status := r.URL.Query().Get("status"); status != "" {
+		if _, ok := returnTransitions[status]; !ok {
+			respondError(w, http.StatusBadRequest, "Invalid status")
+			return
+		}
+		where += " AND r.status = ?"
+		args = append(args, status)
+	}
+
+	var total int
+	if err := h.DB.QueryRow("SELECT COUNT(*) FROM returns r WHERE "+where, args...).Scan(&total); err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to count returns")
+		return
+	}
+
+	returns, err := loadReturns(h.DB, where, "LIMIT ? OFFSET ?", append(args, limit, offset)...)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to fetch returns")
+		return
+	}
+
+	respondSuccess(w, map[string]interface{}{
+		"returns": returns,
+		"page":    page,
+		"limit":   limit,
+		"total":   total,
+	})
+}
+
+// UpdateReturnStatus approves, rejects or marks a return as received. Receiving
+// a return puts its items back into stock; the customer is notified of each change.
+func (h *Handler) UpdateReturnStatus(w http.ResponseWriter, r *http.Request) {
+	returnID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid return ID")
+		return
+	}
+
+	var req struct {
+		Status string `json:"status"`
+		Note   string `json:"note"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if _, ok := returnTransitions[req.Status]; !ok || req.Status == ReturnRefunded || req.Status == ReturnRequested {
+		respondError(w, http.StatusBadRequest, "Invalid status")
+		return
+	}
+
+	principal, _ := principalFromContext(r.Context())
+
+	tx, err := h.DB.Begin()
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	var orderID int
+	err = tx.QueryRow("SELECT order_id FROM returns WHERE id = ?", returnID).Scan(&orderID)
+	if err == sql.ErrNoRows {
+		respondError(w, http.StatusNotFound, "Return not found")
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to update return")
+		return
+	}
+
+	// Lock the order before the return, in the same order as RefundReturn and
+	// RefundOrder
+	var orderStatus string
+	if err := tx.QueryRow("SELECT status FROM orders WHERE id = ? FOR UPDATE", orderID).Scan(&orderStatus); err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to update return")
+		return
+	}
+
+	var (
+		userID int
+		from   string
+	)
+	if err := tx.QueryRow(
+		"SELECT user_id, status FROM returns WHERE id = ? FOR UPDATE", returnID,
+	).Scan(&userID, &from); err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to update return")
+		return
+	}
+
+	allowed := false
+	for _, next := range returnTransitions[from] {
+		allowed = allowed || next == req.Status
+	}
+	if !allowed {
+		respondError(w, http.StatusConflict, fmt.Sprintf("Cannot change return status from %s to %s", from, req.Status))
+		return
+	}
+
+	if req.Status == ReturnReceived {
+		if _, err := tx.Exec(`
+			UPDATE products p
+			JOIN order_items oi ON oi.product_id = p.id
+			JOIN return_items ri ON ri.order_item_id = oi.id
+			SET p.stock = p.stock + ri.quantity
+			WHERE ri.return_id = ?
+		`, returnID); err != nil {
+			respondError(w, http.StatusInternalServerError, "Failed to restock items")
+			return
+		}
+	}
+
+	if _, err := tx.Exec(
+		"UPDATE returns SET status = ?, admin_note = COALESCE(NULLIF(?, ''), admin_note) WHERE id = ?",
+		req.Status, strings.TrimSpace(req.Note), returnID,
+	); err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to update return")
+		return
+	}
+
+	if _, err := tx.Exec(
+		"INSERT INTO notifications (user_id, title, body, type) VALUES (?, ?, ?, 'return')",
+		userID, fmt.Sprintf("Pengembalian pesanan #%d", orderID), returnStatusMessages[req.Status],
+	); err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to update return")
+		return
+	}
+
+	h.audit(tx, principal.UserID, "return_"+req.Status, "return", returnID, fmt.Sprintf("%s -> %s", from, req.Status))
+
+	if err := tx.Commit(); err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to update return")
+		return
+	}
+
+	h.respondReturn(w, http.StatusOK, returnID)
+}
+
+// returnStatusMessages are the customer notifications for each staff decision.
+var returnStatusMessages = map[string]string{
+	ReturnApproved: "Pengembalian disetujui. Silakan kirim produk ke alamat kami.",
+	ReturnRejected: "Pengembalian ditolak.",
+	ReturnReceived: "Produk yang dikembalikan telah kami terima. Dana akan segera dikembalikan.",
+}
+
+// RefundReturn refunds the items of a received return and marks it refunded.
+// The items were restocked on receipt, so the refund does not restock them
+// again. A gateway refund is committed as pending with the return and sent to
+// the gateway afterwards; if the gateway declines it, the return goes back to
+// received.
+func (h *Handler) RefundReturn(w http.ResponseWriter, r *http.Request) {
+	returnID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid return ID")
+		return
+	}
+	principal, _ := principalFromContext(r.Context())
+
+	tx, err := h.DB.Begin()
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	var orderID int
+	if err := tx.QueryRow("SELECT order_id FROM returns WHERE id = ?", returnID).Scan(&orderID); err != nil {
+		respondError(w, http.StatusNotFound, "Return not found")
+		return
+	}
+
+	// Lock in the same order as RefundOrder: order, lines, then the return
+	var orderStatus string
+	if err := tx.QueryRow("SELECT status FROM orders WHERE id = ? FOR UPDATE", orderID).Scan(&orderStatus); err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to refund return")
+		return
+	}
+	lines, lineIDs, err := lockOrderLines(tx, orderID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to fetch order items")
+		return
+	}
+
+	var status, reason string
+	if err := tx.QueryRow(
+		"SELECT status, reason FROM returns WHERE id = ? FOR UPDATE", returnID,
+	).Scan(&status, &reason); err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to refund return")
+		return
+	}
+	if status != ReturnReceived {
+		respondError(w, http.StatusConflict, "Only received returns can be refunded")
+		return
+	}
+
+	requested := map[int]int{}
+	rows, err := tx.Query("SELECT order_item_id, quantity FROM return_items WHERE return_id = ?", returnID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to fetch return items")
+		return
+	}
+	for rows.Next() {
+		var id, qty int
+		if err := rows.Scan(&id, &qty); err != nil {
+			rows.Close()
+			respondError(w, http.StatusInternalServerError, "Failed to fetch return items")
+			return
+		}
+		requested[id] += qty
+	}
+	rows.Close()
+
+	for id, qty := range requested {
+		if l := lines[id]; l == nil || qty > l.quantity-l.refunded {
+			respondError(w, http.StatusConflict, "Some returned items have already been refunded")
+			return
+		}
+	}
+
+	items, amount := refundItems(lines, lineIDs, requested)
+	refundID, err := h.issueRefund(tx, orderID, items, amount, fmt.Sprintf("Return #%d: %s", returnID, reason), false, principal.UserID)
+	if err != nil {
+		respondRefundError(w, err)
+		return
+	}
+
+	if _, err := tx.Exec(
+		"UPDATE returns SET status = ?, refund_id = ? WHERE id = ?", ReturnRefunded, refundID, returnID,
+	); err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to refund return")
+		return
+	}
+
+	// The customer is notified once the gateway has completed the refund
+	if err := tx.Commit(); err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to refund return")
+		return
+	}
+
+	code := http.StatusOK
+	switch h.completeRefund(refundID) {
+	case RefundFailed:
+		respondRefundError(w, errRefundGateway)
+		return
+	case RefundPending:
+		code = http.StatusAccepted
+	}
+	h.respondReturn(w, code, returnID)
+}
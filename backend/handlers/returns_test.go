@@ -0,0 +1,250 @@
+package handlers
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// onReturns answers the return statements of the handlers on f from s, on
+// top of those newRefundState already answers.
+func (s *refundState) onReturns(f *fakeDB) {
+	lookup := func(v driver.Value) *testReturn { return s.returns[int(v.(int64))] }
+
+	f.on("SELECT user_id, status FROM orders WHERE id = ? FOR UPDATE", func([]driver.Value) fakeResult {
+		return row(int64(2), s.orderStatus)
+	})
+	f.on("INSERT INTO returns", func(args []driver.Value) fakeResult {
+		id := len(s.returns) + 1
+		s.returns[id] = &testReturn{userID: int(args[1].(int64)), status: args[2].(string), items: map[int]int{}}
+		return fakeResult{affected: 1, lastID: int64(id)}
+	})
+	f.on("INSERT INTO return_items", func(args []driver.Value) fakeResult {
+		lookup(args[0]).items[int(args[1].(int64))] += int(args[2].(int64))
+		return fakeResult{affected: 1}
+	})
+	f.on("SELECT user_id, status FROM returns WHERE id = ? FOR UPDATE", func(args []driver.Value) fakeResult {
+		rt := lookup(args[0])
+		return row(int64(rt.userID), rt.status)
+	})
+	f.on("SELECT order_id FROM returns WHERE id = ?", func(args []driver.Value) fakeResult {
+		if lookup(args[0]) == nil {
+			return fakeResult{}
+		}
+		return row(int64(1))
+	})
+	f.on("SELECT status, reason FROM returns WHERE id = ? FOR UPDATE", func(args []driver.Value) fakeResult {
+		return row(lookup(args[0]).status, "Rusak")
+	})
+	f.on("SELECT order_item_id, quantity FROM return_items WHERE return_id = ?", func(args []driver.Value) fakeResult {
+		res := fakeResult{columns: make([]string, 2)}
+		for id, qty := range lookup(args[0]).items {
+			res.rows = append(res.rows, []driver.Value{int64(id), int64(qty)})
+		}
+		return res
+	})
+	f.on("SET p.stock = p.stock + ri.quantity", func(args []driver.Value) fakeResult {
+		for id, qty := range lookup(args[0]).items {
+			s.stock[s.lines[id].productID] += qty
+		}
+		return fakeResult{affected: 1}
+	})
+	f.on("UPDATE returns SET status = ?, admin_note", func(args []driver.Value) fakeResult {
+		lookup(args[2]).status = args[0].(string)
+		return fakeResult{affected: 1}
+	})
+	f.on("UPDATE returns SET status = ?, refund_id = ? WHERE id = ?", func(args []driver.Value) fakeResult {
+		rt := lookup(args[2])
+		rt.status = args[0].(string)
+		rt.refundID = int(args[1].(int64))
+		return fakeResult{affected: 1}
+	})
+	f.on("FROM returns r WHERE r.id = ?", func(args []driver.Value) fakeResult {
+		rt := lookup(args[0])
+		var refundID driver.Value
+		if rt.refundID != 0 {
+			refundID = int64(rt.refundID)
+		}
+		return row(args[0], int64(1), int64(rt.userID), rt.status, "Rusak", "", "", refundID,
+			"2026-01-01 00:00:00", "2026-01-01 00:00:00")
+	})
+}
+
+// returnRequest sends body to handler for return id as order staff.
+func returnRequest(handler http.HandlerFunc, id int, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/api/admin/returns/"+strconv.Itoa(id), strings.NewReader(body))
+	req = mux.SetURLVars(req, map[string]string{"id": strconv.Itoa(id)})
+	req = req.WithContext(withPrincipal(req.Context(), Principal{UserID: 1, Role: RoleAdmin}))
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	return rec
+}
+
+func TestCreateReturnLimits(t *testing.T) {
+	db, f := newFakeDB(t)
+	h := NewHandler(db, Config{PaymentGateway: &stubGateway{}})
+	s := newRefundState(f, OrderDelivered)
+	s.onReturns(f)
+	s.addLine(11, 101, 3, 100)
+	s.lines[11].refunded = 1
+
+	create := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/orders/1/returns", strings.NewReader(body))
+		req = mux.SetURLVars(req, map[string]string{"id": "1"})
+		req = req.WithContext(withPrincipal(req.Context(), Principal{UserID: 2, Role: RoleUser}))
+		rec := httptest.NewRecorder()
+		h.CreateReturn(rec, req)
+		return rec
+	}
+
+	// One of three units is refunded, so two can be returned
+	if rec := create(`{"reason":"Rusak","items":[{"order_item_id":11,"quantity":3}]}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("return beyond the unrefunded units: status %d: %s", rec.Code, rec.Body)
+	}
+	if rec := create(`{"reason":"Rusak","items":[{"order_item_id":11,"quantity":2}]}`); rec.Code != http.StatusCreated {
+		t.Fatalf("return: status %d: %s", rec.Code, rec.Body)
+	}
+	if rt := s.returns[1]; rt == nil || rt.status != ReturnRequested || rt.items[11] != 2 {
+		t.Fatalf("return %+v, want 2 units of line 11 requested", rt)
+	}
+	if s.staff != 1 {
+		t.Errorf("%d staff notifications, want 1", s.staff)
+	}
+
+	// Those units are now in an open return
+	if rec := create(`{"reason":"Rusak","items":[{"order_item_id":11,"quantity":1}]}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("second return of the same units: status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+
+	s.orderStatus = OrderShipped
+	if rec := create(`{"reason":"Rusak","items":[{"order_item_id":11,"quantity":1}]}`); rec.Code != http.StatusConflict {
+		t.Errorf("return of an undelivered order: status %d, want %d", rec.Code, http.StatusConflict)
+	}
+}
+
+func TestReturnWorkflow(t *testing.T) {
+	db, f := newFakeDB(t)
+	gateway := &stubGateway{}
+	h := NewHandler(db, Config{PaymentGateway: gateway})
+	s := newRefundState(f, OrderDelivered)
+	s.onReturns(f)
+	s.addLine(11, 101, 3, 100)
+	s.paid, s.paymentAmount = true, 300
+	s.returns[7] = &testReturn{userID: 2, status: ReturnRequested, items: map[int]int{11: 2}}
+
+	setStatus := func(status string) *httptest.ResponseRecorder {
+		return returnRequest(h.UpdateReturnStatus, 7, `{"status":"`+status+`"}`)
+	}
+
+	if rec := setStatus(ReturnReceived); rec.Code != http.StatusConflict {
+		t.Fatalf("receive before approval: status %d, want %d", rec.Code, http.StatusConflict)
+	}
+	if rec := returnRequest(h.RefundReturn, 7, `{}`); rec.Code != http.StatusConflict {
+		t.Fatalf("refund before receipt: status %d, want %d", rec.Code, http.StatusConflict)
+	}
+	if rec := setStatus(ReturnRefunded); rec.Code != http.StatusBadRequest {
+		t.Fatalf("setting refunded directly: status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+
+	// Units in the open return cannot be refunded directly; full skips them
+	if rec := refundRequestFor(h, `{"items":[{"order_item_id":11,"quantity":2}]}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("direct refund of returned units: status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+
+	if rec := setStatus(ReturnApproved); rec.Code != http.StatusOK {
+		t.Fatalf("approve: status %d: %s", rec.Code, rec.Body)
+	}
+	if rec := setStatus(ReturnReceived); rec.Code != http.StatusOK {
+		t.Fatalf("receive: status %d: %s", rec.Code, rec.Body)
+	}
+	if s.stock[101] != 2 {
+		t.Fatalf("receiving restocked %d units, want 2", s.stock[101])
+	}
+	if s.customer != 2 {
+		t.Errorf("%d customer notifications after approve and receive, want 2", s.customer)
+	}
+
+	rec := returnRequest(h.RefundReturn, 7, `{}`)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"refund_id":1`) {
+		t.Fatalf("refund: status %d: %s", rec.Code, rec.Body)
+	}
+	if rt := s.returns[7]; rt.status != ReturnRefunded || rt.refundID != 1 {
+		t.Errorf("return %+v, want refunded with refund 1", rt)
+	}
+	if rf := s.refunds[0]; rf.status != RefundCompleted || rf.amount != 200 || rf.restocked {
+		t.Errorf("refund %+v, want 200 completed without restocking", rf)
+	}
+	if s.stock[101] != 2 || s.lines[11].refunded != 2 || s.paymentRefunded != 200 {
+		t.Errorf("after refund: stock %v, line refunded %d, payment refunded %.2f", s.stock, s.lines[11].refunded, s.paymentRefunded)
+	}
+	if s.customer != 3 {
+		t.Errorf("%d customer notifications after the refund, want 3", s.customer)
+	}
+
+	if rec := returnRequest(h.RefundReturn, 7, `{}`); rec.Code != http.StatusConflict {
+		t.Errorf("second refund of the return: status %d, want %d", rec.Code, http.StatusConflict)
+	}
+}
+
+// TestUpdateReturnStatusLockOrder checks that the order is locked before the
+// return, as RefundReturn and RefundOrder do, so they cannot deadlock.
+func TestUpdateReturnStatusLockOrder(t *testing.T) {
+	db, f := newFakeDB(t)
+	h := NewHandler(db, Config{})
+
+	var locks []string
+	f.on("SELECT order_id FROM returns WHERE id = ?", func([]driver.Value) fakeResult {
+		return row(int64(1))
+	})
+	f.on("SELECT status FROM orders WHERE id = ? FOR UPDATE", func([]driver.Value) fakeResult {
+		locks = append(locks, "order")
+		return row(OrderDelivered)
+	})
+	f.on("SELECT user_id, status FROM returns WHERE id = ? FOR UPDATE", func([]driver.Value) fakeResult {
+		locks = append(locks, "return")
+		return row(int64(2), ReturnRequested)
+	})
+
+	returnRequest(h.UpdateReturnStatus, 7, `{"status":"approved"}`)
+	if !reflect.DeepEqual(locks, []string{"order", "return"}) {
+		t.Errorf("locked %v, want the order before the return", locks)
+	}
+}
+
+func TestRefundReturnDeclined(t *testing.T) {
+	db, f := newFakeDB(t)
+	gateway := &stubGateway{err: errChargeNotFound}
+	h := NewHandler(db, Config{PaymentGateway: gateway})
+	s := newRefundState(f, OrderDelivered)
+	s.onReturns(f)
+	s.addLine(11, 101, 1, 100)
+	s.paid, s.paymentAmount = true, 100
+	s.returns[7] = &testReturn{userID: 2, status: ReturnReceived, items: map[int]int{11: 1}}
+
+	if rec := returnRequest(h.RefundReturn, 7, `{}`); rec.Code != http.StatusBadGateway {
+		t.Fatalf("status %d, want %d: %s", rec.Code, http.StatusBadGateway, rec.Body)
+	}
+	if rt := s.returns[7]; rt.status != ReturnReceived || rt.refundID != 0 {
+		t.Errorf("return %+v, want it received again without a refund", rt)
+	}
+	if s.lines[11].refunded != 0 || s.orderRefunded != 0 {
+		t.Errorf("declined refund kept %d units and %.2f", s.lines[11].refunded, s.orderRefunded)
+	}
+	if s.customer != 0 || s.staff != 1 {
+		t.Errorf("%d customer and %d staff notifications, want 0 and 1", s.customer, s.staff)
+	}
+
+	gateway.err = nil
+	if rec := returnRequest(h.RefundReturn, 7, `{}`); rec.Code != http.StatusOK {
+		t.Fatalf("refund after the decline: status %d: %s", rec.Code, rec.Body)
+	}
+	if s.returns[7].status != ReturnRefunded || s.refunds[1].status != RefundCompleted {
+		t.Errorf("return %+v, refund %+v after the retry", s.returns[7], s.refunds[1])
+	}
+}
@@ -0,0 +1,110 @@
+package handlers
+
+import "github.com/gorilla/mux"
+
+// NewRouter registers the API routes served by h.
+func NewRouter(h *Handler) *mux.Router {
+	r := mux.NewRouter()
+
+	// API routes
+	api := r.PathPrefix("/api").Subrouter()
+
+	// Auth
+	api.HandleFunc("/auth/login", h.Login).Methods("POST")
+	api.HandleFunc("/auth/register", h.Register).Methods("POST")
+	api.HandleFunc("/auth/password-reset/request", h.RequestPasswordReset).Methods("POST")
+	api.HandleFunc("/auth/password-reset/confirm", h.ConfirmPasswordReset).Methods("POST")
+	api.HandleFunc("/auth/verify-email", h.VerifyEmail).Methods("POST")
+	api.HandleFunc("/auth/verify-email/resend", h.RequireAuth(h.ResendEmailVerification)).Methods("POST")
+	api.HandleFunc("/auth/2fa/verify", h.VerifyTwoFactorLogin).Methods("POST")
+	api.HandleFunc("/auth/2fa/setup", h.RequireAuth(h.SetupTwoFactor)).Methods("POST")
+	api.HandleFunc("/auth/2fa/confirm", h.RequireAuth(h.ConfirmTwoFactor)).Methods("POST")
+	api.HandleFunc("/auth/2fa/recovery-codes", h.RequireAuth(h.RegenerateRecoveryCodes)).Methods("POST")
+	api.HandleFunc("/auth/2fa/disable", h.RequireAuth(h.DisableTwoFactor)).Methods("POST")
+	api.HandleFunc("/auth/refresh", h.RefreshSession).Methods("POST")
+	api.HandleFunc("/auth/logout", h.Logout).Methods("POST")
+	api.HandleFunc("/auth/logout-all", h.RequireAuth(h.LogoutAll)).Methods("POST")
+
+	// Categories
+	api.HandleFunc("/categories", h.GetCategories).Methods("GET")
+	api.HandleFunc("/categories/{id}", h.GetCategoryByID).Methods("GET")
+
+	// Products (read-only for customers)
+	api.HandleFunc("/products", h.GetProducts).Methods("GET")
+	api.HandleFunc("/products/{id}", h.GetProductByID).Methods("GET")
+	api.HandleFunc("/products/category/{categoryId}", h.GetProductsByCategory).Methods("GET")
+
+	// Guest cart (identified by the X-Cart-Token header)
+	api.HandleFunc("/guest-cart", h.GetGuestCart).Methods("GET")
+	api.HandleFunc("/guest-cart", h.ClearGuestCart).Methods("DELETE")
+	api.HandleFunc("/guest-cart/items", h.AddGuestCartItem).Methods("POST")
+	api.HandleFunc("/guest-cart/items/{productId}", h.UpdateGuestCartItem).Methods("PUT")
+	api.HandleFunc("/guest-cart/items/{productId}", h.RemoveGuestCartItem).Methods("DELETE")
+
+	// Orders
+	api.HandleFunc("/orders", h.RequireAuth(h.GetOrders)).Methods("GET")
+	api.HandleFunc("/orders", h.RequireVerified(h.Idempotent(h.CreateOrder))).Methods("POST")
+	api.HandleFunc("/checkout", h.RequireVerified(h.Idempotent(h.Checkout))).Methods("POST")
+	api.HandleFunc("/orders/{id}", h.RequireAuth(h.GetOrderByID)).Methods("GET")
+	api.HandleFunc("/orders/{id}/cancel", h.RequireAuth(h.CancelOrder)).Methods("POST")
+
+	// Payments
+	api.HandleFunc("/orders/{id}/payments", h.RequireAuth(h.Idempotent(h.CreatePayment))).Methods("POST")
+	api.HandleFunc("/orders/{id}/payments", h.RequireAuth(h.GetOrderPayments)).Methods("GET")
+	api.HandleFunc("/payments/webhook", h.PaymentWebhook).Methods("POST")
+	api.HandleFunc("/payments/{id}", h.RequireAuth(h.GetPayment)).Methods("GET")
+
+	// Returns
+	api.HandleFunc("/orders/{id}/returns", h.RequireAuth(h.CreateReturn)).Methods("POST")
+	api.HandleFunc("/orders/{id}/returns", h.RequireAuth(h.GetOrderReturns)).Methods("GET")
+
+	// User scoped routes
+	userRoutes := api.PathPrefix("/users/{userId}").Subrouter()
+	userRoutes.Use(h.AuthMiddleware, h.OwnerMiddleware)
+	userRoutes.HandleFunc("/addresses", h.GetAddresses).Methods("GET")
+	userRoutes.HandleFunc("/addresses", h.CreateAddress).Methods("POST")
+	userRoutes.HandleFunc("/notifications", h.GetNotifications).Methods("GET")
+	userRoutes.HandleFunc("/notifications/{notificationId}/read", h.MarkNotificationRead).Methods("PUT")
+	userRoutes.HandleFunc("/profile", h.UpdateProfile).Methods("PUT")
+	userRoutes.HandleFunc("/cart", h.GetCart).Methods("GET")
+	userRoutes.HandleFunc("/cart", h.ClearCart).Methods("DELETE")
+	userRoutes.HandleFunc("/cart/items", h.AddCartItem).Methods("POST")
+	userRoutes.HandleFunc("/cart/items/{productId}", h.UpdateCartItem).Methods("PUT")
+	userRoutes.HandleFunc("/cart/items/{productId}", h.RemoveCartItem).Methods("DELETE")
+	userRoutes.HandleFunc("/orders", h.GetUserOrders).Methods("GET")
+
+	// Admin routes (protected)
+	admin := api.PathPrefix("/admin").Subrouter()
+
+	// Admin - Products
+	admin.HandleFunc("/products", h.RequirePermission(PermProductsRead)(h.GetAllProducts)).Methods("GET")
+	admin.HandleFunc("/products", h.RequirePermission(PermProductsWrite)(h.CreateProduct)).Methods("POST")
+	admin.HandleFunc("/products/{id}", h.RequirePermission(PermProductsWrite)(h.UpdateProduct)).Methods("PUT")
+	admin.HandleFunc("/products/{id}", h.RequirePermission(PermProductsDelete)(h.DeleteProduct)).Methods("DELETE")
+
+	// Admin - Orders
+	admin.HandleFunc("/orders", h.RequirePermission(PermOrdersRead)(h.GetAllOrders)).Methods("GET")
+	admin.HandleFunc("/orders/{id}", h.RequirePermission(PermOrdersRead)(h.GetOrderDetails)).Methods("GET")
+	admin.HandleFunc("/orders/{id}/status", h.RequirePermission(PermOrdersUpdateStatus)(h.UpdateOrderStatus)).Methods("PUT")
+	admin.HandleFunc("/orders/{id}/refunds", h.RequirePermission(PermOrdersRefund)(h.RefundOrder)).Methods("POST")
+
+	// Admin - Returns
+	admin.HandleFunc("/returns", h.RequirePermission(PermOrdersRead)(h.GetAllReturns)).Methods("GET")
+	admin.HandleFunc("/returns/{id}/status", h.RequirePermission(PermOrdersUpdateStatus)(h.UpdateReturnStatus)).Methods("PUT")
+	admin.HandleFunc("/returns/{id}/refund", h.RequirePermission(PermOrdersRefund)(h.RefundReturn)).Methods("POST")
+
+	// Admin - Dashboard
+	admin.HandleFunc("/dashboard/stats", h.RequirePermission(PermDashboardView)(h.GetDashboardStats)).Methods("GET")
+
+	// Admin - Users
+	admin.HandleFunc("/users", h.RequirePermission(PermUsersRead)(h.GetUsers)).Methods("GET")
+	admin.HandleFunc("/users/{id}", h.RequirePermission(PermUsersRead)(h.GetUserDetails)).Methods("GET")
+	admin.HandleFunc("/users/{id}/status", h.RequirePermission(PermUsersManage)(h.UpdateUserStatus)).Methods("PUT")
+	admin.HandleFunc("/users/{id}/force-password-reset", h.RequirePermission(PermUsersManage)(h.ForcePasswordReset)).Methods("POST")
+
+	// Admin - Roles
+	admin.HandleFunc("/roles", h.RequirePermission(PermRolesAssign)(h.GetRoles)).Methods("GET")
+	admin.HandleFunc("/users/{id}/role", h.RequirePermission(PermRolesAssign)(h.AssignRole)).Methods("PUT")
+
+	return r
+}
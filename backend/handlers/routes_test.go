@@ -0,0 +1,243 @@
+package handlers
+
+import (
+	"database/sql/driver"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testUser is a users row as seen by the access checks.
+type testUser struct {
+	role      string
+	active    bool
+	twoFactor bool
+	// passwordChangedAt is users.password_changed_at; zero means never changed.
+	passwordChangedAt time.Time
+}
+
+// newTestRouter returns the API router backed by a fakeDB that answers the
+// active and role lookups of the access checks from users.
+func newTestRouter(t *testing.T, users map[int]testUser) (*Handler, http.Handler) {
+	t.Helper()
+	db, f := newFakeDB(t)
+	f.on("SELECT u.role, u.is_active, t.enabled_at IS NOT NULL", func(args []driver.Value) fakeResult {
+		u, ok := users[int(args[0].(int64))]
+		if !ok {
+			return fakeResult{}
+		}
+		active := int64(0)
+		if u.active {
+			active = 1
+		}
+		return row(u.role, active, u.twoFactor)
+	})
+	f.on("SELECT is_active, UNIX_TIMESTAMP(password_changed_at) FROM users WHERE id = ?", func(args []driver.Value) fakeResult {
+		u, ok := users[int(args[0].(int64))]
+		if !ok {
+			return fakeResult{}
+		}
+		var changedAt driver.Value
+		if !u.passwordChangedAt.IsZero() {
+			changedAt = u.passwordChangedAt.Unix()
+		}
+		return row(u.active, changedAt)
+	})
+
+	h := NewHandler(db, Config{
+		TokenSecret:      []byte("test-secret"),
+		AccessTokenTTL:   time.Hour,
+		Mailer:           &WriterMailer{W: io.Discard},
+		TwoFactorRoles:   map[string]bool{RoleSuperAdmin: true},
+		UnverifiedAccess: UnverifiedAccessBrowse,
+	})
+	return h, NewRouter(h)
+}
+
+// testToken issues an access token for the user through h.
+func testToken(t *testing.T, h *Handler, userID int, role string) string {
+	t.Helper()
+	token, _, err := h.issueAccessToken(userID, role)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// TestUserRoutesAccess checks who may call each /users/{userId} route: the
+// user themselves, staff with users:read for reads and users:manage for
+// changes, and nobody else.
+func TestUserRoutesAccess(t *testing.T) {
+	const (
+		owner       = 2
+		otherUser   = 3
+		support     = 10 // users:read only
+		fulfillment = 11 // no user permissions
+		admin       = 12 // users:read and users:manage
+		inactive    = 13 // admin who has been deactivated
+		superAdmin  = 14 // role that must use 2FA, not enrolled
+		superAdmin2 = 15 // role that must use 2FA, enrolled
+	)
+	h, router := newTestRouter(t, map[int]testUser{
+		owner:       {role: RoleUser, active: true},
+		otherUser:   {role: RoleUser, active: true},
+		support:     {role: RoleSupport, active: true},
+		fulfillment: {role: RoleFulfillment, active: true},
+		admin:       {role: RoleAdmin, active: true},
+		inactive:    {role: RoleAdmin, active: false},
+		superAdmin:  {role: RoleSuperAdmin, active: true},
+		superAdmin2: {role: RoleSuperAdmin, active: true, twoFactor: true},
+	})
+
+	routes := []struct {
+		method, path, body string
+	}{
+		{"GET", "/addresses", ""},
+		{"POST", "/addresses", `{}`},
+		{"GET", "/notifications", ""},
+		{"PUT", "/notifications/1/read", ""},
+		{"PUT", "/profile", `{}`},
+		{"GET", "/cart", ""},
+		{"DELETE", "/cart", ""},
+		{"POST", "/cart/items", `{}`},
+		{"PUT", "/cart/items/1", `{}`},
+		{"DELETE", "/cart/items/1", ""},
+		{"GET", "/orders", ""},
+	}
+
+	callers := []struct {
+		name   string
+		userID int
+		role   string
+		// wantRead and wantWrite are the outcomes for GET and other methods: 0 means the
+		// request reaches the handler, otherwise the status of the refusal.
+		wantRead, wantWrite int
+	}{
+		{"owner", owner, RoleUser, 0, 0},
+		{"other user", otherUser, RoleUser, http.StatusForbidden, http.StatusForbidden},
+		{"support staff", support, RoleSupport, 0, http.StatusForbidden},
+		{"fulfillment staff", fulfillment, RoleFulfillment, http.StatusForbidden, http.StatusForbidden},
+		{"admin", admin, RoleAdmin, 0, 0},
+		{"deactivated admin", inactive, RoleAdmin, http.StatusUnauthorized, http.StatusUnauthorized},
+		{"super admin without 2FA", superAdmin, RoleSuperAdmin, http.StatusForbidden, http.StatusForbidden},
+		{"super admin with 2FA", superAdmin2, RoleSuperAdmin, 0, 0},
+		{"anonymous", 0, "", http.StatusUnauthorized, http.StatusUnauthorized},
+	}
+
+	for _, route := range routes {
+		for _, caller := range callers {
+			t.Run(route.method+" "+route.path+"/"+caller.name, func(t *testing.T) {
+				var body io.Reader
+				if route.body != "" {
+					body = strings.NewReader(route.body)
+				}
+				req := httptest.NewRequest(route.method, "/api/users/"+strconv.Itoa(owner)+route.path, body)
+				if caller.userID != 0 {
+					req.Header.Set("Authorization", "Bearer "+testToken(t, h, caller.userID, caller.role))
+				}
+				rec := httptest.NewRecorder()
+				router.ServeHTTP(rec, req)
+
+				want := caller.wantWrite
+				if route.method == http.MethodGet {
+					want = caller.wantRead
+				}
+				got := rec.Code
+				if want == 0 {
+					// Handlers answer in JSON; mux's own 404/405 pages do not
+					routed := strings.HasPrefix(rec.Header().Get("Content-Type"), "application/json")
+					if got == http.StatusUnauthorized || got == http.StatusForbidden || !routed {
+						t.Fatalf("status %d, want the request to reach the handler: %s", got, rec.Body)
+					}
+					return
+				}
+				if got != want {
+					t.Fatalf("status %d, want %d: %s", got, want, rec.Body)
+				}
+			})
+		}
+	}
+}
+
+// TestUserRoutesInvalidToken checks that a token with a tampered signature is refused.
+func TestUserRoutesInvalidToken(t *testing.T) {
+	h, router := newTestRouter(t, map[int]testUser{2: {role: RoleUser, active: true}})
+
+	token := testToken(t, h, 2, RoleUser)
+	req := httptest.NewRequest("GET", "/api/users/2/cart", nil)
+	req.Header.Set("Authorization", "Bearer "+token[:len(token)-2]+"xx")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("status %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+}
+
+// TestDeactivatedUserRefused checks that a deactivated user's access token stops
+// working before it expires.
+func TestDeactivatedUserRefused(t *testing.T) {
+	h, router := newTestRouter(t, map[int]testUser{2: {role: RoleUser, active: false}})
+
+	req := httptest.NewRequest("GET", "/api/users/2/cart", nil)
+	req.Header.Set("Authorization", "Bearer "+testToken(t, h, 2, RoleUser))
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("status %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+}
+
+// TestPasswordChangeRevokesAccessTokens checks that access tokens issued before
+// or in the same second as the last password change are refused, while those
+// issued since still work.
+func TestPasswordChangeRevokesAccessTokens(t *testing.T) {
+	users := map[int]testUser{2: {role: RoleUser, active: true, passwordChangedAt: time.Now().Add(-time.Minute)}}
+	h, router := newTestRouter(t, users)
+	token := testToken(t, h, 2, RoleUser)
+
+	get := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/users/2/cart", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := get(); rec.Code == http.StatusUnauthorized {
+		t.Fatalf("token issued after the change refused: %s", rec.Body)
+	}
+
+	users[2] = testUser{role: RoleUser, active: true, passwordChangedAt: time.Now().Add(time.Second)}
+	if rec := get(); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("token issued before the change: status %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+
+	principal, err := h.parseAccessToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users[2] = testUser{role: RoleUser, active: true, passwordChangedAt: principal.IssuedAt}
+	if rec := get(); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("token issued in the second of the change: status %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+}
+
+// TestOrderRouteRequiresAuth checks that POST /api/orders is refused without a
+// token, so no order is placed that nobody can pay for or look up.
+func TestOrderRouteRequiresAuth(t *testing.T) {
+	_, router := newTestRouter(t, nil)
+
+	req := httptest.NewRequest("POST", "/api/orders", strings.NewReader(`{}`))
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("status %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+}
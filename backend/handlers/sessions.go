@@ -0,0 +1,175 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+)
+
+type refreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// newSession issues an access token and stores a fresh refresh token in the given family.
+// An empty familyID starts a new family, i.e. a new login on a device.
+func (h *Handler) newSession(q execer, user User, familyID string) (authResponse, error) {
+	accessToken, expiresAt, err := h.issueAccessToken(user.ID, user.Role)
+	if err != nil {
+		return authResponse{}, err
+	}
+
+	if familyID == "" {
+		if familyID, err = randomToken(16); err != nil {
+			return authResponse{}, err
+		}
+	}
+
+	refreshToken, err := randomToken(32)
+	if err != nil {
+		return authResponse{}, err
+	}
+
+	_, err = q.Exec(
+		"INSERT INTO refresh_tokens (user_id, family_id, token_hash, expires_at) VALUES (?, ?, ?, NOW() + INTERVAL ? SECOND)",
+		user.ID, familyID, hashToken(refreshToken), int(h.Config.RefreshTokenTTL.Seconds()),
+	)
+	if err != nil {
+		return authResponse{}, err
+	}
+
+	return authResponse{
+		User:         user,
+		AccessToken:  accessToken,
+		TokenType:    "Bearer",
+		ExpiresAt:    expiresAt,
+		RefreshToken: refreshToken,
+	}, nil
+}
+
+// revokeUserSessions revokes every outstanding refresh token of a user.
+func revokeUserSessions(q execer, userID int) error {
+	_, err := q.Exec(
+		"UPDATE refresh_tokens SET revoked_at = NOW() WHERE user_id = ? AND revoked_at IS NULL",
+		userID,
+	)
+	return err
+}
+
+// RefreshSession exchanges a refresh token for a new token pair. Every refresh token
+// is single-use; presenting one that was already rotated revokes its whole family.
+func (h *Handler) RefreshSession(w http.ResponseWriter, r *http.Request) {
+	var req refreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+		respondError(w, http.StatusBadRequest, "Refresh token wajib diisi")
+		return
+	}
+
+	tx, err := h.DB.Begin()
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Gagal memulai transaksi")
+		return
+	}
+	defer tx.Rollback()
+
+	var (
+		tokenID   int
+		familyID  string
+		expired   bool
+		revokedAt sql.NullTime
+		user      User
+		isActive  int
+	)
+	err = tx.QueryRow(`
+		SELECT rt.id, rt.family_id, rt.expires_at <= NOW(), rt.revoked_at,
+		       u.id, u.email, u.full_name, u.role, u.email_verified_at IS NOT NULL, u.is_active
+		FROM refresh_tokens rt
+		JOIN users u ON rt.user_id = u.id
+		WHERE rt.token_hash = ?
+		FOR UPDATE
+	`, hashToken(req.RefreshToken)).Scan(&tokenID, &familyID, &expired, &revokedAt,
+		&user.ID, &user.Email, &user.FullName, &user.Role, &user.EmailVerified, &isActive)
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, "Sesi tidak valid")
+		return
+	}
+
+	if revokedAt.Valid {
+		// Reuse of a rotated token means it leaked; kill every token descended from the same login.
+		if _, err := tx.Exec(
+			"UPDATE refresh_tokens SET revoked_at = NOW() WHERE family_id = ? AND revoked_at IS NULL",
+			familyID,
+		); err == nil {
+			tx.Commit()
+		}
+		respondError(w, http.StatusUnauthorized, "Sesi tidak valid")
+		return
+	}
+
+	if expired {
+		respondError(w, http.StatusUnauthorized, "Sesi telah berakhir")
+		return
+	}
+
+	if isActive == 0 {
+		respondError(w, http.StatusForbidden, "Akun tidak aktif")
+		return
+	}
+
+	if _, err := tx.Exec("UPDATE refresh_tokens SET revoked_at = NOW() WHERE id = ?", tokenID); err != nil {
+		respondError(w, http.StatusInternalServerError, "Gagal memperbarui sesi")
+		return
+	}
+
+	session, err := h.newSession(tx, user, familyID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Gagal memperbarui sesi")
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		respondError(w, http.StatusInternalServerError, "Gagal memperbarui sesi")
+		return
+	}
+
+	respondSuccess(w, session)
+}
+
+// Logout revokes the session (token family) the given refresh token belongs to.
+func (h *Handler) Logout(w http.ResponseWriter, r *http.Request) {
+	var req refreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+		respondError(w, http.StatusBadRequest, "Refresh token wajib diisi")
+		return
+	}
+
+	_, err := h.DB.Exec(`
+		UPDATE refresh_tokens rt
+		JOIN refresh_tokens cur ON cur.family_id = rt.family_id
+		SET rt.revoked_at = NOW()
+		WHERE cur.token_hash = ? AND rt.revoked_at IS NULL
+	`, hashToken(req.RefreshToken))
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Gagal logout")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, Response{
+		Success: true,
+		Message: "Berhasil logout",
+	})
+}
+
+// LogoutAll revokes every session of the authenticated user.
+func (h *Handler) LogoutAll(w http.ResponseWriter, r *http.Request) {
+	principal, _ := principalFromContext(r.Context())
+
+	if err := revokeUserSessions(h.DB, principal.UserID); err != nil {
+		respondError(w, http.StatusInternalServerError, "Gagal logout")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, Response{
+		Success: true,
+		Message: "Berhasil logout dari semua perangkat",
+	})
+}
@@ -0,0 +1,252 @@
+package handlers
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testRefreshToken is a refresh_tokens row on a fakeDB.
+type testRefreshToken struct {
+	id      int
+	userID  int
+	family  string
+	expired bool
+	revoked bool
+}
+
+// sessionState models the refresh_tokens table on a fakeDB, keyed by token hash.
+type sessionState struct {
+	tokens map[string]*testRefreshToken
+	active bool
+}
+
+func newSessionState(f *fakeDB) *sessionState {
+	s := &sessionState{tokens: map[string]*testRefreshToken{}, active: true}
+
+	f.on("INSERT INTO refresh_tokens", func(args []driver.Value) fakeResult {
+		s.tokens[args[2].(string)] = &testRefreshToken{
+			id:     len(s.tokens) + 1,
+			userID: int(args[0].(int64)),
+			family: args[1].(string),
+		}
+		return fakeResult{affected: 1}
+	})
+	f.on("FROM refresh_tokens rt JOIN users u", func(args []driver.Value) fakeResult {
+		rt, ok := s.tokens[args[0].(string)]
+		if !ok {
+			return fakeResult{}
+		}
+		return s.refreshRow(rt)
+	})
+	f.on("UPDATE refresh_tokens SET revoked_at = NOW() WHERE id = ?", func(args []driver.Value) fakeResult {
+		for _, rt := range s.tokens {
+			if rt.id == int(args[0].(int64)) {
+				rt.revoked = true
+			}
+		}
+		return fakeResult{affected: 1}
+	})
+	f.on("UPDATE refresh_tokens SET revoked_at = NOW() WHERE family_id = ?", func(args []driver.Value) fakeResult {
+		return s.revoke(func(rt *testRefreshToken) bool { return rt.family == args[0].(string) })
+	})
+	f.on("JOIN refresh_tokens cur ON cur.family_id = rt.family_id", func(args []driver.Value) fakeResult {
+		cur, ok := s.tokens[args[0].(string)]
+		if !ok {
+			return fakeResult{}
+		}
+		return s.revoke(func(rt *testRefreshToken) bool { return rt.family == cur.family })
+	})
+	f.on("UPDATE refresh_tokens SET revoked_at = NOW() WHERE user_id = ?", func(args []driver.Value) fakeResult {
+		return s.revoke(func(rt *testRefreshToken) bool { return rt.userID == int(args[0].(int64)) })
+	})
+	return s
+}
+
+// refreshRow is the row RefreshSession selects for rt and its user.
+func (s *sessionState) refreshRow(rt *testRefreshToken) fakeResult {
+	var revokedAt driver.Value
+	if rt.revoked {
+		revokedAt = time.Now()
+	}
+	active := int64(0)
+	if s.active {
+		active = 1
+	}
+	return row(int64(rt.id), rt.family, rt.expired, revokedAt,
+		int64(rt.userID), "user@example.com", "Test User", "user", true, active)
+}
+
+func (s *sessionState) revoke(match func(rt *testRefreshToken) bool) fakeResult {
+	n := int64(0)
+	for _, rt := range s.tokens {
+		if match(rt) && !rt.revoked {
+			rt.revoked = true
+			n++
+		}
+	}
+	return fakeResult{affected: n}
+}
+
+// live counts the tokens of family that are not revoked.
+func (s *sessionState) live(family string) int {
+	n := 0
+	for _, rt := range s.tokens {
+		if rt.family == family && !rt.revoked {
+			n++
+		}
+	}
+	return n
+}
+
+func newSessionHandler(t *testing.T) (*Handler, *sessionState) {
+	t.Helper()
+	db, f := newFakeDB(t)
+	h := NewHandler(db, Config{
+		TokenSecret:     []byte("test-secret"),
+		AccessTokenTTL:  time.Hour,
+		RefreshTokenTTL: time.Hour,
+	})
+	return h, newSessionState(f)
+}
+
+// login starts a session for user 2 the way a successful login does and
+// returns its refresh token.
+func login(t *testing.T, h *Handler) string {
+	t.Helper()
+	session, err := h.newSession(h.DB, User{ID: 2, Email: "user@example.com", Role: "user"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return session.RefreshToken
+}
+
+// sendRefreshToken posts token to handler and returns the response.
+func sendRefreshToken(handler http.HandlerFunc, token string) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(map[string]string{"refresh_token": token})
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("POST", "/api/auth/refresh", strings.NewReader(string(body))))
+	return rec
+}
+
+func TestRefreshSessionRotates(t *testing.T) {
+	h, s := newSessionHandler(t)
+	first := login(t, h)
+	family := s.tokens[hashToken(first)].family
+
+	rec := sendRefreshToken(h.RefreshSession, first)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	var resp struct {
+		Data authResponse `json:"data"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	second := resp.Data.RefreshToken
+	if second == "" || second == first || resp.Data.AccessToken == "" {
+		t.Fatalf("response %s, want a new token pair", rec.Body)
+	}
+
+	if !s.tokens[hashToken(first)].revoked {
+		t.Error("the used refresh token was not revoked")
+	}
+	rt, ok := s.tokens[hashToken(second)]
+	if !ok || rt.family != family || rt.revoked {
+		t.Errorf("new refresh token %+v, want a live token in family %q", rt, family)
+	}
+
+	// The new token can be used in turn
+	if rec := sendRefreshToken(h.RefreshSession, second); rec.Code != http.StatusOK {
+		t.Errorf("refresh with the rotated token: status %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestRefreshSessionReuseRevokesFamily(t *testing.T) {
+	h, s := newSessionHandler(t)
+	first := login(t, h)
+	other := login(t, h)
+	family := s.tokens[hashToken(first)].family
+
+	if rec := sendRefreshToken(h.RefreshSession, first); rec.Code != http.StatusOK {
+		t.Fatalf("first refresh: status %d: %s", rec.Code, rec.Body)
+	}
+	if s.live(family) != 1 {
+		t.Fatalf("%d live tokens in the family after rotation, want 1", s.live(family))
+	}
+
+	// Presenting the rotated token again means it leaked
+	if rec := sendRefreshToken(h.RefreshSession, first); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("reused token: status %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	if n := s.live(family); n != 0 {
+		t.Errorf("%d tokens of the family still live after reuse, want 0", n)
+	}
+	if s.tokens[hashToken(other)].revoked {
+		t.Error("reuse revoked a session from another login")
+	}
+}
+
+func TestRefreshSessionRefused(t *testing.T) {
+	h, s := newSessionHandler(t)
+
+	if rec := sendRefreshToken(h.RefreshSession, "unknown"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("unknown token: status %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	if rec := sendRefreshToken(h.RefreshSession, ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("missing token: status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+
+	expired := login(t, h)
+	s.tokens[hashToken(expired)].expired = true
+	if rec := sendRefreshToken(h.RefreshSession, expired); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expired token: status %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+
+	s.active = false
+	if rec := sendRefreshToken(h.RefreshSession, login(t, h)); rec.Code != http.StatusForbidden {
+		t.Errorf("deactivated user: status %d, want %d", rec.Code, http.StatusForbidden)
+	}
+	if len(s.tokens) != 2 {
+		t.Errorf("%d refresh tokens stored, want no new ones", len(s.tokens))
+	}
+}
+
+func TestLogout(t *testing.T) {
+	h, s := newSessionHandler(t)
+	first := login(t, h)
+	other := login(t, h)
+	rec := sendRefreshToken(h.RefreshSession, first)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("refresh: status %d: %s", rec.Code, rec.Body)
+	}
+	family := s.tokens[hashToken(first)].family
+
+	// Logging out with an already rotated token still ends the whole session
+	if rec := sendRefreshToken(h.Logout, first); rec.Code != http.StatusOK {
+		t.Fatalf("logout: status %d: %s", rec.Code, rec.Body)
+	}
+	if n := s.live(family); n != 0 {
+		t.Errorf("%d tokens of the session still live after logout, want 0", n)
+	}
+	if s.tokens[hashToken(other)].revoked {
+		t.Error("logout revoked a session from another login")
+	}
+
+	req := httptest.NewRequest("POST", "/api/auth/logout-all", nil)
+	req = req.WithContext(context.WithValue(req.Context(), principalKey, Principal{UserID: 2, Role: "user"}))
+	rec = httptest.NewRecorder()
+	h.LogoutAll(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("logout all: status %d: %s", rec.Code, rec.Body)
+	}
+	if !s.tokens[hashToken(other)].revoked {
+		t.Error("logout all left a session live")
+	}
+}
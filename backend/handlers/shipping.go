@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// maxPhoneLength is the width of addresses.phone and orders.customer_phone.
+const maxPhoneLength = 30
+
+// ShippingAddress is the delivery address captured on an order. It is stored
+// as JSON in orders.shipping_address and never changes afterwards, even if the
+// saved address it was copied from is edited or deleted.
+type ShippingAddress struct {
+	AddressID     int    `json:"address_id,omitempty"`
+	Label         string `json:"label,omitempty"`
+	RecipientName string `json:"recipient_name"`
+	Phone         string `json:"phone"`
+	Street        string `json:"street"`
+	City          string `json:"city"`
+	State         string `json:"state,omitempty"`
+	PostalCode    string `json:"postal_code,omitempty"`
+}
+
+// validate trims the address and returns field errors keyed under prefix.
+func (a *ShippingAddress) validate(prefix string) map[string]string {
+	a.AddressID = 0
+	a.Label = ""
+	a.RecipientName = strings.TrimSpace(a.RecipientName)
+	a.Phone = strings.TrimSpace(a.Phone)
+	a.Street = strings.TrimSpace(a.Street)
+	a.City = strings.TrimSpace(a.City)
+	a.State = strings.TrimSpace(a.State)
+	a.PostalCode = strings.TrimSpace(a.PostalCode)
+
+	errs := map[string]string{}
+	if a.RecipientName == "" {
+		errs[prefix+".recipient_name"] = "Nama penerima wajib diisi"
+	}
+	if a.Phone == "" {
+		errs[prefix+".phone"] = "Nomor telepon wajib diisi"
+	} else if len(a.Phone) > maxPhoneLength {
+		errs[prefix+".phone"] = fmt.Sprintf("Nomor telepon maksimal %d karakter", maxPhoneLength)
+	}
+	if a.Street == "" {
+		errs[prefix+".street"] = "Alamat wajib diisi"
+	}
+	if a.City == "" {
+		errs[prefix+".city"] = "Kota wajib diisi"
+	}
+	return errs
+}
+
+// resolveShippingAddress picks the address for a new order: the saved address
+// addressID, which must belong to userID, or else the inline address. When
+// neither is given and useDefault is set, the user's default saved address is
+// used. The second result holds field errors for the client.
+func resolveShippingAddress(q queryer, userID, addressID int, inline *ShippingAddress, useDefault bool) (*ShippingAddress, map[string]string, error) {
+	if addressID <= 0 && inline != nil {
+		if errs := inline.validate("shipping_address"); len(errs) > 0 {
+			return nil, errs, nil
+		}
+		return inline, nil, nil
+	}
+
+	if userID == 0 || (addressID <= 0 && !useDefault) {
+		return nil, map[string]string{"shipping_address": "Alamat pengiriman wajib diisi"}, nil
+	}
+
+	query := `SELECT id, label, recipient_name, phone, street, city, state, postal_code
+		FROM addresses WHERE user_id = ?`
+	args := []interface{}{userID}
+	if addressID > 0 {
+		query += " AND id = ?"
+		args = append(args, addressID)
+	} else {
+		query += " ORDER BY is_default DESC, created_at DESC LIMIT 1"
+	}
+
+	var a ShippingAddress
+	err := q.QueryRow(query, args...).Scan(&a.AddressID, &a.Label, &a.RecipientName, &a.Phone,
+		&a.Street, &a.City, &a.State, &a.PostalCode)
+	if err == sql.ErrNoRows {
+		return nil, map[string]string{"address_id": "Alamat tidak ditemukan"}, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return &a, nil, nil
+}
+
+// encodeShippingAddress returns the JSON snapshot stored on the order.
+func encodeShippingAddress(a *ShippingAddress) string {
+	b, _ := json.Marshal(a)
+	return string(b)
+}
+
+// decodeShippingAddress reads orders.shipping_address. Orders placed before
+// snapshots were structured hold free text, which is returned as the street.
+func decodeShippingAddress(raw sql.NullString) *ShippingAddress {
+	if !raw.Valid || raw.String == "" {
+		return nil
+	}
+	var a ShippingAddress
+	if err := json.Unmarshal([]byte(raw.String), &a); err != nil {
+		return &ShippingAddress{Street: raw.String}
+	}
+	return &a
+}
@@ -0,0 +1,26 @@
+package handlers
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestShippingAddressPhoneLength(t *testing.T) {
+	tests := []struct {
+		phone   string
+		wantErr bool
+	}{
+		{"", true},
+		{"+62 812 3456 7890", false},
+		{strings.Repeat("8", maxPhoneLength), false},
+		{" " + strings.Repeat("8", maxPhoneLength) + " ", false},
+		{strings.Repeat("8", maxPhoneLength+1), true},
+	}
+	for _, tt := range tests {
+		a := ShippingAddress{RecipientName: "Budi", Phone: tt.phone, Street: "Jl. Merdeka 1", City: "Jakarta"}
+		errs := a.validate("shipping_address")
+		if _, got := errs["shipping_address.phone"]; got != tt.wantErr {
+			t.Errorf("phone %q: error %v, want %v", tt.phone, got, tt.wantErr)
+		}
+	}
+}
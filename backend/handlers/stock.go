@@ -0,0 +1,120 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// errInsufficientStock is returned when a conditional stock decrement matches no row.
+var errInsufficientStock = errors.New("insufficient stock")
+
+// Reason a requested product cannot be ordered at all.
+const stockIssueNotFound = "not_found"
+
+// StockShortage describes an order line that cannot be fulfilled from current stock.
+type StockShortage struct {
+	ProductID int    `json:"product_id"`
+	Name      string `json:"name,omitempty"`
+	Requested int    `json:"requested"`
+	Available int    `json:"available"`
+	Reason    string `json:"reason"`
+}
+
+// lockOrderItems locks the product rows of the requested lines in ascending
+// id order (so concurrent orders cannot deadlock), prices each line from the
+// locked row and reports every line that current stock cannot cover. Lines for
+// the same product are combined. The returned items have no OrderID yet.
+func lockOrderItems(q queryer, requested []OrderItem) ([]OrderItem, []StockShortage, error) {
+	quantities := make(map[int]int)
+	var ids []int
+	for _, item := range requested {
+		if _, seen := quantities[item.ProductID]; !seen {
+			ids = append(ids, item.ProductID)
+		}
+		quantities[item.ProductID] += item.Quantity
+	}
+	sort.Ints(ids)
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+
+	rows, err := q.Query(
+		"SELECT id, name, price, stock, is_active FROM products WHERE id IN ("+placeholders+") ORDER BY id FOR UPDATE",
+		args...,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	type lockedProduct struct {
+		name     string
+		price    float64
+		stock    int
+		isActive int
+	}
+	products := make(map[int]lockedProduct, len(ids))
+	for rows.Next() {
+		var (
+			id int
+			p  lockedProduct
+		)
+		if err := rows.Scan(&id, &p.name, &p.price, &p.stock, &p.isActive); err != nil {
+			return nil, nil, err
+		}
+		products[id] = p
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	items := make([]OrderItem, 0, len(ids))
+	var shortages []StockShortage
+	for _, id := range ids {
+		qty := quantities[id]
+		p, ok := products[id]
+
+		shortage := StockShortage{ProductID: id, Name: p.name, Requested: qty, Available: p.stock}
+		switch {
+		case !ok:
+			shortage.Reason = stockIssueNotFound
+		case p.isActive == 0:
+			shortage.Reason = cartIssueInactive
+			shortage.Available = 0
+		case p.stock <= 0:
+			shortage.Reason = cartIssueOutOfStock
+			shortage.Available = 0
+		case p.stock < qty:
+			shortage.Reason = cartIssueInsufficientStock
+		default:
+			items = append(items, OrderItem{ProductID: id, Quantity: qty, Price: p.price})
+			continue
+		}
+		shortages = append(shortages, shortage)
+	}
+
+	return items, shortages, nil
+}
+
+// orderTotal sums the line totals of items.
+func orderTotal(items []OrderItem) float64 {
+	var total float64
+	for _, item := range items {
+		total += item.Price * float64(item.Quantity)
+	}
+	return total
+}
+
+// respondStockShortage writes a 409 listing the lines that cannot be fulfilled.
+func respondStockShortage(w http.ResponseWriter, shortages []StockShortage) {
+	respondJSON(w, http.StatusConflict, Response{
+		Success: false,
+		Error:   "Insufficient stock for some items",
+		Data:    map[string]interface{}{"items": shortages},
+	})
+}
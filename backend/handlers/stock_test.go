@@ -0,0 +1,205 @@
+package handlers
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// These tests need a MySQL database loaded from database/schema.sql, e.g.
+//
+//	TEST_MYSQL_DSN='root:@tcp(localhost:3306)/ecommerce_db?parseTime=true' go test ./handlers
+//
+// They create their own category, product and orders and remove them afterwards.
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	dsn := os.Getenv("TEST_MYSQL_DSN")
+	if dsn == "" {
+		t.Skip("TEST_MYSQL_DSN not set")
+	}
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Ping(); err != nil {
+		t.Fatalf("ping: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// createTestProduct inserts a product with the given stock and returns its id
+// and name. Orders placed by the test must use the name as customer_name; they
+// are deleted with the product and its category when the test ends.
+func createTestProduct(t *testing.T, db *sql.DB, stock int) (int, string) {
+	t.Helper()
+	name := fmt.Sprintf("stock test %d", time.Now().UnixNano())
+
+	result, err := db.Exec("INSERT INTO categories (name) VALUES (?)", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	categoryID, _ := result.LastInsertId()
+
+	result, err = db.Exec(
+		"INSERT INTO products (category_id, name, price, stock, is_active) VALUES (?, ?, 10000, ?, 1)",
+		categoryID, name, stock,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	productID, _ := result.LastInsertId()
+
+	t.Cleanup(func() {
+		db.Exec("DELETE FROM orders WHERE customer_name = ?", name)
+		db.Exec("DELETE FROM products WHERE id = ?", productID)
+		db.Exec("DELETE FROM categories WHERE id = ?", categoryID)
+	})
+	return int(productID), name
+}
+
+func productStock(t *testing.T, db *sql.DB, productID int) int {
+	t.Helper()
+	var stock int
+	if err := db.QueryRow("SELECT stock FROM products WHERE id = ?", productID).Scan(&stock); err != nil {
+		t.Fatal(err)
+	}
+	return stock
+}
+
+// race runs fn n times in parallel, releasing all goroutines at once.
+func race(n int, fn func(i int)) {
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			fn(i)
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+}
+
+// TestInsertOrderItemsNeverOversells runs the conditional decrement on its own,
+// without the row locks taken by lockOrderItems, so it alone must stop stock
+// from going negative.
+func TestInsertOrderItemsNeverOversells(t *testing.T) {
+	db := openTestDB(t)
+	const stock, attempts = 5, 30
+	productID, name := createTestProduct(t, db, stock)
+
+	orderIDs := make([]int, attempts)
+	for i := range orderIDs {
+		result, err := db.Exec(
+			"INSERT INTO orders (customer_name, customer_email, customer_phone, total_amount) VALUES (?, 'stock@example.com', '0', 10000)",
+			name,
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, _ := result.LastInsertId()
+		orderIDs[i] = int(id)
+	}
+
+	var (
+		mu               sync.Mutex
+		placed, shortage int
+	)
+	race(attempts, func(i int) {
+		// Without lockOrderItems the foreign key check and the decrement can
+		// deadlock; InnoDB rolls one side back and the order is simply retried
+		var err error
+		for {
+			err = placeOrderItem(db, orderIDs[i], productID)
+			if mysqlErr, ok := err.(*mysql.MySQLError); !ok || mysqlErr.Number != 1213 {
+				break
+			}
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		switch err {
+		case nil:
+			placed++
+		case errInsufficientStock:
+			shortage++
+		default:
+			t.Errorf("insertOrderItems: %v", err)
+		}
+	})
+
+	if after := productStock(t, db, productID); after != 0 {
+		t.Errorf("stock after race = %d, want 0", after)
+	}
+	if placed != stock || shortage != attempts-stock {
+		t.Errorf("placed %d and refused %d, want %d and %d", placed, shortage, stock, attempts-stock)
+	}
+}
+
+// placeOrderItem adds one unit of the product to the order in its own transaction.
+func placeOrderItem(db *sql.DB, orderID, productID int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := insertOrderItems(tx, orderID, []OrderItem{{ProductID: productID, Quantity: 1, Price: 10000}}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// TestCreateOrderNeverOversells places parallel orders through the handler and
+// checks that exactly the available stock is sold.
+func TestCreateOrderNeverOversells(t *testing.T) {
+	db := openTestDB(t)
+	const stock, attempts, quantity = 6, 25, 2
+	productID, name := createTestProduct(t, db, stock)
+	h := NewHandler(db, Config{OrderHoldTTL: time.Hour})
+
+	body, _ := json.Marshal(CreateOrderRequest{
+		CustomerName:  name,
+		CustomerEmail: "stock@example.com",
+		CustomerPhone: "0",
+		Items:         []OrderItem{{ProductID: productID, Quantity: quantity}},
+		ShippingAddress: &ShippingAddress{
+			RecipientName: "Stock Test",
+			Phone:         "0",
+			Street:        "Jl. Test 1",
+			City:          "Jakarta",
+		},
+	})
+
+	var (
+		mu       sync.Mutex
+		statuses = map[int]int{}
+	)
+	race(attempts, func(int) {
+		rec := httptest.NewRecorder()
+		h.CreateOrder(rec, httptest.NewRequest(http.MethodPost, "/api/orders", bytes.NewReader(body)))
+		mu.Lock()
+		statuses[rec.Code]++
+		mu.Unlock()
+	})
+
+	want := stock / quantity
+	if statuses[http.StatusCreated] != want || statuses[http.StatusConflict] != attempts-want {
+		t.Errorf("statuses %v, want %d created and %d conflicts", statuses, want, attempts-want)
+	}
+	if after := productStock(t, db, productID); after != stock-want*quantity {
+		t.Errorf("stock after race = %d, want %d", after, stock-want*quantity)
+	}
+}
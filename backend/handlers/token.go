@@ -0,0 +1,135 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	errInvalidToken = errors.New("invalid token")
+	errTokenExpired = errors.New("token expired")
+)
+
+// tokenHeader is the fixed JOSE header for HS256 signed tokens.
+var tokenHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// Token purposes. Access tokens carry no purpose.
+const (
+	purposeAccess    = ""
+	purposeChallenge = "2fa"
+)
+
+// accessClaims is the payload carried by signed tokens.
+type accessClaims struct {
+	Subject   string `json:"sub"`
+	Role      string `json:"role"`
+	Purpose   string `json:"purpose,omitempty"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// issueAccessToken signs a short-lived access token for the given user.
+func (h *Handler) issueAccessToken(userID int, role string) (string, time.Time, error) {
+	return h.issueToken(userID, role, purposeAccess, h.Config.AccessTokenTTL)
+}
+
+// parseAccessToken verifies the signature and expiry of an access token.
+func (h *Handler) parseAccessToken(token string) (Principal, error) {
+	return h.parseToken(token, purposeAccess)
+}
+
+// issueChallengeToken signs the token a client exchanges, together with a
+// second factor, for a session once the password has been verified.
+func (h *Handler) issueChallengeToken(userID int, role string) (string, time.Time, error) {
+	return h.issueToken(userID, role, purposeChallenge, h.Config.TwoFactorChallengeTTL)
+}
+
+// parseChallengeToken verifies a token issued by issueChallengeToken.
+func (h *Handler) parseChallengeToken(token string) (Principal, error) {
+	return h.parseToken(token, purposeChallenge)
+}
+
+func (h *Handler) issueToken(userID int, role, purpose string, ttl time.Duration) (string, time.Time, error) {
+	now := time.Now()
+	expiresAt := now.Add(ttl)
+
+	payload, err := json.Marshal(accessClaims{
+		Subject:   strconv.Itoa(userID),
+		Role:      role,
+		Purpose:   purpose,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: expiresAt.Unix(),
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	unsigned := tokenHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return unsigned + "." + h.signToken(unsigned), expiresAt, nil
+}
+
+func (h *Handler) parseToken(token, purpose string) (Principal, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != tokenHeader {
+		return Principal{}, errInvalidToken
+	}
+
+	expected := h.signToken(parts[0] + "." + parts[1])
+	if !hmac.Equal([]byte(expected), []byte(parts[2])) {
+		return Principal{}, errInvalidToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return Principal{}, errInvalidToken
+	}
+
+	var claims accessClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return Principal{}, errInvalidToken
+	}
+
+	if claims.Purpose != purpose {
+		return Principal{}, errInvalidToken
+	}
+
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return Principal{}, errTokenExpired
+	}
+
+	userID, err := strconv.Atoi(claims.Subject)
+	if err != nil || userID <= 0 {
+		return Principal{}, errInvalidToken
+	}
+
+	return Principal{UserID: userID, Role: claims.Role, IssuedAt: time.Unix(claims.IssuedAt, 0)}, nil
+}
+
+func (h *Handler) signToken(unsigned string) string {
+	mac := hmac.New(sha256.New, h.Config.TokenSecret)
+	mac.Write([]byte(unsigned))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// randomToken returns n random bytes encoded as URL-safe base64.
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken returns the hex SHA-256 digest used to store opaque tokens.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
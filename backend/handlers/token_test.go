@@ -0,0 +1,93 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseAccessToken(t *testing.T) {
+	h := &Handler{Config: Config{
+		TokenSecret:           []byte("test-secret"),
+		AccessTokenTTL:        time.Hour,
+		TwoFactorChallengeTTL: time.Minute,
+	}}
+
+	valid, _, err := h.issueAccessToken(7, RoleAdmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	challenge, _, err := h.issueChallengeToken(7, RoleAdmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, _, err := h.issueToken(7, RoleAdmin, purposeAccess, -time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := &Handler{Config: Config{TokenSecret: []byte("other-secret"), AccessTokenTTL: time.Hour}}
+	foreign, _, err := other.issueAccessToken(7, RoleAdmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parts := strings.Split(valid, ".")
+	// resign builds a token with the given header and claims, signed with the
+	// right secret, so only the content is wrong.
+	resign := func(header string, claims interface{}) string {
+		payload, err := json.Marshal(claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		unsigned := header + "." + base64.RawURLEncoding.EncodeToString(payload)
+		return unsigned + "." + h.signToken(unsigned)
+	}
+	// Same claims, but the role raised without re-signing
+	escalated := parts[0] + "." + base64.RawURLEncoding.EncodeToString(
+		[]byte(`{"sub":"7","role":"super_admin","iat":0,"exp":9999999999}`),
+	) + "." + parts[2]
+	noneHeader := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`))
+	future := time.Now().Add(time.Hour).Unix()
+
+	tests := []struct {
+		name  string
+		token string
+		want  error
+	}{
+		{"valid", valid, nil},
+		{"expired", expired, errTokenExpired},
+		{"challenge token", challenge, errInvalidToken},
+		{"signed with another secret", foreign, errInvalidToken},
+		{"tampered claims", escalated, errInvalidToken},
+		{"tampered signature", valid[:len(valid)-2] + "xx", errInvalidToken},
+		{"unsigned", parts[0] + "." + parts[1] + ".", errInvalidToken},
+		{"alg none header", noneHeader + "." + parts[1] + "." + parts[2], errInvalidToken},
+		{"alg none header re-signed", resign(noneHeader, accessClaims{Subject: "7", ExpiresAt: future}), errInvalidToken},
+		{"unknown purpose", resign(tokenHeader, accessClaims{Subject: "7", Purpose: "reset", ExpiresAt: future}), errInvalidToken},
+		{"non-numeric subject", resign(tokenHeader, accessClaims{Subject: "admin", ExpiresAt: future}), errInvalidToken},
+		{"zero subject", resign(tokenHeader, accessClaims{Subject: "0", ExpiresAt: future}), errInvalidToken},
+		{"two parts", parts[0] + "." + parts[1], errInvalidToken},
+		{"empty", "", errInvalidToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			principal, err := h.parseAccessToken(tt.token)
+			if err != tt.want {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+			if err == nil && (principal.UserID != 7 || principal.Role != RoleAdmin) {
+				t.Errorf("got principal %+v, want user 7 with role %s", principal, RoleAdmin)
+			}
+		})
+	}
+
+	// The converse: an access token cannot stand in for a challenge token
+	if _, err := h.parseChallengeToken(valid); err != errInvalidToken {
+		t.Errorf("access token as challenge token: got %v, want %v", err, errInvalidToken)
+	}
+	if _, err := h.parseChallengeToken(challenge); err != nil {
+		t.Errorf("challenge token: %v", err)
+	}
+}
@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA-1 key of the RFC 6238 test vectors,
+// "12345678901234567890", in base32.
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCodeRFC6238(t *testing.T) {
+	// RFC 6238 appendix B lists 8-digit codes; 6-digit codes are their last six digits
+	vectors := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, v := range vectors {
+		got, err := totpCode(rfc6238Secret, v.unix/totpPeriod)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != v.want {
+			t.Errorf("code at %d = %s, want %s", v.unix, got, v.want)
+		}
+	}
+}
+
+func TestVerifyTOTPSkew(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	current := now.Unix() / totpPeriod
+
+	for offset := int64(-3); offset <= 3; offset++ {
+		code, err := totpCode(rfc6238Secret, current+offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		step, ok := verifyTOTP(rfc6238Secret, code, now)
+		wantOK := offset >= -totpSkew && offset <= totpSkew
+		if ok != wantOK {
+			t.Errorf("offset %d: accepted = %v, want %v", offset, ok, wantOK)
+		}
+		if ok && step != current+offset {
+			t.Errorf("offset %d: step = %d, want %d", offset, step, current+offset)
+		}
+	}
+}
+
+func TestVerifyTOTPInput(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	code, _ := totpCode(rfc6238Secret, now.Unix()/totpPeriod)
+
+	tests := []struct {
+		code string
+		want bool
+	}{
+		{code, true},
+		{" " + code[:3] + " " + code[3:] + " ", true},
+		{code[:5], false},
+		{code + "0", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if _, ok := verifyTOTP(rfc6238Secret, tt.code, now); ok != tt.want {
+			t.Errorf("verifyTOTP(%q) = %v, want %v", tt.code, ok, tt.want)
+		}
+	}
+	if _, ok := verifyTOTP("not base32!", code, now); ok {
+		t.Error("verifyTOTP accepted a code for an invalid secret")
+	}
+}
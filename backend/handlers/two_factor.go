@@ -0,0 +1,438 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// recoveryCodeCount is how many recovery codes are issued on enrollment.
+const recoveryCodeCount = 10
+
+// twoFactorChallenge is returned by Login instead of a session when 2FA is enabled.
+type twoFactorChallenge struct {
+	TwoFactorRequired bool      `json:"two_factor_required"`
+	ChallengeToken    string    `json:"challenge_token"`
+	ExpiresAt         time.Time `json:"expires_at"`
+}
+
+type twoFactorCodeRequest struct {
+	Code string `json:"code"`
+}
+
+type twoFactorLoginRequest struct {
+	ChallengeToken string `json:"challenge_token"`
+	Code           string `json:"code"`
+	RecoveryCode   string `json:"recovery_code"`
+}
+
+type disableTwoFactorRequest struct {
+	Password string `json:"password"`
+	Code     string `json:"code"`
+}
+
+func twoFactorThrottleKey(userID int) string {
+	return "2fa:" + strconv.Itoa(userID)
+}
+
+// normalizeRecoveryCode makes recovery codes insensitive to case, spaces and dashes.
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToUpper(code)
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
+
+// twoFactorEnabled reports whether the user has completed TOTP enrollment.
+func (h *Handler) twoFactorEnabled(userID int) (bool, error) {
+	var enabled bool
+	err := h.DB.QueryRow("SELECT enabled_at IS NOT NULL FROM user_totp WHERE user_id = ?", userID).Scan(&enabled)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return enabled, err
+}
+
+// generateRecoveryCodes replaces the user's recovery codes and returns the new plaintext codes.
+func generateRecoveryCodes(q execer, userID int) ([]string, error) {
+	if _, err := q.Exec("DELETE FROM user_recovery_codes WHERE user_id = ?", userID); err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		raw := totpEncoding.EncodeToString(b)
+		code := raw[:4] + "-" + raw[4:]
+
+		if _, err := q.Exec(
+			"INSERT INTO user_recovery_codes (user_id, code_hash) VALUES (?, ?)",
+			userID, hashToken(normalizeRecoveryCode(code)),
+		); err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+// checkTOTP verifies a code against the user's secret and consumes its time step
+// so the same code cannot be replayed. pendingOK allows unconfirmed secrets.
+func (h *Handler) checkTOTP(tx *sql.Tx, userID int, code string, pendingOK bool) bool {
+	var (
+		secret   string
+		lastStep sql.NullInt64
+		enabled  bool
+	)
+	err := tx.QueryRow(
+		"SELECT secret, last_used_step, enabled_at IS NOT NULL FROM user_totp WHERE user_id = ? FOR UPDATE",
+		userID,
+	).Scan(&secret, &lastStep, &enabled)
+	if err != nil || (!enabled && !pendingOK) {
+		return false
+	}
+
+	step, ok := verifyTOTP(secret, code, time.Now())
+	if !ok || (lastStep.Valid && step <= lastStep.Int64) {
+		return false
+	}
+
+	result, err := tx.Exec(
+		"UPDATE user_totp SET last_used_step = ? WHERE user_id = ? AND (last_used_step IS NULL OR last_used_step < ?)",
+		step, userID, step,
+	)
+	if err != nil {
+		return false
+	}
+	affected, _ := result.RowsAffected()
+	return affected == 1
+}
+
+// useRecoveryCode consumes a recovery code of the user.
+func useRecoveryCode(q execer, userID int, code string) bool {
+	result, err := q.Exec(
+		"UPDATE user_recovery_codes SET used_at = NOW() WHERE user_id = ? AND code_hash = ? AND used_at IS NULL",
+		userID, hashToken(normalizeRecoveryCode(code)),
+	)
+	if err != nil {
+		return false
+	}
+	affected, _ := result.RowsAffected()
+	return affected == 1
+}
+
+// SetupTwoFactor starts TOTP enrollment and returns the secret and otpauth URI.
+// Enrollment only takes effect after ConfirmTwoFactor.
+func (h *Handler) SetupTwoFactor(w http.ResponseWriter, r *http.Request) {
+	principal, _ := principalFromContext(r.Context())
+
+	enabled, err := h.twoFactorEnabled(principal.UserID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Gagal memulai 2FA")
+		return
+	}
+	if enabled {
+		respondError(w, http.StatusConflict, "2FA sudah aktif")
+		return
+	}
+
+	var email string
+	if err := h.DB.QueryRow("SELECT email FROM users WHERE id = ?", principal.UserID).Scan(&email); err != nil {
+		respondError(w, http.StatusNotFound, "User tidak ditemukan")
+		return
+	}
+
+	secret, err := newTOTPSecret()
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Gagal memulai 2FA")
+		return
+	}
+
+	_, err = h.DB.Exec(`
+		INSERT INTO user_totp (user_id, secret) VALUES (?, ?)
+		ON DUPLICATE KEY UPDATE secret = VALUES(secret), enabled_at = NULL, last_used_step = NULL
+	`, principal.UserID, secret)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Gagal memulai 2FA")
+		return
+	}
+
+	respondSuccess(w, map[string]string{
+		"secret":      secret,
+		"otpauth_uri": totpURI(h.Config.TwoFactorIssuer, email, secret),
+	})
+}
+
+// ConfirmTwoFactor enables 2FA once the user proves their authenticator works,
+// and returns the recovery codes. They are shown only this once. Wrong codes
+// count towards the same backoff as VerifyTwoFactorLogin.
+func (h *Handler) ConfirmTwoFactor(w http.ResponseWriter, r *http.Request) {
+	principal, _ := principalFromContext(r.Context())
+
+	var req twoFactorCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+		respondError(w, http.StatusBadRequest, "Kode wajib diisi")
+		return
+	}
+
+	throttleKey := twoFactorThrottleKey(principal.UserID)
+	if wait := h.loginRetryAfter(throttleKey); wait > 0 {
+		seconds := int(wait.Seconds())
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+		respondError(w, http.StatusTooManyRequests, fmt.Sprintf("Terlalu banyak percobaan. Coba lagi dalam %d detik", seconds))
+		return
+	}
+
+	tx, err := h.DB.Begin()
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Gagal memulai transaksi")
+		return
+	}
+	defer tx.Rollback()
+
+	if !h.checkTOTP(tx, principal.UserID, req.Code, true) {
+		h.recordLoginFailure(throttleKey, h.Config.AccountThrottle)
+		respondError(w, http.StatusBadRequest, "Kode tidak valid")
+		return
+	}
+
+	if _, err := tx.Exec("UPDATE user_totp SET enabled_at = NOW() WHERE user_id = ?", principal.UserID); err != nil {
+		respondError(w, http.StatusInternalServerError, "Gagal mengaktifkan 2FA")
+		return
+	}
+
+	codes, err := generateRecoveryCodes(tx, principal.UserID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Gagal mengaktifkan 2FA")
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		respondError(w, http.StatusInternalServerError, "Gagal mengaktifkan 2FA")
+		return
+	}
+	h.clearLoginFailures(throttleKey)
+
+	respondSuccess(w, map[string]interface{}{
+		"enabled":        true,
+		"recovery_codes": codes,
+	})
+}
+
+// RegenerateRecoveryCodes replaces all recovery codes after checking a current
+// TOTP code. Wrong codes count towards the same backoff as VerifyTwoFactorLogin.
+func (h *Handler) RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	principal, _ := principalFromContext(r.Context())
+
+	var req twoFactorCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+		respondError(w, http.StatusBadRequest, "Kode wajib diisi")
+		return
+	}
+
+	throttleKey := twoFactorThrottleKey(principal.UserID)
+	if wait := h.loginRetryAfter(throttleKey); wait > 0 {
+		seconds := int(wait.Seconds())
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+		respondError(w, http.StatusTooManyRequests, fmt.Sprintf("Terlalu banyak percobaan. Coba lagi dalam %d detik", seconds))
+		return
+	}
+
+	tx, err := h.DB.Begin()
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Gagal memulai transaksi")
+		return
+	}
+	defer tx.Rollback()
+
+	if !h.checkTOTP(tx, principal.UserID, req.Code, false) {
+		h.recordLoginFailure(throttleKey, h.Config.AccountThrottle)
+		respondError(w, http.StatusBadRequest, "Kode tidak valid")
+		return
+	}
+
+	codes, err := generateRecoveryCodes(tx, principal.UserID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Gagal membuat kode pemulihan")
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		respondError(w, http.StatusInternalServerError, "Gagal membuat kode pemulihan")
+		return
+	}
+	h.clearLoginFailures(throttleKey)
+
+	respondSuccess(w, map[string]interface{}{
+		"recovery_codes": codes,
+	})
+}
+
+// DisableTwoFactor turns 2FA off after re-checking the password and a second factor.
+// Wrong passwords and codes count towards the same backoff as Login and
+// VerifyTwoFactorLogin. Roles that require 2FA cannot disable it.
+func (h *Handler) DisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	principal, _ := principalFromContext(r.Context())
+
+	var req disableTwoFactorRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Password == "" || req.Code == "" {
+		respondError(w, http.StatusBadRequest, "Password dan kode wajib diisi")
+		return
+	}
+
+	var email, hash, role string
+	if err := h.DB.QueryRow(
+		"SELECT email, password_hash, role FROM users WHERE id = ?", principal.UserID,
+	).Scan(&email, &hash, &role); err != nil {
+		respondError(w, http.StatusNotFound, "User tidak ditemukan")
+		return
+	}
+
+	if h.Config.TwoFactorRoles[role] {
+		respondError(w, http.StatusConflict, "2FA wajib untuk role ini")
+		return
+	}
+
+	accountKey := accountThrottleKey(email)
+	codeKey := twoFactorThrottleKey(principal.UserID)
+	if wait := h.loginRetryAfter(accountKey, codeKey); wait > 0 {
+		seconds := int(wait.Seconds())
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+		respondError(w, http.StatusTooManyRequests, fmt.Sprintf("Terlalu banyak percobaan. Coba lagi dalam %d detik", seconds))
+		return
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(req.Password)); err != nil {
+		h.recordLoginFailure(accountKey, h.Config.AccountThrottle)
+		respondError(w, http.StatusUnauthorized, "Password salah")
+		return
+	}
+	h.clearLoginFailures(accountKey)
+
+	tx, err := h.DB.Begin()
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Gagal memulai transaksi")
+		return
+	}
+	defer tx.Rollback()
+
+	if !h.checkTOTP(tx, principal.UserID, req.Code, false) && !useRecoveryCode(tx, principal.UserID, req.Code) {
+		h.recordLoginFailure(codeKey, h.Config.AccountThrottle)
+		respondError(w, http.StatusBadRequest, "Kode tidak valid")
+		return
+	}
+
+	if _, err := tx.Exec("DELETE FROM user_totp WHERE user_id = ?", principal.UserID); err != nil {
+		respondError(w, http.StatusInternalServerError, "Gagal menonaktifkan 2FA")
+		return
+	}
+	if _, err := tx.Exec("DELETE FROM user_recovery_codes WHERE user_id = ?", principal.UserID); err != nil {
+		respondError(w, http.StatusInternalServerError, "Gagal menonaktifkan 2FA")
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		respondError(w, http.StatusInternalServerError, "Gagal menonaktifkan 2FA")
+		return
+	}
+	h.clearLoginFailures(codeKey)
+
+	respondJSON(w, http.StatusOK, Response{
+		Success: true,
+		Message: "2FA dinonaktifkan",
+	})
+}
+
+// VerifyTwoFactorLogin completes a login started by Login when 2FA is enabled,
+// accepting either a TOTP code or an unused recovery code.
+func (h *Handler) VerifyTwoFactorLogin(w http.ResponseWriter, r *http.Request) {
+	var req twoFactorLoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if req.ChallengeToken == "" || (req.Code == "" && req.RecoveryCode == "") {
+		respondError(w, http.StatusBadRequest, "Challenge token dan kode wajib diisi")
+		return
+	}
+
+	principal, err := h.parseChallengeToken(req.ChallengeToken)
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, "Sesi login telah berakhir, silakan login kembali")
+		return
+	}
+
+	throttleKey := twoFactorThrottleKey(principal.UserID)
+	if wait := h.loginRetryAfter(throttleKey); wait > 0 {
+		seconds := int(wait.Seconds())
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+		respondError(w, http.StatusTooManyRequests, fmt.Sprintf("Terlalu banyak percobaan. Coba lagi dalam %d detik", seconds))
+		return
+	}
+
+	var (
+		user     User
+		isActive int
+	)
+	err = h.DB.QueryRow(
+		"SELECT id, email, full_name, role, email_verified_at IS NOT NULL, is_active FROM users WHERE id = ?",
+		principal.UserID,
+	).Scan(&user.ID, &user.Email, &user.FullName, &user.Role, &user.EmailVerified, &isActive)
+	if err != nil || isActive == 0 {
+		respondError(w, http.StatusForbidden, "Akun tidak aktif")
+		return
+	}
+
+	tx, err := h.DB.Begin()
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Gagal memulai transaksi")
+		return
+	}
+	defer tx.Rollback()
+
+	var ok bool
+	if req.Code != "" {
+		ok = h.checkTOTP(tx, user.ID, req.Code, false)
+	} else {
+		ok = useRecoveryCode(tx, user.ID, req.RecoveryCode)
+	}
+	if !ok {
+		h.recordLoginFailure(throttleKey, h.Config.AccountThrottle)
+		respondError(w, http.StatusUnauthorized, "Kode tidak valid")
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		respondError(w, http.StatusInternalServerError, "Gagal membuat sesi")
+		return
+	}
+
+	h.clearLoginFailures(throttleKey)
+	h.completeLogin(w, r, user)
+}
+
+// completeLogin records the login, merges any guest cart sent with the request
+// and responds with a new session.
+func (h *Handler) completeLogin(w http.ResponseWriter, r *http.Request, user User) {
+	if _, err := h.DB.Exec("UPDATE users SET last_login = NOW() WHERE id = ?", user.ID); err != nil {
+		log.Printf("login: failed to update last_login for user %d: %v", user.ID, err)
+	}
+
+	session, err := h.newSession(h.DB, user, "")
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Gagal membuat sesi")
+		return
+	}
+	session.CartMerge = h.mergeGuestCartFromRequest(r, user.ID)
+
+	respondSuccess(w, session)
+}
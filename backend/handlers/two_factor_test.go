@@ -0,0 +1,275 @@
+package handlers
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// twoFactorState models one user's user_totp, user_recovery_codes and
+// login_throttles rows on a fakeDB.
+type twoFactorState struct {
+	*throttleState
+	secret   string
+	lastStep driver.Value // nil while no code has been used
+	codes    map[string]bool
+}
+
+func newTwoFactorState(f *fakeDB) *twoFactorState {
+	s := &twoFactorState{
+		throttleState: newThrottleState(f),
+		secret:        rfc6238Secret,
+		codes:         map[string]bool{},
+	}
+
+	f.on("SELECT id, email, full_name, role, email_verified_at IS NOT NULL, is_active FROM users", func([]driver.Value) fakeResult {
+		return row(int64(1), "user@example.com", "Test User", RoleUser, true, int64(1))
+	})
+	f.on("SELECT secret, last_used_step, enabled_at IS NOT NULL FROM user_totp", func([]driver.Value) fakeResult {
+		return row(s.secret, s.lastStep, true)
+	})
+	f.on("UPDATE user_totp SET last_used_step = ? WHERE user_id = ? AND (last_used_step IS NULL OR last_used_step < ?)", func(args []driver.Value) fakeResult {
+		step := args[0].(int64)
+		if last, ok := s.lastStep.(int64); ok && last >= step {
+			return fakeResult{}
+		}
+		s.lastStep = step
+		return fakeResult{affected: 1}
+	})
+	f.on("INSERT INTO user_recovery_codes", func(args []driver.Value) fakeResult {
+		s.codes[args[1].(string)] = false
+		return fakeResult{affected: 1}
+	})
+	f.on("UPDATE user_recovery_codes SET used_at = NOW() WHERE user_id = ? AND code_hash = ? AND used_at IS NULL", func(args []driver.Value) fakeResult {
+		used, ok := s.codes[args[1].(string)]
+		if !ok || used {
+			return fakeResult{}
+		}
+		s.codes[args[1].(string)] = true
+		return fakeResult{affected: 1}
+	})
+	return s
+}
+
+// awayFromStepEnd waits out the last seconds of the current TOTP step, so a
+// test's codes are all computed and checked within the same step.
+func awayFromStepEnd() {
+	if left := totpPeriod - time.Now().Unix()%totpPeriod; left <= 2 {
+		time.Sleep(time.Duration(left) * time.Second)
+	}
+}
+
+// currentCode returns the TOTP code for offset steps from the current one.
+func currentCode(t *testing.T, secret string, offset int64) string {
+	t.Helper()
+	code, err := totpCode(secret, time.Now().Unix()/totpPeriod+offset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+// wrongCode returns a well-formed code that no step in the skew window accepts.
+func wrongCode(t *testing.T, secret string) string {
+	t.Helper()
+	for i := 0; i < 1000000; i++ {
+		code := fmt.Sprintf("%06d", i)
+		if _, ok := verifyTOTP(secret, code, time.Now()); !ok {
+			return code
+		}
+	}
+	t.Fatal("no wrong code found")
+	return ""
+}
+
+func TestCheckTOTPRejectsReplay(t *testing.T) {
+	db, f := newFakeDB(t)
+	state := newTwoFactorState(f)
+	h := &Handler{DB: db}
+	awayFromStepEnd()
+
+	check := func(code string) bool {
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tx.Rollback()
+		return h.checkTOTP(tx, 1, code, false)
+	}
+
+	if !check(currentCode(t, state.secret, 0)) {
+		t.Fatal("current code rejected")
+	}
+	if check(currentCode(t, state.secret, 0)) {
+		t.Error("current code accepted twice")
+	}
+	if check(currentCode(t, state.secret, -1)) {
+		t.Error("code from before the last used step accepted")
+	}
+	if !check(currentCode(t, state.secret, 1)) {
+		t.Error("code from the next step rejected")
+	}
+	if check(currentCode(t, state.secret, 0)) {
+		t.Error("current code accepted after a later step was used")
+	}
+}
+
+func TestRecoveryCodesAreSingleUse(t *testing.T) {
+	db, f := newFakeDB(t)
+	state := newTwoFactorState(f)
+
+	codes, err := generateRecoveryCodes(db, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != recoveryCodeCount || len(state.codes) != recoveryCodeCount {
+		t.Fatalf("got %d codes and %d stored, want %d", len(codes), len(state.codes), recoveryCodeCount)
+	}
+
+	// Case, spaces and dashes do not matter
+	typed := strings.ToLower(strings.ReplaceAll(codes[0], "-", " "))
+	if !useRecoveryCode(db, 1, typed) {
+		t.Fatal("unused recovery code rejected")
+	}
+	if useRecoveryCode(db, 1, codes[0]) {
+		t.Error("recovery code accepted twice")
+	}
+	if !useRecoveryCode(db, 1, codes[1]) {
+		t.Error("second recovery code rejected after the first was used")
+	}
+	if useRecoveryCode(db, 1, "AAAA-AAAA") {
+		t.Error("unknown recovery code accepted")
+	}
+}
+
+func TestVerifyTwoFactorLoginThrottle(t *testing.T) {
+	db, f := newFakeDB(t)
+	state := newTwoFactorState(f)
+	h := NewHandler(db, Config{
+		TokenSecret:           []byte("test-secret"),
+		AccessTokenTTL:        time.Hour,
+		RefreshTokenTTL:       time.Hour,
+		TwoFactorChallengeTTL: time.Minute,
+		Mailer:                &WriterMailer{W: io.Discard},
+		AccountThrottle: LoginThrottle{
+			FreeAttempts: 2,
+			BaseDelay:    time.Minute,
+			MaxDelay:     time.Hour,
+		},
+	})
+	challenge, _, err := h.issueChallengeToken(1, RoleUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	awayFromStepEnd()
+
+	verify := func(field, code string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(map[string]string{"challenge_token": challenge, field: code})
+		rec := httptest.NewRecorder()
+		h.VerifyTwoFactorLogin(rec, httptest.NewRequest("POST", "/api/auth/2fa/verify", strings.NewReader(string(body))))
+		return rec
+	}
+
+	wrong := wrongCode(t, state.secret)
+	for i := 1; i <= 3; i++ {
+		if rec := verify("code", wrong); rec.Code != http.StatusUnauthorized {
+			t.Fatalf("wrong code %d: status %d, want %d", i, rec.Code, http.StatusUnauthorized)
+		}
+	}
+
+	key := twoFactorThrottleKey(1)
+	if state.failures[key] != 3 || !state.blocked[key] {
+		t.Fatalf("after 3 failures: %d recorded, blocked %v", state.failures[key], state.blocked[key])
+	}
+
+	// Once blocked, even the right code or a recovery code is refused
+	for _, field := range []string{"code", "recovery_code"} {
+		rec := verify(field, currentCode(t, state.secret, 0))
+		if rec.Code != http.StatusTooManyRequests {
+			t.Fatalf("%s while blocked: status %d, want %d", field, rec.Code, http.StatusTooManyRequests)
+		}
+		if rec.Header().Get("Retry-After") == "" {
+			t.Errorf("%s while blocked: no Retry-After header", field)
+		}
+	}
+	if state.lastStep != nil {
+		t.Error("a code was checked while the user was blocked")
+	}
+
+	// When the block runs out, the right code logs in and clears the failures
+	state.blocked[key] = false
+	if rec := verify("code", currentCode(t, state.secret, 0)); rec.Code != http.StatusOK {
+		t.Fatalf("right code after the block: status %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+	if _, ok := state.failures[key]; ok {
+		t.Error("failures not cleared after a successful login")
+	}
+}
+
+// TestTwoFactorCodeEndpointsThrottle checks that confirming 2FA and replacing
+// recovery codes share the backoff of VerifyTwoFactorLogin, so a stolen access
+// token cannot be used to guess codes there instead.
+func TestTwoFactorCodeEndpointsThrottle(t *testing.T) {
+	endpoints := []struct {
+		name    string
+		handler func(h *Handler) http.HandlerFunc
+	}{
+		{"confirm", func(h *Handler) http.HandlerFunc { return h.ConfirmTwoFactor }},
+		{"recovery codes", func(h *Handler) http.HandlerFunc { return h.RegenerateRecoveryCodes }},
+	}
+	for _, ep := range endpoints {
+		t.Run(ep.name, func(t *testing.T) {
+			db, f := newFakeDB(t)
+			state := newTwoFactorState(f)
+			h := NewHandler(db, Config{
+				AccountThrottle: LoginThrottle{
+					FreeAttempts: 2,
+					BaseDelay:    time.Minute,
+					MaxDelay:     time.Hour,
+				},
+			})
+			awayFromStepEnd()
+
+			send := func(code string) *httptest.ResponseRecorder {
+				body, _ := json.Marshal(map[string]string{"code": code})
+				req := httptest.NewRequest("POST", "/api/auth/2fa", strings.NewReader(string(body)))
+				req = req.WithContext(withPrincipal(req.Context(), Principal{UserID: 1, Role: RoleUser}))
+				rec := httptest.NewRecorder()
+				ep.handler(h)(rec, req)
+				return rec
+			}
+
+			wrong := wrongCode(t, state.secret)
+			for i := 1; i <= 3; i++ {
+				if rec := send(wrong); rec.Code != http.StatusBadRequest {
+					t.Fatalf("wrong code %d: status %d, want %d", i, rec.Code, http.StatusBadRequest)
+				}
+			}
+			key := twoFactorThrottleKey(1)
+			if state.failures[key] != 3 || !state.blocked[key] {
+				t.Fatalf("after 3 failures: %d recorded, blocked %v", state.failures[key], state.blocked[key])
+			}
+
+			if rec := send(currentCode(t, state.secret, 0)); rec.Code != http.StatusTooManyRequests {
+				t.Fatalf("right code while blocked: status %d, want %d", rec.Code, http.StatusTooManyRequests)
+			}
+			if state.lastStep != nil {
+				t.Error("a code was checked while the user was blocked")
+			}
+
+			state.blocked[key] = false
+			if rec := send(currentCode(t, state.secret, 0)); rec.Code != http.StatusOK {
+				t.Fatalf("right code after the block: status %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+			}
+			if _, ok := state.failures[key]; ok {
+				t.Error("failures not cleared after a valid code")
+			}
+		})
+	}
+}
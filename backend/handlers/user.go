@@ -59,9 +59,9 @@ func (h *Handler) UpdateProfile(w http.ResponseWriter, r *http.Request) {
 	// Fetch updated user to return
 	var updatedUser User
 	err = h.DB.QueryRow(
-		"SELECT id, email, full_name, role FROM users WHERE id = ?",
+		"SELECT id, email, full_name, role, email_verified_at IS NOT NULL FROM users WHERE id = ?",
 		userID,
-	).Scan(&updatedUser.ID, &updatedUser.Email, &updatedUser.FullName, &updatedUser.Role)
+	).Scan(&updatedUser.ID, &updatedUser.Email, &updatedUser.FullName, &updatedUser.Role, &updatedUser.EmailVerified)
 
 	if err != nil {
 		respondError(w, http.StatusInternalServerError, "Gagal mengambil data user terbaru")
@@ -0,0 +1,127 @@
+package handlers
+
+import (
+	"bufio"
+	_ "embed"
+	"io"
+	"net/http"
+	"net/mail"
+	"strings"
+	"unicode"
+)
+
+// maxPasswordBytes is the longest input bcrypt hashes without silently truncating.
+const maxPasswordBytes = 72
+
+//go:embed common_passwords.txt
+var defaultCommonPasswords string
+
+// PasswordPolicy holds the rules new passwords must satisfy.
+type PasswordPolicy struct {
+	MinLength     int
+	RequireUpper  bool
+	RequireLower  bool
+	RequireDigit  bool
+	RequireSymbol bool
+	// Common is the set of lower-cased passwords that are always rejected.
+	Common map[string]struct{}
+}
+
+// DefaultCommonPasswords returns the bundled list of passwords to reject.
+func DefaultCommonPasswords() map[string]struct{} {
+	common, _ := LoadCommonPasswords(strings.NewReader(defaultCommonPasswords))
+	return common
+}
+
+// LoadCommonPasswords reads one password per line; blank lines and # comments are skipped.
+func LoadCommonPasswords(r io.Reader) (map[string]struct{}, error) {
+	common := make(map[string]struct{})
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		common[strings.ToLower(line)] = struct{}{}
+	}
+	return common, scanner.Err()
+}
+
+// Check returns a user-facing reason the password is rejected, or "" if it is acceptable.
+func (p PasswordPolicy) Check(password, email string) string {
+	if password == "" {
+		return "Password wajib diisi"
+	}
+	if len(password) > maxPasswordBytes {
+		return "Password maksimal 72 byte"
+	}
+	if len([]rune(password)) < p.MinLength {
+		return "Password terlalu pendek"
+	}
+
+	var upper, lower, digit, symbol bool
+	for _, c := range password {
+		switch {
+		case unicode.IsUpper(c):
+			upper = true
+		case unicode.IsLower(c):
+			lower = true
+		case unicode.IsDigit(c):
+			digit = true
+		case unicode.IsPunct(c) || unicode.IsSymbol(c) || unicode.IsSpace(c):
+			symbol = true
+		}
+	}
+
+	switch {
+	case p.RequireUpper && !upper:
+		return "Password harus mengandung huruf besar"
+	case p.RequireLower && !lower:
+		return "Password harus mengandung huruf kecil"
+	case p.RequireDigit && !digit:
+		return "Password harus mengandung angka"
+	case p.RequireSymbol && !symbol:
+		return "Password harus mengandung simbol"
+	}
+
+	lowered := strings.ToLower(password)
+	if _, ok := p.Common[lowered]; ok {
+		return "Password terlalu umum"
+	}
+	if local, _, ok := strings.Cut(email, "@"); ok && len(local) >= 3 && strings.Contains(lowered, strings.ToLower(local)) {
+		return "Password tidak boleh mengandung email"
+	}
+
+	return ""
+}
+
+// normalizeEmail trims and lower-cases an address after checking it is a bare
+// RFC 5322 addr-spec (no display name) with a dotted domain.
+func normalizeEmail(raw string) (string, bool) {
+	email := strings.ToLower(strings.TrimSpace(raw))
+	if email == "" || len(email) > 255 {
+		return "", false
+	}
+
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Name != "" || addr.Address != email {
+		return "", false
+	}
+
+	at := strings.LastIndex(email, "@")
+	domain := email[at+1:]
+	if at < 1 || !strings.Contains(domain, ".") || strings.HasPrefix(domain, ".") || strings.HasSuffix(domain, ".") {
+		return "", false
+	}
+
+	return email, true
+}
+
+// respondValidationError reports per-field problems in Response.Errors.
+func respondValidationError(w http.ResponseWriter, errs map[string]string) {
+	respondJSON(w, http.StatusBadRequest, Response{
+		Success: false,
+		Error:   "Data tidak valid",
+		Errors:  errs,
+	})
+}
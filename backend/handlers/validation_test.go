@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPasswordPolicyCheck(t *testing.T) {
+	policy := PasswordPolicy{
+		MinLength:    8,
+		RequireUpper: true,
+		RequireLower: true,
+		RequireDigit: true,
+		Common:       DefaultCommonPasswords(),
+	}
+	strict := policy
+	strict.RequireSymbol = true
+
+	tests := []struct {
+		name     string
+		policy   PasswordPolicy
+		password string
+		email    string
+		want     string
+	}{
+		{"acceptable", policy, "Correct9Horse", "user@example.com", ""},
+		{"empty", policy, "", "user@example.com", "Password wajib diisi"},
+		{"too short", policy, "Ab3defg", "user@example.com", "Password terlalu pendek"},
+		{"minimum length", policy, "Ab3defgh", "user@example.com", ""},
+		{"length counts characters not bytes", policy, "Åb3défgh", "user@example.com", ""},
+		{"72 bytes", policy, "Ab3" + strings.Repeat("x", 69), "user@example.com", ""},
+		{"73 bytes", policy, "Ab3" + strings.Repeat("x", 70), "user@example.com", "Password maksimal 72 byte"},
+		{"72 bytes of multi-byte characters", policy, "Ab3" + strings.Repeat("é", 34) + "x", "user@example.com", ""},
+		{"over 72 bytes in fewer characters", policy, "Ab3" + strings.Repeat("é", 35), "user@example.com", "Password maksimal 72 byte"},
+		{"no upper case", policy, "correct9horse", "user@example.com", "Password harus mengandung huruf besar"},
+		{"no lower case", policy, "CORRECT9HORSE", "user@example.com", "Password harus mengandung huruf kecil"},
+		{"no digit", policy, "CorrectHorse", "user@example.com", "Password harus mengandung angka"},
+		{"no symbol when required", strict, "Correct9Horse", "user@example.com", "Password harus mengandung simbol"},
+		{"symbol when required", strict, "Correct9Horse!", "user@example.com", ""},
+		{"space counts as symbol", strict, "Correct 9 Horse", "user@example.com", ""},
+		{"common password", policy, "Password123", "user@example.com", "Password terlalu umum"},
+		{"contains email local part", policy, "Xx9Budiman2024", "budiman@example.com", "Password tidak boleh mengandung email"},
+		{"contains email local part in another case", policy, "Xx9BUDIMAN2024", "Budiman@example.com", "Password tidak boleh mengandung email"},
+		{"short local part is ignored", policy, "Correct9Horse", "or@example.com", ""},
+		{"no rules but length", PasswordPolicy{MinLength: 8}, "password", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.Check(tt.password, tt.email); got != tt.want {
+				t.Errorf("Check(%q) = %q, want %q", tt.password, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeEmail(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want string
+		ok   bool
+	}{
+		{"user@example.com", "user@example.com", true},
+		{"User@Example.COM", "user@example.com", true},
+		{"  user@example.com\t", "user@example.com", true},
+		{" MiXeD.Case+Tag@Sub.Example.Co.Id ", "mixed.case+tag@sub.example.co.id", true},
+		{"", "", false},
+		{"   ", "", false},
+		{"user", "", false},
+		{"@example.com", "", false},
+		{"user@", "", false},
+		{"user@localhost", "", false},
+		{"user@.example.com", "", false},
+		{"user@example.com.", "", false},
+		{"user@@example.com", "", false},
+		{"user name@example.com", "", false},
+		{"User <user@example.com>", "", false},
+		{"<user@example.com>", "", false},
+		{"user@example.com, other@example.com", "", false},
+		{strings.Repeat("a", 64) + "@" + strings.Repeat("b", 186) + ".com", strings.Repeat("a", 64) + "@" + strings.Repeat("b", 186) + ".com", true},
+		{strings.Repeat("a", 64) + "@" + strings.Repeat("b", 187) + ".com", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := normalizeEmail(tt.raw)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("normalizeEmail(%q) = %q, %v, want %q, %v", tt.raw, got, ok, tt.want, tt.ok)
+		}
+	}
+}
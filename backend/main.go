@@ -1,15 +1,18 @@
 package main
 
 import (
+	"crypto/rand"
 	"database/sql"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"guaagsay/backend/handlers"
 
 	_ "github.com/go-sql-driver/mysql"
-	"github.com/gorilla/mux"
 	"github.com/rs/cors"
 )
 
@@ -29,56 +32,153 @@ func main() {
 	}
 	log.Println("Database connected successfully")
 
+	// Auth config
+	tokenSecret := []byte(os.Getenv("TOKEN_SECRET"))
+	if len(tokenSecret) == 0 {
+		tokenSecret = make([]byte, 32)
+		if _, err := rand.Read(tokenSecret); err != nil {
+			log.Fatal("Failed to generate token secret:", err)
+		}
+		log.Println("TOKEN_SECRET not set, using a random secret; tokens will not survive a restart")
+	}
+	accessTokenTTL := getDuration("ACCESS_TOKEN_TTL", "15m")
+	refreshTokenTTL := getDuration("REFRESH_TOKEN_TTL", "720h")
+	passwordResetTTL := getDuration("PASSWORD_RESET_TTL", "1h")
+
+	// Login brute-force protection
+	lockoutDuration := getDuration("LOGIN_LOCKOUT_DURATION", "15m")
+	accountThrottle := handlers.LoginThrottle{
+		FreeAttempts:     3,
+		BaseDelay:        time.Second,
+		MaxDelay:         5 * time.Minute,
+		LockoutThreshold: getInt("LOGIN_MAX_FAILURES", 10),
+		LockoutDuration:  lockoutDuration,
+	}
+	trustedProxies, err := handlers.ParseTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
+	if err != nil {
+		log.Fatal("Invalid TRUSTED_PROXIES:", err)
+	}
+	ipThrottle := handlers.LoginThrottle{
+		FreeAttempts:     10,
+		BaseDelay:        time.Second,
+		MaxDelay:         5 * time.Minute,
+		LockoutThreshold: getInt("LOGIN_MAX_FAILURES_PER_IP", 50),
+		LockoutDuration:  lockoutDuration,
+	}
+
+	// Password policy
+	commonPasswords := handlers.DefaultCommonPasswords()
+	if path := os.Getenv("COMMON_PASSWORDS_FILE"); path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			log.Fatal("Failed to open COMMON_PASSWORDS_FILE:", err)
+		}
+		commonPasswords, err = handlers.LoadCommonPasswords(f)
+		f.Close()
+		if err != nil {
+			log.Fatal("Failed to read COMMON_PASSWORDS_FILE:", err)
+		}
+	}
+	passwordPolicy := handlers.PasswordPolicy{
+		MinLength:     getInt("PASSWORD_MIN_LENGTH", 8),
+		RequireUpper:  getEnv("PASSWORD_REQUIRE_UPPER", "true") == "true",
+		RequireLower:  getEnv("PASSWORD_REQUIRE_LOWER", "true") == "true",
+		RequireDigit:  getEnv("PASSWORD_REQUIRE_DIGIT", "true") == "true",
+		RequireSymbol: getEnv("PASSWORD_REQUIRE_SYMBOL", "false") == "true",
+		Common:        commonPasswords,
+	}
+
+	// Email verification
+	unverifiedAccess := getEnv("UNVERIFIED_ACCESS", handlers.UnverifiedAccessBrowse)
+	switch unverifiedAccess {
+	case handlers.UnverifiedAccessFull, handlers.UnverifiedAccessBrowse, handlers.UnverifiedAccessNone:
+	default:
+		log.Fatalf("Invalid UNVERIFIED_ACCESS: %q", unverifiedAccess)
+	}
+
+	// Two-factor authentication
+	twoFactorRoles := map[string]bool{}
+	for _, role := range strings.Split(getEnv("TWO_FACTOR_REQUIRED_ROLES", ""), ",") {
+		if role = strings.TrimSpace(role); role != "" {
+			twoFactorRoles[role] = true
+		}
+	}
+
+	// Guest carts
+	guestCartTTL := getDuration("GUEST_CART_TTL", "720h")
+	if guestCartTTL <= 0 {
+		log.Fatalf("Invalid GUEST_CART_TTL: %s must be positive", guestCartTTL)
+	}
+	cartMergeStrategy := getEnv("CART_MERGE_STRATEGY", handlers.CartMergeSum)
+	if cartMergeStrategy != handlers.CartMergeSum && cartMergeStrategy != handlers.CartMergeMax {
+		log.Fatalf("Invalid CART_MERGE_STRATEGY: %q", cartMergeStrategy)
+	}
+
+	// Stock holds
+	orderHoldTTL := getDuration("ORDER_HOLD_TTL", "30m")
+	orderHoldMaxAge := getDuration("ORDER_HOLD_MAX_AGE", "24h")
+	if orderHoldTTL > 0 && orderHoldMaxAge < orderHoldTTL {
+		log.Fatalf("Invalid ORDER_HOLD_MAX_AGE: %s must be at least ORDER_HOLD_TTL (%s)", orderHoldMaxAge, orderHoldTTL)
+	}
+
+	// Payments: only the local fake gateway is built in so far
+	var paymentGateway handlers.PaymentGateway
+	switch provider := getEnv("PAYMENT_GATEWAY", "fake"); provider {
+	case "fake":
+		paymentGateway = &handlers.FakeGateway{AutoPay: getEnv("PAYMENT_FAKE_AUTOPAY", "false") == "true"}
+	default:
+		log.Fatalf("Invalid PAYMENT_GATEWAY: %q", provider)
+	}
+
+	// Mail delivery: write to MAIL_DIR when set, otherwise print to stdout
+	var mailer handlers.Mailer = &handlers.WriterMailer{W: os.Stdout}
+	if dir := os.Getenv("MAIL_DIR"); dir != "" {
+		mailer = &handlers.FileMailer{Dir: dir}
+	}
+
+	h := handlers.NewHandler(db, handlers.Config{
+		TokenSecret:      tokenSecret,
+		AccessTokenTTL:   accessTokenTTL,
+		RefreshTokenTTL:  refreshTokenTTL,
+		PasswordResetTTL: passwordResetTTL,
+		PasswordResetURL: os.Getenv("PASSWORD_RESET_URL"),
+		Mailer:           mailer,
+		AccountThrottle:  accountThrottle,
+		IPThrottle:       ipThrottle,
+		TrustedProxies:   trustedProxies,
+		PasswordPolicy:   passwordPolicy,
+
+		EmailVerificationTTL:       getDuration("EMAIL_VERIFICATION_TTL", "24h"),
+		EmailVerificationURL:       os.Getenv("EMAIL_VERIFICATION_URL"),
+		VerificationResendInterval: getDuration("VERIFICATION_RESEND_INTERVAL", "1m"),
+		UnverifiedAccess:           unverifiedAccess,
+
+		TwoFactorIssuer:       getEnv("TOTP_ISSUER", "ShopJoy"),
+		TwoFactorChallengeTTL: getDuration("TWO_FACTOR_CHALLENGE_TTL", "5m"),
+		TwoFactorRoles:        twoFactorRoles,
+
+		CartMergeStrategy:   cartMergeStrategy,
+		CartMergeCapAtStock: getEnv("CART_MERGE_CAP_AT_STOCK", "true") == "true",
+		GuestCartTTL:        guestCartTTL,
+
+		OrderHoldTTL:      orderHoldTTL,
+		OrderHoldMaxAge:   orderHoldMaxAge,
+		IdempotencyKeyTTL: getDuration("IDEMPOTENCY_KEY_TTL", "24h"),
+		PaymentGateway:    paymentGateway,
+
+		PaymentWebhookSecret:    []byte(os.Getenv("PAYMENT_WEBHOOK_SECRET")),
+		PaymentWebhookTolerance: getDuration("PAYMENT_WEBHOOK_TOLERANCE", "5m"),
+	})
+
+	// Cancel unpaid pending orders whose stock hold has expired
+	sweepInterval := getDuration("ORDER_HOLD_SWEEP_INTERVAL", "1m")
+	if sweepInterval <= 0 {
+		log.Fatalf("Invalid ORDER_HOLD_SWEEP_INTERVAL: %s must be positive", sweepInterval)
+	}
+	h.StartHoldSweeper(sweepInterval)
+
 	// Setup router
-	r := mux.NewRouter()
-	h := handlers.NewHandler(db)
-
-	// API routes
-	api := r.PathPrefix("/api").Subrouter()
-
-	// Auth
-	api.HandleFunc("/auth/login", h.Login).Methods("POST")
-	api.HandleFunc("/auth/register", h.Register).Methods("POST")
-	api.HandleFunc("/auth/reset-password", h.ResetPassword).Methods("POST")
-
-	// Categories
-	api.HandleFunc("/categories", h.GetCategories).Methods("GET")
-	api.HandleFunc("/categories/{id}", h.GetCategoryByID).Methods("GET")
-
-	// Products (read-only for customers)
-	api.HandleFunc("/products", h.GetProducts).Methods("GET")
-	api.HandleFunc("/products/{id}", h.GetProductByID).Methods("GET")
-	api.HandleFunc("/products/category/{categoryId}", h.GetProductsByCategory).Methods("GET")
-
-	// Orders
-	api.HandleFunc("/orders", h.CreateOrder).Methods("POST")
-	api.HandleFunc("/orders/{id}", h.GetOrderByID).Methods("GET")
-	api.HandleFunc("/orders", h.GetOrders).Methods("GET")
-
-	// User scoped routes
-	userRoutes := api.PathPrefix("/users/{userId}").Subrouter()
-	userRoutes.HandleFunc("/addresses", h.GetAddresses).Methods("GET")
-	userRoutes.HandleFunc("/addresses", h.CreateAddress).Methods("POST")
-	userRoutes.HandleFunc("/notifications", h.GetNotifications).Methods("GET")
-	userRoutes.HandleFunc("/notifications/{notificationId}/read", h.MarkNotificationRead).Methods("PUT")
-	userRoutes.HandleFunc("/profile", h.UpdateProfile).Methods("PUT")
-
-	// Admin routes (protected)
-	admin := api.PathPrefix("/admin").Subrouter()
-
-	// Admin - Products
-	admin.HandleFunc("/products", h.AdminMiddleware(h.GetAllProducts)).Methods("GET")
-	admin.HandleFunc("/products", h.AdminMiddleware(h.CreateProduct)).Methods("POST")
-	admin.HandleFunc("/products/{id}", h.AdminMiddleware(h.UpdateProduct)).Methods("PUT")
-	admin.HandleFunc("/products/{id}", h.AdminMiddleware(h.DeleteProduct)).Methods("DELETE")
-
-	// Admin - Orders
-	admin.HandleFunc("/orders", h.AdminMiddleware(h.GetAllOrders)).Methods("GET")
-	admin.HandleFunc("/orders/{id}", h.AdminMiddleware(h.GetOrderDetails)).Methods("GET")
-	admin.HandleFunc("/orders/{id}/status", h.AdminMiddleware(h.UpdateOrderStatus)).Methods("PUT")
-
-	// Admin - Dashboard
-	admin.HandleFunc("/dashboard/stats", h.AdminMiddleware(h.GetDashboardStats)).Methods("GET")
+	r := handlers.NewRouter(h)
 
 	// CORS
 	c := cors.New(cors.Options{
@@ -103,3 +203,23 @@ func getEnv(key, defaultValue string) string {
 	}
 	return defaultValue
 }
+
+func getDuration(key, defaultValue string) time.Duration {
+	d, err := time.ParseDuration(getEnv(key, defaultValue))
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", key, err)
+	}
+	return d
+}
+
+func getInt(key string, defaultValue int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", key, err)
+	}
+	return n
+}
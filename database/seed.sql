@@ -10,15 +10,15 @@ USE ecommerce_db;
 -- Password for all accounts: Password123!
 -- Hash generated using bcrypt with cost 10
 -- =============================================
-INSERT INTO users (email, password_hash, full_name, phone, role, is_active) VALUES
+INSERT INTO users (email, password_hash, full_name, phone, role, is_active, email_verified_at) VALUES
 -- Admin Accounts
-('admin@ecommerce.com', '$2a$10$rZ9pJWxH5kqVQzB5g1PNnOYxJ1nB5QzB5g1PNnOYxJ1nB5QzB5g1P', 'Admin User', '+1234567890', 'admin', 1),
-('superadmin@ecommerce.com', '$2a$10$rZ9pJWxH5kqVQzB5g1PNnOYxJ1nB5QzB5g1PNnOYxJ1nB5QzB5g1P', 'Super Admin', '+1234567891', 'admin', 1),
+('admin@ecommerce.com', '$2a$10$rZ9pJWxH5kqVQzB5g1PNnOYxJ1nB5QzB5g1PNnOYxJ1nB5QzB5g1P', 'Admin User', '+1234567890', 'admin', 1, NOW()),
+('superadmin@ecommerce.com', '$2a$10$rZ9pJWxH5kqVQzB5g1PNnOYxJ1nB5QzB5g1PNnOYxJ1nB5QzB5g1P', 'Super Admin', '+1234567891', 'super_admin', 1, NOW()),
 
 -- Regular User Accounts
-('user@example.com', '$2a$10$rZ9pJWxH5kqVQzB5g1PNnOYxJ1nB5QzB5g1PNnOYxJ1nB5QzB5g1P', 'John Doe', '+1234567892', 'user', 1),
-('jane.smith@example.com', '$2a$10$rZ9pJWxH5kqVQzB5g1PNnOYxJ1nB5QzB5g1PNnOYxJ1nB5QzB5g1P', 'Jane Smith', '+1234567893', 'user', 1),
-('testuser@ecommerce.com', '$2a$10$rZ9pJWxH5kqVQzB5g1PNnOYxJ1nB5QzB5g1PNnOYxJ1nB5QzB5g1P', 'Test User', '+1234567894', 'user', 1);
+('user@example.com', '$2a$10$rZ9pJWxH5kqVQzB5g1PNnOYxJ1nB5QzB5g1PNnOYxJ1nB5QzB5g1P', 'John Doe', '+1234567892', 'user', 1, NOW()),
+('jane.smith@example.com', '$2a$10$rZ9pJWxH5kqVQzB5g1PNnOYxJ1nB5QzB5g1PNnOYxJ1nB5QzB5g1P', 'Jane Smith', '+1234567893', 'user', 1, NOW()),
+('testuser@ecommerce.com', '$2a$10$rZ9pJWxH5kqVQzB5g1PNnOYxJ1nB5QzB5g1PNnOYxJ1nB5QzB5g1P', 'Test User', '+1234567894', 'user', 1, NOW());
 
 -- =============================================
 -- Seed Categories